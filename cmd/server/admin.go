@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+// adminAuth restricts an admin handler to requests with the admin bearer token
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.AdminToken == "" {
+			http.Error(w, "Admin endpoints disabled", http.StatusForbidden)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gokvs admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cfg.redacted()); err != nil {
+		log.Printf("ERROR in json.Encode for admin config: %v\n", err)
+	}
+}
+
+// adminFlushLogHandler makes the logged events durable, e.g. before taking
+// a filesystem snapshot
+func adminFlushLogHandler(w http.ResponseWriter, r *http.Request) {
+	if err := transact.Flush(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("FLUSH transaction log\n")
+}
+
+// adminCompactLogHandler rewrites the transaction log without the events
+// superseded by later ones, to shorten the replay at startup
+func adminCompactLogHandler(w http.ResponseWriter, r *http.Request) {
+	dropped, err := transact.Compact()
+	if errors.Is(err, internal.ErrorReadOnlyLog) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"dropped": dropped}); err != nil {
+		log.Printf("ERROR in json.Encode for compact-log: %v\n", err)
+	}
+	log.Printf("COMPACT transaction log, %d events dropped\n", dropped)
+}
+
+// adminReadOnlyHandler pauses the writes with ?enabled=true, e.g. for a
+// backup, and resumes them with ?enabled=false
+func adminReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "invalid enabled, expected true or false", http.StatusBadRequest)
+		return
+	}
+
+	setMaintenance(enabled)
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("READONLY enabled=%t\n", enabled)
+}
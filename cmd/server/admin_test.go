@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+func TestAdminConfig(t *testing.T) {
+	c, err := parseConfig([]string{"-rate-limit=5", "-admin-token=s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, func(current *config) { *current = c })
+
+	handler := adminAuth(adminConfigHandler)
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/config", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	if rr := get(""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("without token: got status %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := get("wrong"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got status %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	rr := get("s3cret")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if strings.Contains(rr.Body.String(), "s3cret") {
+		t.Errorf("admin token leaked: %s", rr.Body)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["rate_limit"] != 5.0 {
+		t.Errorf("rate_limit = %v, want 5", got["rate_limit"])
+	}
+	if got["admin_token"] != "REDACTED" {
+		t.Errorf("admin_token = %v, want REDACTED", got["admin_token"])
+	}
+}
+
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	setConfig(t, func(c *config) { c.AdminToken = "" })
+
+	rr := httptest.NewRecorder()
+	adminAuth(adminConfigHandler)(rr, httptest.NewRequest("GET", "/admin/config", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestAdminFlushLog(t *testing.T) {
+	setupMetrics()
+	setConfig(t, func(c *config) { c.AdminToken = "s3cret" })
+
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	var err error
+	if transact, err = internal.NewTransactionLogger(filename); err != nil {
+		t.Fatal(err)
+	}
+	transact.Run()
+	defer transact.Close()
+
+	const writes = 50
+	for i := 0; i < writes; i++ {
+		transact.WritePut(fmt.Sprintf("flush-key-%d", i), "value")
+	}
+
+	req := httptest.NewRequest("POST", "/admin/flush-log", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	adminAuth(adminFlushLogHandler)(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusNoContent)
+	}
+
+	// Every event is on disk, without closing the logger
+	reopened, err := internal.NewReadOnlyTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	count, err := reopened.Replay(func(internal.Event) error { return nil })
+	if err != nil || count != writes {
+		t.Errorf("reopened log: got %d events, %v; want %d", count, err, writes)
+	}
+}
+
+func TestAdminCompactLog(t *testing.T) {
+	setupMetrics()
+	setConfig(t, func(c *config) { c.AdminToken = "s3cret" })
+
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	var err error
+	if transact, err = internal.NewTransactionLogger(filename); err != nil {
+		t.Fatal(err)
+	}
+	transact.Run()
+	defer transact.Close()
+
+	for i := 0; i < 10; i++ {
+		transact.WritePut("compact-key", fmt.Sprintf("value-%d", i))
+	}
+	transact.WritePut("compact-deleted", "value")
+	transact.WriteDelete("compact-deleted")
+
+	req := httptest.NewRequest("POST", "/admin/compact-log", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	adminAuth(adminCompactLogHandler)(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if got, want := strings.TrimSpace(rr.Body.String()), `{"dropped":11}`; got != want {
+		t.Errorf("got body %s, want %s", got, want)
+	}
+
+	// The replay of the compacted log restores the same state
+	if _, err := internal.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+	if value, err := internal.Get("compact-key"); err != nil || value != "value-9" {
+		t.Errorf("compact-key: got %q, %v; want %q", value, err, "value-9")
+	}
+	if _, err := internal.Get("compact-deleted"); !errors.Is(err, internal.ErrorNoSuchKey) {
+		t.Errorf("compact-deleted: got error %v, want %v", err, internal.ErrorNoSuchKey)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// isWriteMethod reports whether the method mutates the store
+func isWriteMethod(method string) bool {
+	return method == http.MethodPut || method == http.MethodDelete || method == http.MethodPost
+}
+
+// readPostPaths are the POST routes that only read the store, taking their
+// keys in the body as they may not fit in a URL
+var readPostPaths = map[string]bool{
+	"/v1/mget":     true,
+	"/v1:batchGet": true,
+}
+
+// dryRunPostPaths are the POST routes previewing their writes with ?dry-run,
+// see queryDryRun
+var dryRunPostPaths = map[string]bool{
+	"/v1:batch":    true,
+	"/v1:batchPut": true,
+	"/v1/import":   true,
+}
+
+// isWriteRequest reports whether the request mutates the store, by its method
+// and, for the POST requests, its route and dry-run
+func isWriteRequest(r *http.Request) bool {
+	if r.Method == http.MethodPost && readPostPaths[r.URL.Path] {
+		return false
+	}
+	if r.Method == http.MethodPost && dryRunPostPaths[r.URL.Path] {
+		if dryRun, err := queryDryRun(r); err == nil && dryRun {
+			return false
+		}
+	}
+	return isWriteMethod(r.Method)
+}
+
+// newWriteLimitMiddleware bounds the concurrent writes, so a spike doesn't
+// overwhelm the transaction log. Extra writes are shed with 503, reads are
+// never limited.
+func newWriteLimitMiddleware(maxInflight int) mux.MiddlewareFunc {
+	sem := make(chan struct{}, maxInflight)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isWriteRequest(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+				next.ServeHTTP(w, r)
+			default:
+				m.WritesShed.Inc()
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Too many writes inflight", http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
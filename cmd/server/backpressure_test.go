@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWriteLimitShedsWrites(t *testing.T) {
+	setupMetrics()
+
+	const maxInflight = 2
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := newWriteLimitMiddleware(maxInflight)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			entered <- struct{}{}
+			<-release // Slow write holding its slot
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	do := func(method string) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, "/v1/key", nil))
+		return rr.Code
+	}
+
+	shed := testutil.ToFloat64(m.WritesShed)
+
+	// Saturate the writes
+	var wg sync.WaitGroup
+	for i := 0; i < maxInflight; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := do("PUT"); code != http.StatusOK {
+				t.Errorf("inflight PUT: got status %d, want %d", code, http.StatusOK)
+			}
+		}()
+		<-entered
+	}
+
+	if code := do("DELETE"); code != http.StatusServiceUnavailable {
+		t.Errorf("write over the limit: got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := do("GET"); code != http.StatusOK {
+		t.Errorf("read while saturated: got status %d, want %d", code, http.StatusOK)
+	}
+	for _, path := range []string{"/v1/mget", "/v1:batchGet"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", path, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("POST %s while saturated: got status %d, want %d", path, rr.Code, http.StatusOK)
+		}
+	}
+	if got := testutil.ToFloat64(m.WritesShed) - shed; got != 1 {
+		t.Errorf("got %v shed writes, want 1", got)
+	}
+
+	close(release)
+	wg.Wait()
+
+	// Slots are given back
+	if code := do("DELETE"); code != http.StatusOK {
+		t.Errorf("write after release: got status %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+// batchResult reports whether an op of the batch was applied
+type batchResult struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Applied bool   `json:"applied"`
+}
+
+// keyValueBatchHandler applies a JSON array of ops atomically, ops with an
+// "if" condition ("exists" or "absent") are skipped when it does not hold
+func keyValueBatchHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	dryRun, err := queryDryRun(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ops []internal.Op
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, fmt.Sprintf("invalid batch: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !checkBatchSize(w, len(ops)) {
+		return
+	}
+	for i, op := range ops {
+		if !checkKeyPrefix(w, op.Key) {
+			return
+		}
+		if err := validateWrite(op.Key, op.Value); err != nil {
+			http.Error(w, fmt.Sprintf("op %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if dryRun {
+		writeDryRun(w, ops, "BATCH")
+		return
+	}
+
+	applied, err := internal.Batch(ops)
+	if errors.Is(err, internal.ErrorInvalidOp) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	results := make([]batchResult, len(ops))
+	count := 0
+	for i, op := range ops {
+		results[i] = batchResult{Op: op.Op, Key: op.Key, Applied: applied[i]}
+		if !applied[i] {
+			continue
+		}
+
+		switch op.Op {
+		case internal.OpPut:
+			transact.WritePut(op.Key, op.Value)
+			m.EventsPut.Inc()
+		case internal.OpDelete:
+			transact.WriteDelete(op.Key)
+			m.EventsDelete.Inc()
+		}
+		count++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Printf("ERROR in json.Encode for BATCH\n")
+	}
+
+	log.Printf("BATCH ops=%d applied=%d\n", len(ops), count)
+}
+
+// keyValueBatchPutHandler stores all the pairs of a JSON object at once, each
+// logged as its own PUT
+func keyValueBatchPutHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	dryRun, err := queryDryRun(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var pairs map[string]string
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&pairs); err != nil {
+		http.Error(w, fmt.Sprintf("invalid pairs: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !checkBatchSize(w, len(pairs)) {
+		return
+	}
+	for key, value := range pairs {
+		if !checkKeyPrefix(w, key) {
+			return
+		}
+		if err := validateWrite(key, value); err != nil {
+			http.Error(w, fmt.Sprintf("key %s: %v", key, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if dryRun {
+		writeDryRun(w, putOps(pairs), "BATCHPUT")
+		return
+	}
+
+	if err := internal.PutMulti(pairs); err != nil {
+		storeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+
+	for key, value := range pairs {
+		transact.WritePut(key, value)
+	}
+	m.EventsPut.Add(float64(len(pairs)))
+	log.Printf("BATCHPUT keys=%d\n", len(pairs))
+}
+
+// checkBatchSize answers 400 to a request over -max-batch-size items
+func checkBatchSize(w http.ResponseWriter, n int) bool {
+	if cfg.MaxBatchSize > 0 && n > cfg.MaxBatchSize {
+		http.Error(w, fmt.Sprintf("too many items, %d over the maximum of %d", n, cfg.MaxBatchSize), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// dryRunReport lists the keys a bulk write would change, answered instead of
+// applying it with ?dry-run=1
+type dryRunReport struct {
+	New         []string `json:"new"`
+	Overwritten []string `json:"overwritten"`
+	Deleted     []string `json:"deleted"`
+}
+
+// queryDryRun parses the optional ?dry-run= query parameter
+func queryDryRun(r *http.Request) (bool, error) {
+	s := r.URL.Query().Get("dry-run")
+	if s == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid dry-run %q", s)
+	}
+	return dryRun, nil
+}
+
+// writeDryRun answers the keys the ops would change, leaving the store and
+// the transaction log untouched
+func writeDryRun(w http.ResponseWriter, ops []internal.Op, name string) {
+	changes, err := internal.PreviewBatch(ops)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report := dryRunReport{New: []string{}, Overwritten: []string{}, Deleted: []string{}}
+	for i, change := range changes {
+		switch change {
+		case internal.ChangeNew:
+			report.New = append(report.New, ops[i].Key)
+		case internal.ChangeOverwrite:
+			report.Overwritten = append(report.Overwritten, ops[i].Key)
+		case internal.ChangeDelete:
+			report.Deleted = append(report.Deleted, ops[i].Key)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("ERROR in json.Encode for %s dry-run\n", name)
+	}
+
+	log.Printf("%s dry-run ops=%d new=%d overwritten=%d deleted=%d\n",
+		name, len(ops), len(report.New), len(report.Overwritten), len(report.Deleted))
+}
+
+// putOps returns the puts of the pairs, sorted by key
+func putOps(pairs map[string]string) []internal.Op {
+	ops := make([]internal.Op, 0, len(pairs))
+	for key, value := range pairs {
+		ops = append(ops, internal.Op{Op: internal.OpPut, Key: key, Value: value})
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Key < ops[j].Key })
+	return ops
+}
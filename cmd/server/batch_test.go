@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/davidaparicio/gokvs/internal"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBatchConditionalOps(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	router.HandleFunc("/v1:batch", keyValueBatchHandler).Methods("POST")
+
+	if err := internal.Put("batch-existing", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `[
+		{"op":"put","key":"batch-existing","value":"new","if":"absent"},
+		{"op":"put","key":"batch-fresh","value":"value","if":"absent"},
+		{"op":"delete","key":"batch-existing","if":"exists"}
+	]`
+	req := httptest.NewRequest("POST", "/v1:batch", bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d (%s)", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	var results []batchResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	want := []bool{false, true, true}
+	for i := range want {
+		if results[i].Applied != want[i] {
+			t.Errorf("op %d: applied = %v, want %v", i, results[i].Applied, want[i])
+		}
+	}
+
+	if value, _ := internal.Get("batch-fresh"); value != "value" {
+		t.Errorf("batch-fresh = %q, want %q", value, "value")
+	}
+	if _, err := internal.Get("batch-existing"); err == nil {
+		t.Error("batch-existing should be deleted")
+	}
+
+	// Unknown ops reject the whole batch
+	req = httptest.NewRequest("POST", "/v1:batch", bytes.NewBufferString(`[{"op":"nope","key":"k"}]`))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid op: got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	setupTransactionLog(t)
+	setConfig(t, func(c *config) { c.MaxBatchSize = 2 })
+
+	post := func(handler http.HandlerFunc, body string) int {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("POST", "/", bytes.NewBufferString(body)))
+		return rr.Code
+	}
+
+	ops := `[{"op":"put","key":"max-batch-1","value":"v"},{"op":"put","key":"max-batch-2","value":"v"},{"op":"put","key":"max-batch-3","value":"v"}]`
+	if code := post(keyValueBatchHandler, ops); code != http.StatusBadRequest {
+		t.Errorf("batch over the limit: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	if _, err := internal.Get("max-batch-1"); err != internal.ErrorNoSuchKey {
+		t.Errorf("refused batch applied: got error %v, want %v", err, internal.ErrorNoSuchKey)
+	}
+	if code := post(keyValueMultiGetHandler, `["a", "b", "c"]`); code != http.StatusBadRequest {
+		t.Errorf("mget over the limit: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := post(keyValueMultiGetHandler, `["a", "b"]`); code != http.StatusOK {
+		t.Errorf("mget at the limit: got status %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestBatchPutAtomic(t *testing.T) {
+	setupTransactionLog(t)
+	keys := []string{"batch-put:a", "batch-put:b", "batch-put:c"}
+	pairs := func(value string) string {
+		body, _ := json.Marshal(map[string]string{keys[0]: value, keys[1]: value, keys[2]: value})
+		return string(body)
+	}
+	put := func(value string) int {
+		rr := httptest.NewRecorder()
+		keyValueBatchPutHandler(rr, httptest.NewRequest("POST", "/v1:batchPut", bytes.NewBufferString(pairs(value))))
+		return rr.Code
+	}
+	if code := put("v0"); code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d", code, http.StatusCreated)
+	}
+
+	// Readers see all the keys at the same version, never a mix
+	stop := make(chan struct{})
+	mixed := make(chan map[string]string, 1)
+	go func() {
+		defer close(mixed)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			values := internal.GetMulti(keys)
+			if values[keys[0]] != values[keys[1]] || values[keys[1]] != values[keys[2]] {
+				mixed <- values
+				return
+			}
+		}
+	}()
+
+	for i := 1; i <= 200; i++ {
+		if code := put("v" + strconv.Itoa(i)); code != http.StatusCreated {
+			t.Fatalf("got status %d, want %d", code, http.StatusCreated)
+		}
+	}
+	close(stop)
+	if values, ok := <-mixed; ok {
+		t.Errorf("read a half-applied batch: %v", values)
+	}
+}
+
+func TestBatchDryRun(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	router.HandleFunc("/v1:batch", keyValueBatchHandler).Methods("POST")
+	router.HandleFunc("/v1/import", keyValueImportHandler).Methods("POST")
+	for _, key := range []string{"dry:existing", "dry:deleted"} {
+		if err := internal.Put(key, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _ = internal.Delete("dry:fresh")
+	puts, deletes := testutil.ToFloat64(m.EventsPut), testutil.ToFloat64(m.EventsDelete)
+
+	dryRun := func(path, body string) dryRunReport {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", path, bytes.NewBufferString(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d (%s)", path, rr.Code, http.StatusOK, rr.Body)
+		}
+		var report dryRunReport
+		if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	report := dryRun("/v1:batch?dry-run=1", `[
+		{"op":"put","key":"dry:existing","value":"new"},
+		{"op":"put","key":"dry:fresh","value":"new"},
+		{"op":"delete","key":"dry:deleted"},
+		{"op":"delete","key":"dry:missing"},
+		{"op":"put","key":"dry:deleted","value":"new","if":"exists"}
+	]`)
+	want := dryRunReport{New: []string{"dry:fresh"}, Overwritten: []string{"dry:existing"}, Deleted: []string{"dry:deleted"}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("batch dry-run = %+v, want %+v", report, want)
+	}
+
+	report = dryRun("/v1/import?dry-run=true", `{"dry:fresh":"new","dry:existing":"new"}`)
+	want = dryRunReport{New: []string{"dry:fresh"}, Overwritten: []string{"dry:existing"}, Deleted: []string{}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("import dry-run = %+v, want %+v", report, want)
+	}
+
+	// Neither the store nor the log changed
+	for key, want := range map[string]string{"dry:existing": "old", "dry:deleted": "old"} {
+		if value, _ := internal.Get(key); value != want {
+			t.Errorf("%s = %q, want %q", key, value, want)
+		}
+	}
+	if _, err := internal.Get("dry:fresh"); err == nil {
+		t.Error("dry:fresh was stored by a dry-run")
+	}
+	if testutil.ToFloat64(m.EventsPut) != puts || testutil.ToFloat64(m.EventsDelete) != deletes {
+		t.Error("a dry-run logged events")
+	}
+}
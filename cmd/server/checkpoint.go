@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+// checkpointPath is the checkpoint of the transaction log at logPath
+func checkpointPath(logPath string) string {
+	return logPath + ".checkpoint"
+}
+
+// loadCheckpoint stores the checkpoint of the transaction log, if any, and
+// makes the replay skip the events it covers. A checkpoint that can't be
+// loaded is ignored, the log still holds all the events.
+func loadCheckpoint(logPath string) {
+	c, err := internal.ReadCheckpoint(checkpointPath(logPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		err = internal.LoadCheckpoint(c)
+	}
+	if err != nil {
+		log.Printf("WARNING: %v, replaying the whole transaction log\n", err)
+		return
+	}
+
+	transact.ReplayAfter(c.Sequence)
+	log.Printf("%d keys loaded from the checkpoint of event %d\n", len(c.Pairs), c.Sequence)
+}
+
+// writeCheckpoint checkpoints the store at the last event written, so the
+// next startup only replays the events after it
+func writeCheckpoint(logPath string) error {
+	seq := transact.LastSequence()
+	if err := internal.WriteCheckpoint(checkpointPath(logPath), internal.TakeCheckpoint(seq)); err != nil {
+		return err
+	}
+
+	transact.MarkSnapshot(seq)
+	log.Printf("CHECKPOINT event=%d\n", seq)
+	return nil
+}
+
+// checkpointEvery writes a checkpoint at each interval with new events
+func checkpointEvery(logPath string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if transact.PendingReplay() == 0 {
+			continue
+		}
+		if err := writeCheckpoint(logPath); err != nil {
+			log.Printf("ERROR in CHECKPOINT: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+func TestCheckpointReplay(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+
+	if _, err := internal.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{"checkpointed": "v1", "overwritten": "v1", "deleted": "v1"} {
+		if err := internal.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		transact.WritePut(key, value)
+	}
+	transact.Wait()
+	if err := writeCheckpoint(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tail, after the checkpoint
+	transact.WritePut("overwritten", "v2")
+	transact.WriteDelete("deleted")
+	transact.WritePut("added", "v1")
+	if err := transact.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := internal.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+
+	if got := transact.ReplayedByType()[internal.EventPut] + transact.ReplayedByType()[internal.EventDelete]; got != 3 {
+		t.Errorf("replayed %d events, want the 3 after the checkpoint", got)
+	}
+	for key, want := range map[string]string{"checkpointed": "v1", "overwritten": "v2", "added": "v1"} {
+		if got, err := internal.Get(key); err != nil || got != want {
+			t.Errorf("Get(%q) = %q, %v; want %q", key, got, err, want)
+		}
+	}
+	if _, err := internal.Get("deleted"); !errors.Is(err, internal.ErrorNoSuchKey) {
+		t.Errorf("Get(deleted): got error %v, want %v", err, internal.ErrorNoSuchKey)
+	}
+
+	// The new events are numbered after the replayed ones
+	if got := transact.LastSequence(); got != 6 {
+		t.Errorf("LastSequence() = %d, want 6", got)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+// config holds the server settings, set from the command line flags
+type config struct {
+	Addr            string        `json:"addr"`             // TCP address to listen on
+	KeepAlivePeriod time.Duration `json:"keepalive_period"` // TCP keep-alive probes interval
+	UnixSocket      string        `json:"unix_socket"`      // Unix domain socket to listen on, in addition to Addr
+	ReusePort       bool          `json:"reuse_port"`       // SO_REUSEADDR and SO_REUSEPORT on the TCP listener, for fast restarts
+	ListenBacklog   int           `json:"listen_backlog"`   // Connections queued before accept, 0 keeps the system maximum
+	TLSCert         string        `json:"tls_cert"`         // Server certificate PEM file, serves TLS on Addr when set
+	TLSKey          string        `json:"tls_key"`          // Private key PEM file of TLSCert
+	TLSClientCA     string        `json:"tls_client_ca"`    // CAs of the required client certificates (mutual TLS)
+	DrainGrace      time.Duration `json:"drain_grace"`      // Wait for the inflight queries on shutdown, 0 waits forever
+	HeaderTimeout   time.Duration `json:"header_timeout"`   // Slow clients defense: time to send the headers
+	RequestTimeout  time.Duration `json:"request_timeout"`  // Slow clients defense: time to send the whole request
+	IdleTimeout     time.Duration `json:"idle_timeout"`     // Slow clients defense: keep-alive connection unused
+	ShutdownFlush   bool          `json:"shutdown_flush"`   // Write the queued log events on shutdown, or drop them
+
+	Peers []string `json:"peers"` // Proxy mode: route each key to the owning peer
+
+	FetchAllowHosts []string `json:"fetch_allow_hosts"` // PUT ?from=<url> source hosts, disabled if empty
+	FetchMaxBytes   int64    `json:"fetch_max_bytes"`   // Size limit of a fetched value
+
+	RateLimit        float64            `json:"rate_limit"`         // Requests per second for all methods, 0 disables it
+	MethodRateLimits map[string]float64 `json:"rate_limit_methods"` // Requests per second by HTTP method
+	RateBurst        int                `json:"rate_burst"`         // Bucket size, defaults to the rate
+	KeyRateLimit     float64            `json:"rate_limit_key"`     // Requests per second on a single key, 0 disables it
+	KeyRateKeys      int                `json:"rate_limit_keys"`    // Keys tracked by the per-key limit, the least recent dropped
+
+	MaxInflightWrites int           `json:"max_inflight_writes"` // Concurrent writes before shedding with 503, 0 is unlimited
+	MaxBatchSize      int           `json:"max_batch_size"`      // Items of a batch, mget or batchPut request, 0 is unlimited
+	LockTimeout       time.Duration `json:"lock_timeout"`        // Wait for the store lock before a 503, 0 waits forever
+	LockWaitMetrics   bool          `json:"lock_wait_metrics"`   // Time the store lock waits in gokvs_store_lock_wait_seconds
+	MaxEntries        int           `json:"max_entries"`         // Keys stored before evicting the least recently used, 0 is unbounded
+
+	GCPercent    int    `json:"gc_percent"`     // GC target percentage, the effective one once applied
+	MaxHeapBytes uint64 `json:"max_heap_bytes"` // Heap size refusing the large GETs with 503, 0 disables it
+
+	RequiredKeyPrefix  string   `json:"required_key_prefix"`  // Keys outside of it are refused with 403, for tenant isolation
+	MetricsKeyPrefixes []string `json:"metrics_key_prefixes"` // Key prefixes counted apart, the others as "other"
+	AccessLogSample    int      `json:"access_log_sample"`    // Log 1 in N requests, 1 logs them all
+
+	StatsDAddr     string        `json:"statsd_addr"`     // StatsD server mirroring the main metrics, disabled if empty
+	StatsDInterval time.Duration `json:"statsd_interval"` // Push interval to StatsD
+
+	LogPath         string `json:"log_path"`           // Transaction log replayed at startup
+	LogType         string `json:"log_type"`           // Transaction logger, see internal.LoggerConfig
+	LogMaxLineBytes int    `json:"log_max_line_bytes"` // Longest event line replayed, bounding the largest value
+	LogMaxBytes     int64  `json:"log_max_bytes"`      // Size rotating the transaction log, 0 never rotates it
+
+	CheckpointInterval time.Duration `json:"checkpoint_interval"` // Checkpoint of the store next to the log, 0 disables it
+
+	ReadOnly    bool   `json:"read_only"`   // Reject the writes, the transaction log is only replayed
+	Maintenance bool   `json:"maintenance"` // Start with the writes paused, toggled by POST /admin/readonly
+	SeedFile    string `json:"seed_file"`   // JSON or CSV defaults logged on the first start, over an empty log
+
+	ReplayAttempts int           `json:"replay_attempts"`         // Replays of the transaction log on transient read errors
+	ReplayBackoff  time.Duration `json:"replay_backoff"`          // First wait between two replays, doubled each time
+	ReplayDupSeq   bool          `json:"replay_tolerate_dup_seq"` // Skip the events with an already seen sequence number
+
+	AdminToken string `json:"admin_token"` // Bearer token of the /admin endpoints, disabled if empty
+
+	SoftDeleteWindow time.Duration `json:"soft_delete_window"` // Undo window of a DELETE, 0 deletes at once
+
+	ExpirySweepInterval time.Duration `json:"expiry_sweep_interval"` // Deletion of the expired keys never read, 0 disables it
+	SlidingTTL          bool          `json:"sliding_ttl"`           // Each GET pushes back the expiry of a key put with ?ttl=
+	InterpolateDepth    int           `json:"interpolate_depth"`     // GET replaces ${key} references, nested this deep, 0 disables it
+	DefaultContentType  string        `json:"default_content_type"`  // Content-Type of the values, sniffed if empty
+	EmptyListNoContent  bool          `json:"empty_list_no_content"` // GET /v1 of an empty store answers 204, not an empty list
+
+	MaxKeyLength        int  `json:"max_key_length"`        // Longest key of a write in bytes, 0 is unlimited
+	RequireUTF8         bool `json:"require_utf8"`          // Reject keys and values that are not valid UTF-8
+	CaseInsensitiveKeys bool `json:"case_insensitive_keys"` // Keys stored as-is, but looked up ignoring case
+	RecordTimestamps    bool `json:"record_timestamps"`     // Record the time of each PUT, see GET ?with-timestamp
+
+	InjectLatency time.Duration `json:"inject_latency"` // Testing only: delay of each /v1 operation, 0 disables it
+
+	ValidateConfig bool `json:"-"` // Check the settings and exit, without starting the server
+}
+
+// cfg starts with the flag defaults, main overrides it from the command line
+var cfg, _ = parseConfig(nil)
+
+func parseConfig(args []string) (config, error) {
+	var c config
+
+	fs := flag.NewFlagSet("gokvs", flag.ContinueOnError)
+	fs.StringVar(&c.Addr, "addr", ":8080", "TCP address to listen on")
+	fs.StringVar(&c.UnixSocket, "unix-socket", "", "Unix domain socket path to listen on, in addition to -addr (empty -addr for the socket only)")
+	fs.BoolVar(&c.ReusePort, "reuse-port", false, "set SO_REUSEADDR and SO_REUSEPORT on the TCP listener, so a restarted server binds -addr at once")
+	fs.IntVar(&c.ListenBacklog, "listen-backlog", 0, "connections queued before being accepted, capped by the system (0 keeps the system maximum)")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "certificate PEM file, serve TLS on -addr (not on -unix-socket) with -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "private key PEM file of -tls-cert")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", "", "CA certificates PEM file, require client certificates signed by them (mutual TLS); their common name is logged")
+	fs.DurationVar(&c.KeepAlivePeriod, "keepalive-period", 15*time.Second, "TCP keep-alive probes interval of idle connections (negative disables them)")
+	fs.DurationVar(&c.DrainGrace, "drain-grace", 0, "on shutdown, keep serving until the inflight queries are done, for at most this long (0 waits for them without limit)")
+	fs.DurationVar(&c.HeaderTimeout, "header-timeout", 2*time.Second, "slow clients defense: answer 408 to a client not done sending the headers in time")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", time.Second, "slow clients defense: answer 408 to a client not done sending the request, body included, in time")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 30*time.Second, "slow clients defense: close the keep-alive connections unused for this long")
+	fs.BoolVar(&c.ShutdownFlush, "shutdown-flush", true, "on shutdown, write all the queued transaction log events (durable, but slow with a long queue); false drops them for a fast shutdown, losing those writes on restart")
+	fs.Func("peers", "comma-separated peer URLs, enables the consistent-hash proxy mode", func(s string) error {
+		c.Peers = splitList(s)
+		return nil
+	})
+	fs.Func("fetch-allow-hosts", "comma-separated hosts allowed as PUT ?from=<url> sources (disabled if empty)", func(s string) error {
+		c.FetchAllowHosts = splitList(s)
+		return nil
+	})
+	fs.Int64Var(&c.FetchMaxBytes, "fetch-max-bytes", 1<<20, "maximum size of a value fetched with PUT ?from=<url>")
+	fs.Float64Var(&c.RateLimit, "rate-limit", 0, "requests per second allowed for all methods (0 disables it)")
+	fs.Func("rate-limit-methods", "requests per second by HTTP method, e.g. PUT=5,DELETE=5,GET=100", func(s string) (err error) {
+		c.MethodRateLimits, err = parseMethodRates(s)
+		return err
+	})
+	fs.IntVar(&c.RateBurst, "rate-burst", 0, "requests allowed in a burst (defaults to the rate)")
+	fs.Float64Var(&c.KeyRateLimit, "rate-limit-key", 0, "requests per second allowed on a single key, against hot keys (0 disables it)")
+	fs.IntVar(&c.KeyRateKeys, "rate-limit-keys", 10000, "most recently used keys tracked by -rate-limit-key")
+	fs.IntVar(&c.MaxBatchSize, "max-batch-size", 1000, "operations of a /v1:batch, keys of a /v1/mget or /v1:batchGet, or pairs of a /v1:batchPut above which the request is refused with 400, bounding its work and memory (0 is unlimited)")
+	fs.IntVar(&c.MaxInflightWrites, "max-inflight-writes", 0, "concurrent PUT/DELETE/POST requests before shedding writes with 503 (0 is unlimited)")
+	fs.StringVar(&c.RequiredKeyPrefix, "required-key-prefix", "", "refuse with 403 the operations on keys without this prefix, and the ones spanning all the keys, isolating a tenant instance (disabled if empty)")
+	fs.Func("metrics-key-prefixes", "comma-separated key prefixes (before the first ':' or '/') counted apart in gokvs_prefix_requests_total", func(s string) error {
+		c.MetricsKeyPrefixes = splitList(s)
+		return nil
+	})
+	fs.StringVar(&c.StatsDAddr, "statsd-addr", "", "host:port of a StatsD server to push the GET/PUT/DELETE counters and the inflight queries to (disabled if empty)")
+	fs.DurationVar(&c.StatsDInterval, "statsd-interval", 10*time.Second, "interval between two pushes to -statsd-addr")
+	fs.IntVar(&c.AccessLogSample, "access-log-sample", 1, "log 1 in N requests in the access log, against the logging cost under heavy load (1 logs them all)")
+	fs.IntVar(&c.MaxEntries, "max-entries", 0, "keys stored before a PUT evicts the least recently used one, logged as a DELETE, to use gokvs as a bounded cache (0 is unbounded)")
+	fs.DurationVar(&c.LockTimeout, "lock-timeout", 0, "wait for the store lock at most this long before answering a write with 503 (0 waits forever)")
+	fs.BoolVar(&c.LockWaitMetrics, "lock-wait-metrics", false, "time the waits for the store lock of GET/PUT/DELETE in the gokvs_store_lock_wait_seconds histogram, to diagnose contention (some overhead on each of them)")
+	fs.IntVar(&c.GCPercent, "gc-percent", 0, "GC target percentage, higher trades memory for fewer GCs on large datasets (0 keeps GOGC, negative disables the GC)")
+	fs.Uint64Var(&c.MaxHeapBytes, "max-heap-bytes", 0, "heap size over which GETs of values over 64KiB are refused with 503 (0 disables it)")
+	fs.StringVar(&c.LogPath, "log-path", "/tmp/transactions.log", "transaction log replayed at startup, give each instance its own (env GOKVS_LOG_PATH)")
+	fs.IntVar(&c.LogMaxLineBytes, "log-max-line-bytes", internal.DefaultMaxLineBytes, "longest transaction log line replayed, a longer one fails the replay; a value takes up to 3 times its size once encoded")
+	fs.DurationVar(&c.CheckpointInterval, "checkpoint-interval", 0, "write a checkpoint of the store to <log-path>.checkpoint this often, so a startup only replays the events after it (0 disables it, an existing checkpoint is still loaded)")
+	fs.Int64Var(&c.LogMaxBytes, "log-max-bytes", 0, "rotate the transaction log to <log-path>.1 once this big, shifting the older segments to .2, .3 and so on; all of them are replayed (0 never rotates it)")
+	fs.StringVar(&c.LogType, "log-type", internal.LoggerFile, "transaction logger type, only file so far")
+	fs.BoolVar(&c.ReadOnly, "read-only", false, "reject PUT/DELETE/POST with 405 and only replay the transaction log, for read replicas")
+	fs.BoolVar(&c.Maintenance, "maintenance", false, "start with the writes refused with 503 while the reads are served, until POST /admin/readonly?enabled=false (env GOKVS_MAINTENANCE)")
+	fs.StringVar(&c.SeedFile, "seed-file", "", "JSON object or .csv file of default key/values, stored and logged on the first start, when the log is empty")
+	fs.IntVar(&c.ReplayAttempts, "replay-attempts", 3, "attempts to replay the transaction log on transient read errors (a corrupt log fails at once)")
+	fs.DurationVar(&c.ReplayBackoff, "replay-backoff", 100*time.Millisecond, "wait before the second replay attempt, doubled for each next one")
+	fs.BoolVar(&c.ReplayDupSeq, "replay-tolerate-dup-seq", false, "skip the events with an already seen sequence number on replay instead of failing, to recover merged logs")
+	fs.StringVar(&c.AdminToken, "admin-token", "", "bearer token of the /admin endpoints, disabled if empty (env GOKVS_ADMIN_TOKEN)")
+	fs.DurationVar(&c.SoftDeleteWindow, "soft-delete-window", 0, "keep deleted values restorable with POST /v1/{key}/undelete for this long (0 disables it)")
+	fs.DurationVar(&c.ExpirySweepInterval, "expiry-sweep-interval", time.Minute, "delete the expired keys never read again this often (0 disables it, Get still expires them)")
+	fs.IntVar(&c.InterpolateDepth, "interpolate-depth", 0, "make GET replace the ${key} references of a value by the value of key, nested at most this deep against cycles (0 disables it)")
+	fs.StringVar(&c.DefaultContentType, "default-content-type", "", "Content-Type of the values returned by GET, e.g. application/octet-stream or text/plain; charset=utf-8 (sniffed from the value if empty)")
+	fs.BoolVar(&c.EmptyListNoContent, "empty-list-no-content", false, "answer GET /v1 on an empty store with 204 No Content instead of 200 and an empty list ([] in JSON)")
+	fs.BoolVar(&c.SlidingTTL, "sliding-ttl", false, "make the ?ttl= of all keys an idle timeout, reset by each GET (?sliding per key); the resets aren't logged, after a restart the keys expire as first set")
+	fs.IntVar(&c.MaxKeyLength, "max-key-length", 1024, "longest key in bytes a write accepts, longer ones are refused with 400 (0 is unlimited)")
+	fs.BoolVar(&c.RequireUTF8, "require-utf8", false, "reject keys and values that are not valid UTF-8 with 400 (binary values allowed by default)")
+	fs.BoolVar(&c.CaseInsensitiveKeys, "case-insensitive-keys", false, "store keys as-is but look them up ignoring case")
+	fs.BoolVar(&c.RecordTimestamps, "record-timestamps", false, "record the server time of each PUT, returned by GET ?with-timestamp (not kept across restarts)")
+	fs.DurationVar(&c.InjectLatency, "inject-latency", 0, "TESTING ONLY, never in production: delay each /v1 operation this long, to test the client timeouts (at most 5s, 0 disables it)")
+	fs.BoolVar(&c.ValidateConfig, "validate-config", false, "check the settings, print the errors and exit non-zero if any, without starting the server")
+
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	// Prefer the environment for secrets, command lines show up in ps
+	if c.AdminToken == "" {
+		c.AdminToken = os.Getenv("GOKVS_ADMIN_TOKEN")
+	}
+
+	if v := os.Getenv("GOKVS_LOG_PATH"); v != "" && !isFlagSet(fs, "log-path") {
+		c.LogPath = v
+	}
+	if v, ok := os.LookupEnv("GOKVS_MAINTENANCE"); ok && !c.Maintenance {
+		var err error
+		if c.Maintenance, err = strconv.ParseBool(v); err != nil {
+			return c, fmt.Errorf("invalid GOKVS_MAINTENANCE %q: %w", v, err)
+		}
+	}
+
+	return c, nil
+}
+
+// isFlagSet reports whether the flag was given on the command line, so it
+// takes precedence over the environment
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// redacted returns a copy of the config safe to display
+func (c config) redacted() config {
+	if c.AdminToken != "" {
+		c.AdminToken = "REDACTED"
+	}
+	return c
+}
+
+// validate checks the settings main can't catch at parse time, and returns
+// all the errors rather than the first one
+func (c config) validate() error {
+	var errs []error
+
+	if c.Addr == "" && c.UnixSocket == "" {
+		errs = append(errs, errors.New("nothing to listen on, set -addr and/or -unix-socket"))
+	}
+	if c.Addr != "" {
+		if err := validateAddr(c.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -addr %q: %w", c.Addr, err))
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("-tls-cert and -tls-key go together"))
+	} else if c.TLSCert != "" {
+		if _, err := newTLSConfig(c.TLSCert, c.TLSKey, c.TLSClientCA); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		errs = append(errs, errors.New("-tls-client-ca needs -tls-cert and -tls-key"))
+	}
+	if c.ListenBacklog < 0 {
+		errs = append(errs, fmt.Errorf("-listen-backlog can't be negative, got %d", c.ListenBacklog))
+	}
+	if c.UnixSocket != "" {
+		if err := checkWritableDir(filepath.Dir(c.UnixSocket)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -unix-socket %q: %w", c.UnixSocket, err))
+		}
+	}
+
+	for _, peer := range c.Peers {
+		if u, err := url.Parse(peer); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid peer %q: expected scheme://host:port", peer))
+		}
+	}
+	// The peers hash the exact key, other cases land on another peer
+	if len(c.Peers) > 0 && c.CaseInsensitiveKeys {
+		errs = append(errs, errors.New("-case-insensitive-keys can't be used with -peers"))
+	}
+
+	if c.FetchMaxBytes <= 0 && len(c.FetchAllowHosts) > 0 {
+		errs = append(errs, fmt.Errorf("-fetch-max-bytes must be positive, got %d", c.FetchMaxBytes))
+	}
+	if c.RateLimit < 0 {
+		errs = append(errs, fmt.Errorf("-rate-limit can't be negative, got %v", c.RateLimit))
+	}
+	if c.RateBurst < 0 {
+		errs = append(errs, fmt.Errorf("-rate-burst can't be negative, got %d", c.RateBurst))
+	}
+	if c.KeyRateLimit > 0 && c.KeyRateKeys < 1 {
+		errs = append(errs, fmt.Errorf("-rate-limit-keys must be positive, got %d", c.KeyRateKeys))
+	}
+	if c.MaxBatchSize < 0 {
+		errs = append(errs, fmt.Errorf("-max-batch-size can't be negative, got %d", c.MaxBatchSize))
+	}
+	if c.MaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("-max-entries can't be negative, got %d", c.MaxEntries))
+	}
+	if c.MaxInflightWrites < 0 {
+		errs = append(errs, fmt.Errorf("-max-inflight-writes can't be negative, got %d", c.MaxInflightWrites))
+	}
+	if c.StatsDAddr != "" {
+		if _, _, err := net.SplitHostPort(c.StatsDAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -statsd-addr %q: %w", c.StatsDAddr, err))
+		}
+		if c.StatsDInterval <= 0 {
+			errs = append(errs, fmt.Errorf("-statsd-interval must be positive, got %v", c.StatsDInterval))
+		}
+	}
+	if c.InterpolateDepth < 0 {
+		errs = append(errs, fmt.Errorf("-interpolate-depth can't be negative, got %d", c.InterpolateDepth))
+	}
+	if c.DefaultContentType != "" {
+		if _, _, err := mime.ParseMediaType(c.DefaultContentType); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -default-content-type %q: %w", c.DefaultContentType, err))
+		}
+	}
+	if c.MaxKeyLength < 0 {
+		errs = append(errs, fmt.Errorf("-max-key-length can't be negative, got %d", c.MaxKeyLength))
+	}
+	if c.AccessLogSample < 1 {
+		errs = append(errs, fmt.Errorf("-access-log-sample must be at least 1, got %d", c.AccessLogSample))
+	}
+	if c.ReplayAttempts < 1 {
+		errs = append(errs, fmt.Errorf("-replay-attempts must be at least 1, got %d", c.ReplayAttempts))
+	}
+	if c.LockTimeout < 0 {
+		errs = append(errs, fmt.Errorf("-lock-timeout can't be negative, got %v", c.LockTimeout))
+	}
+	for name, d := range map[string]time.Duration{"-header-timeout": c.HeaderTimeout, "-request-timeout": c.RequestTimeout, "-idle-timeout": c.IdleTimeout} {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %v", name, d))
+		}
+	}
+	if c.DrainGrace < 0 {
+		errs = append(errs, fmt.Errorf("-drain-grace can't be negative, got %v", c.DrainGrace))
+	}
+	if c.InjectLatency < 0 || c.InjectLatency > maxInjectLatency {
+		errs = append(errs, fmt.Errorf("-inject-latency must be between 0 and %v, got %v", maxInjectLatency, c.InjectLatency))
+	}
+	if c.SoftDeleteWindow < 0 {
+		errs = append(errs, fmt.Errorf("-soft-delete-window can't be negative, got %v", c.SoftDeleteWindow))
+	}
+
+	if c.SeedFile != "" {
+		if _, err := os.Stat(c.SeedFile); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -seed-file: %w", err))
+		}
+	}
+
+	if c.LogType != internal.LoggerFile {
+		errs = append(errs, fmt.Errorf("invalid -log-type %q, expected %s", c.LogType, internal.LoggerFile))
+	}
+	if c.CheckpointInterval < 0 {
+		errs = append(errs, fmt.Errorf("-checkpoint-interval can't be negative, got %v", c.CheckpointInterval))
+	}
+	if c.LogMaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("-log-max-bytes can't be negative, got %d", c.LogMaxBytes))
+	}
+	if c.LogMaxLineBytes <= 0 {
+		errs = append(errs, fmt.Errorf("-log-max-line-bytes must be positive, got %d", c.LogMaxLineBytes))
+	}
+	if c.LogPath == "" {
+		errs = append(errs, errors.New("-log-path can't be empty"))
+	} else if c.ReadOnly {
+		if _, err := os.Stat(c.LogPath); err != nil {
+			errs = append(errs, fmt.Errorf("read-only mode needs an existing transaction log: %w", err))
+		}
+	} else if err := checkWritableDir(filepath.Dir(c.LogPath)); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -log-path %q: %w", c.LogPath, err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateAddr checks a host:port listen address, without binding it
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	_, err = net.LookupPort("tcp", port) // Numbers in range or service names
+	return err
+}
+
+// checkWritableDir creates and removes a file, as permission bits don't
+// tell about read-only mounts
+func checkWritableDir(dir string) error {
+	f, err := os.CreateTemp(dir, ".gokvs-validate-*")
+	if err != nil {
+		return fmt.Errorf("directory not writable: %w", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// runValidateConfig prints the config errors and returns the exit code
+func runValidateConfig(c config, w io.Writer) int {
+	if err := c.validate(); err != nil {
+		fmt.Fprintln(w, "invalid configuration:")
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(w, "  -", line)
+		}
+		return 1
+	}
+	fmt.Fprintln(w, "configuration OK")
+	return 0
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
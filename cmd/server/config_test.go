@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	good, err := parseConfig([]string{"-addr=127.0.0.1:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if code := runValidateConfig(good, &out); code != 0 {
+		t.Errorf("valid config: got exit code %d, want 0 (%s)", code, out.String())
+	}
+
+	bad, err := parseConfig([]string{
+		"-addr=localhost:http-ish",
+		"-unix-socket=" + filepath.Join(t.TempDir(), "missing", "gokvs.sock"),
+		"-peers=not-a-url",
+		"-case-insensitive-keys",
+		"-max-inflight-writes=-1",
+		"-tls-client-ca=ca.pem",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if code := runValidateConfig(bad, &out); code == 0 {
+		t.Errorf("invalid config: got exit code 0, want non-zero")
+	}
+
+	// All the errors are reported, not only the first one
+	for _, want := range []string{"-addr", "-unix-socket", "not-a-url", "-case-insensitive-keys", "-max-inflight-writes", "-tls-client-ca"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't mention %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestLogPath(t *testing.T) {
+	envPath := filepath.Join(t.TempDir(), "env.log")
+	flagPath := filepath.Join(t.TempDir(), "flag.log")
+	t.Setenv("GOKVS_LOG_PATH", envPath)
+
+	c, err := parseConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LogPath != envPath {
+		t.Errorf("LogPath = %q, want the GOKVS_LOG_PATH %q", c.LogPath, envPath)
+	}
+	if c, _ = parseConfig([]string{"-log-path=" + flagPath}); c.LogPath != flagPath {
+		t.Errorf("LogPath = %q, want the -log-path %q", c.LogPath, flagPath)
+	}
+	if c, _ = parseConfig([]string{"-log-type=sqlite"}); c.validate() == nil {
+		t.Error("-log-type=sqlite: got no error")
+	}
+
+	// The server logs its writes to the configured path
+	setupMetrics()
+	setConfig(t, func(c *config) { c.LogPath = flagPath })
+	if err := initializeTransactionLog(cfg.LogPath); err != nil {
+		t.Fatal(err)
+	}
+	transact.WritePut("log-path-key", "value")
+	transact.Close()
+
+	data, err := os.ReadFile(flagPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "log-path-key") {
+		t.Errorf("%s doesn't hold the PUT:\n%s", flagPath, data)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// drainPollInterval is how often drainAndShutdown checks the inflight queries
+const drainPollInterval = 50 * time.Millisecond
+
+// drainAndShutdown keeps serving until the inflight queries are done or the
+// grace period is over, then shuts the server down and closes the remaining
+// connections. A zero grace waits for the inflight requests without limit.
+func drainAndShutdown(srv *http.Server, grace time.Duration) error {
+	if grace <= 0 {
+		return srv.Shutdown(context.Background())
+	}
+
+	deadline := time.Now().Add(grace)
+	for inflightQueries() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		_ = srv.Close() // Grace period over, drop the slow requests
+		return err
+	}
+	return nil
+}
+
+func inflightQueries() float64 {
+	var pb dto.Metric
+	if err := m.QueriesInflight.Write(&pb); err != nil {
+		return 0
+	}
+	return pb.GetGauge().GetValue()
+}
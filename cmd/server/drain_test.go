@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startSlowServer serves requests blocking until release is closed
+func startSlowServer(t *testing.T, release <-chan struct{}) (*http.Server, string, <-chan struct{}) {
+	t.Helper()
+	setupMetrics()
+
+	entered := make(chan struct{}, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.QueriesInflight.Inc()
+		defer m.QueriesInflight.Dec()
+		entered <- struct{}{}
+		<-release
+	})}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() { srv.Close() })
+
+	return srv, "http://" + ln.Addr().String(), entered
+}
+
+func TestDrainWaitsForInflight(t *testing.T) {
+	release := make(chan struct{})
+	srv, url, entered := startSlowServer(t, release)
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	<-entered
+
+	time.AfterFunc(200*time.Millisecond, func() { close(release) })
+	start := time.Now()
+	if err := drainAndShutdown(srv, 5*time.Second); err != nil {
+		t.Errorf("drainAndShutdown() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("shutdown after %v, before the inflight request completed", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("inflight request failed: %v", err)
+	}
+}
+
+func TestDrainGraceTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv, url, entered := startSlowServer(t, release)
+
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-entered
+
+	const grace = 200 * time.Millisecond
+	start := time.Now()
+	if err := drainAndShutdown(srv, grace); err == nil {
+		t.Error("expected an error, the request outlived the grace period")
+	}
+	if elapsed := time.Since(start); elapsed < grace || elapsed > grace+time.Second {
+		t.Errorf("shutdown after %v, want about %v", elapsed, grace)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+const csvContentType = "text/csv"
+
+// csvHeader is the first row of the CSV exports, required on import
+var csvHeader = []string{"key", "value"}
+
+// keyValueExportHandler dumps the store as a JSON object, or as key,value
+// CSV rows with Accept: text/csv. The X-GoKVS-Key-Count and
+// X-GoKVS-Total-Bytes headers let a backup check it received the whole dump,
+// which is encoded before being sent to count its bytes.
+func keyValueExportHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	pairs := internal.Pairs()
+
+	var buf bytes.Buffer
+	var err error
+	if strings.Contains(r.Header.Get("Accept"), csvContentType) {
+		w.Header().Set("Content-Type", csvContentType)
+		err = writeCSV(&buf, pairs)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(&buf).Encode(pairs)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	size := buf.Len()
+	w.Header().Set("X-GoKVS-Key-Count", strconv.Itoa(len(pairs)))
+	w.Header().Set("X-GoKVS-Total-Bytes", strconv.Itoa(size))
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("ERROR in EXPORT: %v\n", err)
+	}
+
+	log.Printf("EXPORT keys=%d bytes=%d\n", len(pairs), size)
+}
+
+// keyValueSnapshotHandler streams the store as a JSON object attachment, for
+// backups independent of the transaction log. The writes wait until the
+// client received it all.
+func keyValueSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	filename := "gokvs-snapshot-" + time.Now().UTC().Format("20060102T150405Z") + ".json"
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	if err := internal.Snapshot(w); err != nil {
+		log.Printf("ERROR in SNAPSHOT: %v\n", err) // Too late for an error status
+		return
+	}
+
+	log.Printf("SNAPSHOT %s\n", filename)
+}
+
+// keyValueRestoreHandler loads a /v1:snapshot, merged into the store or with
+// ?mode=replace replacing it. The restore is logged as a clear, when
+// replacing, then a PUT per pair, so a replay reproduces it.
+func keyValueRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	var replace bool
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "merge":
+	case "replace":
+		replace = true
+	default:
+		http.Error(w, fmt.Sprintf("invalid mode %q, expected merge or replace", mode), http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	var body io.Reader = r.Body
+	if cfg.RequireUTF8 { // The JSON decoding would replace the invalid bytes silently
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !utf8.Valid(data) {
+			http.Error(w, "key and value must be valid UTF-8", http.StatusBadRequest)
+			return
+		}
+		body = bytes.NewReader(data)
+	}
+	pairs, err := internal.Restore(body, replace, validateWrite) // Like the PUTs
+	if errors.Is(err, internal.ErrorInvalidSnapshot) || errors.Is(err, internal.ErrorInvalidKey) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	if replace {
+		transact.WriteClear()
+		m.EventsClear.Inc()
+	}
+	for key, value := range pairs {
+		transact.WritePut(key, value)
+	}
+	m.EventsPut.Add(float64(len(pairs)))
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("RESTORE keys=%d replace=%t\n", len(pairs), replace)
+}
+
+// keyValueImportHandler stores the pairs of a JSON object, or of key,value
+// CSV rows with Content-Type: text/csv, all or nothing
+func keyValueImportHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	dryRun, err := queryDryRun(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	var pairs map[string]string
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == csvContentType {
+		pairs, err = readCSV(r.Body)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&pairs)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid import: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for key, value := range pairs {
+		if !checkKeyPrefix(w, key) {
+			return
+		}
+		if err := validateWrite(key, value); err != nil {
+			http.Error(w, fmt.Sprintf("key %q: %v", key, err), http.StatusBadRequest)
+			return
+		}
+	}
+	ops := putOps(pairs)
+	if dryRun {
+		writeDryRun(w, ops, "IMPORT")
+		return
+	}
+	if _, err := internal.Batch(ops); err != nil {
+		storeError(w, err)
+		return
+	}
+
+	for _, op := range ops {
+		transact.WritePut(op.Key, op.Value)
+		m.EventsPut.Inc()
+	}
+
+	log.Printf("IMPORT keys=%d\n", len(ops))
+}
+
+// writeCSV writes the header then the pairs sorted by key, encoding/csv
+// quotes the commas, quotes and newlines
+func writeCSV(w io.Writer, pairs map[string]string) error {
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := cw.Write([]string{key, pairs[key]}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func readCSV(r io.Reader) (map[string]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != csvHeader[0] || header[1] != csvHeader[1] {
+		return nil, fmt.Errorf("expected a %q header", strings.Join(csvHeader, ","))
+	}
+
+	pairs := make(map[string]string)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return pairs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pairs[record[0]] = record[1]
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+func TestExportImportCSV(t *testing.T) {
+	setupTransactionLog(t)
+
+	pairs := map[string]string{
+		"csv:plain":   "value",
+		"csv:comma":   "a,b,c",
+		"csv:newline": "line 1\nline 2",
+		"csv:quote":   `say "hi"`,
+	}
+	for key, value := range pairs {
+		if err := internal.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/v1/export", nil)
+	req.Header.Set("Accept", "text/csv")
+	rr := httptest.NewRecorder()
+	keyValueExportHandler(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("export: got %d %q, want %d text/csv", rr.Code, rr.Header().Get("Content-Type"), http.StatusOK)
+	}
+	if !strings.HasPrefix(rr.Body.String(), "key,value\n") {
+		t.Errorf("export doesn't start with the header: %q", rr.Body)
+	}
+	exported := rr.Body.Bytes()
+
+	for key := range pairs {
+		if _, err := internal.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req = httptest.NewRequest("POST", "/v1/import", bytes.NewReader(exported))
+	req.Header.Set("Content-Type", "text/csv; charset=utf-8")
+	rr = httptest.NewRecorder()
+	keyValueImportHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("import: got status %d, want %d (%s)", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	for key, want := range pairs {
+		if got, err := internal.Get(key); err != nil || got != want {
+			t.Errorf("Get(%q) = %q, %v; want %q", key, got, err, want)
+		}
+	}
+}
+
+func TestImportJSON(t *testing.T) {
+	setupTransactionLog(t)
+
+	rr := httptest.NewRecorder()
+	keyValueImportHandler(rr, httptest.NewRequest("POST", "/v1/import", strings.NewReader(`{"json:key":"json-value"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if got, _ := internal.Get("json:key"); got != "json-value" {
+		t.Errorf("got %q, want %q", got, "json-value")
+	}
+
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/import", strings.NewReader("name,value\nk,v\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	keyValueImportHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("CSV without header: got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSnapshotHandler(t *testing.T) {
+	setupTransactionLog(t)
+	if err := internal.Put("snapshot-key", "snapshot-value"); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	keyValueSnapshotHandler(rr, httptest.NewRequest("GET", "/v1:snapshot", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if got := rr.Header().Get("Content-Disposition"); !strings.HasPrefix(got, "attachment; filename=gokvs-snapshot-") {
+		t.Errorf("got Content-Disposition %q, want an attachment", got)
+	}
+
+	var pairs map[string]string
+	if err := json.NewDecoder(rr.Body).Decode(&pairs); err != nil {
+		t.Fatal(err)
+	}
+	if pairs["snapshot-key"] != "snapshot-value" {
+		t.Errorf("snapshot-key = %q, want %q", pairs["snapshot-key"], "snapshot-value")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := internal.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{"restore:a": "1", "restore:b": "2"} {
+		if err := internal.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	keyValueSnapshotHandler(rr, httptest.NewRequest("GET", "/v1:snapshot", nil))
+	snapshot := rr.Body.String()
+
+	// Changed after the snapshot
+	_ = internal.Put("restore:a", "changed")
+	_ = internal.Put("restore:c", "3")
+
+	restore := func(url, body string) int {
+		rr := httptest.NewRecorder()
+		keyValueRestoreHandler(rr, httptest.NewRequest("POST", url, strings.NewReader(body)))
+		return rr.Code
+	}
+
+	// A truncated snapshot changes nothing
+	if code := restore("/v1:restore?mode=replace", snapshot[:len(snapshot)/2]); code != http.StatusBadRequest {
+		t.Errorf("truncated snapshot: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	if value, _ := internal.Get("restore:a"); value != "changed" {
+		t.Errorf("restore:a after a failed restore = %q, want %q", value, "changed")
+	}
+
+	// The values are checked like the PUTs, all before any is stored
+	setConfig(t, func(c *config) { c.RequireUTF8 = true })
+	if code := restore("/v1:restore", "{\"restore:a\":\"valid\",\"restore:d\":\"\xff\"}"); code != http.StatusBadRequest {
+		t.Errorf("invalid UTF-8 value: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	if value, _ := internal.Get("restore:a"); value != "changed" {
+		t.Errorf("restore:a after a refused restore = %q, want %q", value, "changed")
+	}
+
+	if code := restore("/v1:restore?mode=replace", snapshot); code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", code, http.StatusNoContent)
+	}
+	want := map[string]string{"restore:a": "1", "restore:b": "2"}
+	if got := internal.Pairs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("store after restore = %v, want %v", got, want)
+	}
+	transact.Close()
+
+	// The replay reproduces the restored state
+	_ = internal.Put("restore:c", "3")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+	if got := internal.Pairs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("store after replay = %v, want %v", got, want)
+	}
+}
+
+func TestExportHeaders(t *testing.T) {
+	setupTransactionLog(t)
+	if _, err := internal.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if err := internal.PutMulti(map[string]string{"export:a": "1", "export:b": "two", "export:c": "three"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, accept := range []string{"application/json", "text/csv"} {
+		req := httptest.NewRequest("GET", "/v1/export", nil)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		keyValueExportHandler(rr, req)
+
+		if got := rr.Header().Get("X-GoKVS-Key-Count"); got != "3" {
+			t.Errorf("%s: X-GoKVS-Key-Count = %q, want %q", accept, got, "3")
+		}
+		if got, want := rr.Header().Get("X-GoKVS-Total-Bytes"), strconv.Itoa(rr.Body.Len()); got != want {
+			t.Errorf("%s: X-GoKVS-Total-Bytes = %q, want the %s bytes streamed", accept, got, want)
+		}
+	}
+}
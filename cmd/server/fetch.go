@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	errFetchDisabled   = errors.New("fetching values from a URL is disabled")
+	errFetchForbidden  = errors.New("host not allowed")
+	errFetchTooLarge   = errors.New("fetched value too large")
+	errFetchBadURL     = errors.New("invalid source URL")
+	errFetchBadGateway = errors.New("cannot fetch source URL")
+)
+
+// fetchClient re-checks the allowlist on redirects, otherwise an allowed
+// host could bounce the request anywhere (SSRF)
+var fetchClient = &http.Client{
+	Timeout: 1 * time.Second, // Stay within the server WriteTimeout
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		return checkFetchHost(req.URL)
+	},
+}
+
+// fetchValue downloads the value for PUT /v1/{key}?from=<url>
+func fetchValue(ctx context.Context, rawURL string) (string, error) {
+	if len(cfg.FetchAllowHosts) == 0 {
+		return "", errFetchDisabled
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("%w: %s", errFetchBadURL, rawURL)
+	}
+	if err := checkFetchHost(u); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errFetchBadURL, err)
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errFetchForbidden) {
+			return "", errFetchForbidden
+		}
+		return "", fmt.Errorf("%w: %v", errFetchBadGateway, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: %s", errFetchBadGateway, resp.Status)
+	}
+
+	// Read one byte over the limit to detect oversized values
+	value, err := io.ReadAll(io.LimitReader(resp.Body, cfg.FetchMaxBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errFetchBadGateway, err)
+	}
+	if int64(len(value)) > cfg.FetchMaxBytes {
+		return "", errFetchTooLarge
+	}
+
+	return string(value), nil
+}
+
+func checkFetchHost(u *url.URL) error {
+	for _, host := range cfg.FetchAllowHosts {
+		if host == u.Host || host == u.Hostname() {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errFetchForbidden, u.Host)
+}
+
+// fetchErrorStatus maps a fetchValue error to the HTTP status to return
+func fetchErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errFetchDisabled), errors.Is(err, errFetchForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errFetchTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errFetchBadURL):
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
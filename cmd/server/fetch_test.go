@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+func TestPutFromURL(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big" {
+			_, _ = io.WriteString(w, strings.Repeat("x", 64))
+			return
+		}
+		_, _ = io.WriteString(w, "seeded-value")
+	}))
+	defer source.Close()
+	sourceURL, _ := url.Parse(source.URL)
+
+	put := func(key, from string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/v1/"+key+"?from="+url.QueryEscape(from), nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Disabled by default
+	setConfig(t, func(c *config) { c.FetchAllowHosts = nil })
+	if rr := put("seed-key", source.URL+"/seed"); rr.Code != http.StatusForbidden {
+		t.Errorf("disabled fetch: got status %d, want %d", rr.Code, http.StatusForbidden)
+	}
+
+	setConfig(t, func(c *config) {
+		c.FetchAllowHosts = []string{sourceURL.Hostname()}
+		c.FetchMaxBytes = 32
+	})
+
+	if rr := put("seed-key", source.URL+"/seed"); rr.Code != http.StatusCreated {
+		t.Fatalf("fetch: got status %d, want %d (%s)", rr.Code, http.StatusCreated, rr.Body)
+	}
+	if value, err := internal.Get("seed-key"); err != nil || value != "seeded-value" {
+		t.Errorf("stored value = %q, %v; want %q", value, err, "seeded-value")
+	}
+
+	if rr := put("big-key", source.URL+"/big"); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized fetch: got status %d, want %d", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+	if rr := put("other-key", "http://example.com/seed"); rr.Code != http.StatusForbidden {
+		t.Errorf("host not allowed: got status %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	if rr := put("file-key", "file:///etc/passwd"); rr.Code != http.StatusBadRequest {
+		t.Errorf("bad scheme: got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import "runtime/debug"
+
+// applyGCPercent sets the GC target percentage, trading memory for fewer GCs
+// on large datasets, and returns the effective one. Zero keeps the current
+// setting (GOGC, 100 by default).
+func applyGCPercent(percent int) int {
+	if percent == 0 {
+		percent = debug.SetGCPercent(100)
+	}
+	debug.SetGCPercent(percent)
+	return percent
+}
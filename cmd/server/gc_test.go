@@ -0,0 +1,26 @@
+package main
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestApplyGCPercent(t *testing.T) {
+	initial := debug.SetGCPercent(100)
+	defer debug.SetGCPercent(initial)
+
+	if got := applyGCPercent(400); got != 400 {
+		t.Errorf("applyGCPercent(400) = %d, want 400", got)
+	}
+	if current := debug.SetGCPercent(400); current != 400 {
+		t.Errorf("GC percent is %d, want 400", current)
+	}
+
+	// Zero keeps the current setting
+	if got := applyGCPercent(0); got != 400 {
+		t.Errorf("applyGCPercent(0) = %d, want the current 400", got)
+	}
+	if current := debug.SetGCPercent(400); current != 400 {
+		t.Errorf("GC percent is %d, want 400", current)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The slow clients defense, against the slowloris attack of examples/slowloris.
+// The -header-timeout, -request-timeout and -idle-timeout settings bound how
+// long a client can hold a connection, and each rejection is counted by reason
+// in gokvs_slow_client_rejections:
+//   - header_timeout: the headers took too long, answered with 408
+//   - request_timeout: the body took too long, answered with 408
+//   - idle_timeout: a keep-alive connection stayed unused, closed
+
+// requestTimeoutResponse is written on the connection itself, as net/http
+// closes it without a response when the headers time out
+const requestTimeoutResponse = "HTTP/1.1 408 Request Timeout\r\nContent-Type: text/plain; charset=utf-8\r\nConnection: close\r\nContent-Length: 16\r\n\r\nRequest Timeout\n"
+
+// hardenedListener wraps the accepted connections, to tell why they time out
+type hardenedListener struct {
+	net.Listener
+	encrypted bool // Under TLS, see newTLSListener
+}
+
+func newHardenedListener(ln net.Listener) net.Listener {
+	return hardenedListener{Listener: ln}
+}
+
+func (l hardenedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &hardenedConn{Conn: c, encrypted: l.encrypted}, nil
+}
+
+// hardenedConnOf returns the hardened connection under c, TLS or not
+func hardenedConnOf(c net.Conn) (*hardenedConn, bool) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	hc, ok := c.(*hardenedConn)
+	return hc, ok
+}
+
+// hardenedConn tells why a read times out, from the state of the connection
+type hardenedConn struct {
+	net.Conn
+	state       atomic.Int32 // http.ConnState, set by trackConnections
+	received    atomic.Bool  // Bytes read since the connection went idle
+	handling    atomic.Bool  // A handler runs, the body timeouts are its own
+	interrupted atomic.Bool  // The read deadline was set in the past
+	rejected    atomic.Bool  // Counted once, net/http may read again
+	encrypted   bool         // Under TLS, no raw 408 response can be written
+}
+
+func (c *hardenedConn) setState(state http.ConnState) {
+	if state == http.StateIdle {
+		c.received.Store(false)
+	}
+	c.state.Store(int32(state))
+}
+
+// SetReadDeadline records whether the deadline is already past: net/http
+// does so to interrupt its background reads, which is no client timeout
+func (c *hardenedConn) SetReadDeadline(t time.Time) error {
+	c.interrupted.Store(!t.IsZero() && t.Before(time.Now()))
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *hardenedConn) SetDeadline(t time.Time) error {
+	c.interrupted.Store(!t.IsZero() && t.Before(time.Now()))
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *hardenedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.received.Store(true)
+	}
+	if !isTimeout(err) || c.handling.Load() || c.interrupted.Load() || !c.rejected.CompareAndSwap(false, true) {
+		return n, err
+	}
+
+	// An idle keep-alive connection stays idle while the headers of its
+	// next request arrive
+	if http.ConnState(c.state.Load()) == http.StateIdle && !c.received.Load() {
+		m.SlowClientRejections.WithLabelValues("idle_timeout").Inc()
+		return n, err
+	}
+
+	m.SlowClientRejections.WithLabelValues("header_timeout").Inc()
+	if c.encrypted {
+		return n, err
+	}
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = io.WriteString(c.Conn, requestTimeoutResponse)
+	return n, err
+}
+
+type hardenedConnKey struct{}
+
+// hardenedConnContext is the http.Server ConnContext hook giving the
+// handlers their connection
+func hardenedConnContext(ctx context.Context, c net.Conn) context.Context {
+	if hc, ok := hardenedConnOf(c); ok {
+		return context.WithValue(ctx, hardenedConnKey{}, hc)
+	}
+	return ctx
+}
+
+// requestTimeoutMiddleware answers 408 when the body doesn't arrive before
+// the -request-timeout deadline, instead of the handler error
+func requestTimeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hc, ok := r.Context().Value(hardenedConnKey{}).(*hardenedConn); ok {
+			hc.handling.Store(true)
+			defer hc.handling.Store(false)
+		}
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body := &timeoutBody{ReadCloser: r.Body}
+		r.Body = body
+		next.ServeHTTP(&timeoutWriter{ResponseWriter: w, body: body}, r)
+	})
+}
+
+// timeoutBody records whether reading the body timed out
+type timeoutBody struct {
+	io.ReadCloser
+	timedOut bool
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if isTimeout(err) {
+		b.timedOut = true
+	}
+	return n, err
+}
+
+// timeoutWriter replaces the response by a 408 once the body timed out
+type timeoutWriter struct {
+	http.ResponseWriter
+	body     *timeoutBody
+	rejected bool
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	if !w.body.timedOut {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if !w.rejected {
+		w.rejected = true
+		m.SlowClientRejections.WithLabelValues("request_timeout").Inc()
+		http.Error(w.ResponseWriter, "Request Timeout", http.StatusRequestTimeout)
+	}
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if !w.body.timedOut {
+		return w.ResponseWriter.Write(b)
+	}
+	w.WriteHeader(http.StatusRequestTimeout)
+	return len(b), nil
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// startHardenedServer serves the router like main does, with short timeouts
+func startHardenedServer(t *testing.T) string {
+	t.Helper()
+	setupTransactionLog(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := setupRouter()
+	router.Use(requestTimeoutMiddleware)
+	srv := &http.Server{
+		Handler:           router,
+		ReadHeaderTimeout: 100 * time.Millisecond,
+		ReadTimeout:       200 * time.Millisecond,
+		IdleTimeout:       100 * time.Millisecond,
+		ConnState:         trackConnections,
+		ConnContext:       hardenedConnContext,
+	}
+	go func() { _ = srv.Serve(newHardenedListener(ln)) }()
+	t.Cleanup(func() { srv.Close() })
+
+	return ln.Addr().String()
+}
+
+func TestSlowClientRejected(t *testing.T) {
+	addr := startHardenedServer(t)
+	rejections := func(reason string) float64 {
+		return testutil.ToFloat64(m.SlowClientRejections.WithLabelValues(reason))
+	}
+
+	send := func(request string) string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		if _, err := io.WriteString(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		status, _ := bufio.NewReader(conn).ReadString('\n')
+		return strings.TrimSpace(status)
+	}
+
+	t.Run("headers", func(t *testing.T) {
+		before := rejections("header_timeout")
+		if status := send("GET /v1/slow HTTP/1.1\r\nHost: gokvs\r\n"); status != "HTTP/1.1 408 Request Timeout" {
+			t.Errorf("got status line %q, want a 408", status)
+		}
+		if got := rejections("header_timeout") - before; got != 1 {
+			t.Errorf("got %.0f header timeouts, want 1", got)
+		}
+	})
+
+	t.Run("body", func(t *testing.T) {
+		before := rejections("request_timeout")
+		if status := send("PUT /v1/slow HTTP/1.1\r\nHost: gokvs\r\nContent-Length: 10\r\n\r\nabc"); status != "HTTP/1.1 408 Request Timeout" {
+			t.Errorf("got status line %q, want a 408", status)
+		}
+		if got := rejections("request_timeout") - before; got != 1 {
+			t.Errorf("got %.0f request timeouts, want 1", got)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		before := rejections("idle_timeout")
+		if status := send("GET /v1/slow HTTP/1.1\r\nHost: gokvs\r\n\r\n"); status != "HTTP/1.1 404 Not Found" {
+			t.Errorf("got status line %q, want a 404", status)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if got := rejections("idle_timeout") - before; got != 0 {
+			t.Errorf("got %.0f idle timeouts for a closed connection, want 0", got)
+		}
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "GET /v1/slow HTTP/1.1\r\nHost: gokvs\r\n\r\n")
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _ = io.ReadAll(conn) // Until the server closes the idle connection
+		if got := rejections("idle_timeout") - before; got != 1 {
+			t.Errorf("got %.0f idle timeouts, want 1", got)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// ready is set once the startup replay is over
+var ready atomic.Bool
+
+// startupReplay replays the transaction log, runs the steps depending on the
+// replayed data, then marks the server ready
+func startupReplay(filename string, afterReplay func() error) error {
+	if err := initializeTransactionLog(filename); err != nil {
+		return err
+	}
+	if err := afterReplay(); err != nil {
+		return err
+	}
+
+	ready.Store(true)
+	log.Printf("Ready, replay completed")
+	return nil
+}
+
+// readyzHandler tells the load balancers not to send traffic before the end
+// of the replay, unlike /healthz that only tells the process is alive
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "replaying the transaction log", http.StatusServiceUnavailable)
+		return
+	}
+	if _, err := w.Write([]byte("ready\n")); err != nil {
+		log.Printf("ERROR in w.Write for readyz\n")
+	}
+}
+
+// readinessMiddleware answers 503 to the /v1 and /admin requests during the
+// replay, the store is incomplete and the transaction log not running yet
+func readinessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() && (strings.HasPrefix(r.URL.Path, "/v1") || strings.HasPrefix(r.URL.Path, "/admin/")) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "replaying the transaction log", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadyzDuringReplay(t *testing.T) {
+	setupMetrics()
+	ready.Store(false)
+
+	router := setupRouter()
+	router.Use(readinessMiddleware)
+	router.HandleFunc("/readyz", readyzHandler)
+	router.HandleFunc("/admin/flush-log", adminFlushLogHandler).Methods("POST")
+	do := func(method, path string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, nil))
+		return rr.Code
+	}
+	get := func(path string) int { return do("GET", path) }
+
+	// A long replay, blocked until released
+	replaying, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- startupReplay(filepath.Join(t.TempDir(), "transactions.log"), func() error {
+			close(replaying)
+			<-release
+			return nil
+		})
+	}()
+	<-replaying
+
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz during the replay: got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := get("/v1/some-key"); code != http.StatusServiceUnavailable {
+		t.Errorf("GET during the replay: got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := do("POST", "/admin/flush-log"); code != http.StatusServiceUnavailable {
+		t.Errorf("admin request during the replay: got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+	if runningLog.Load() != transact {
+		t.Error("transaction log not published to the shutdown once running")
+	}
+
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Errorf("readyz after the replay: got status %d, want %d", code, http.StatusOK)
+	}
+	if code := get("/v1/some-key"); code != http.StatusNotFound {
+		t.Errorf("GET after the replay: got status %d, want %d", code, http.StatusNotFound)
+	}
+}
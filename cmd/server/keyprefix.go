@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// keyspaceRoutes span the keys of all the tenants, refused under
+// -required-key-prefix
+var keyspaceRoutes = map[string]bool{
+	"/v1":             true,
+	"/v1/match":       true,
+	"/v1/changes":     true,
+	"/v1/export":      true,
+	"/v1/scan/stream": true,
+	"/v1:snapshot":    true,
+	"/v1:restore":     true,
+}
+
+// newRequiredPrefixMiddleware answers 403 to the operations on a key without
+// the prefix, isolating the keyspace of a tenant instance. The keys of a
+// request body are checked by their handlers, with checkKeyPrefix.
+func newRequiredPrefixMiddleware(prefix string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key, ok := mux.Vars(r)["key"]; ok && !strings.HasPrefix(key, prefix) {
+				forbiddenKey(w, key)
+				return
+			}
+			if route := mux.CurrentRoute(r); route != nil {
+				if tpl, _ := route.GetPathTemplate(); keyspaceRoutes[tpl] {
+					http.Error(w, "Forbidden, the keys are restricted to the "+prefix+" prefix", http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// checkKeyPrefix answers 403 if one of the keys lacks -required-key-prefix
+func checkKeyPrefix(w http.ResponseWriter, keys ...string) bool {
+	if cfg.RequiredKeyPrefix == "" {
+		return true
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, cfg.RequiredKeyPrefix) {
+			forbiddenKey(w, key)
+			return false
+		}
+	}
+	return true
+}
+
+func forbiddenKey(w http.ResponseWriter, key string) {
+	http.Error(w, fmt.Sprintf("Forbidden key %q, outside of the required prefix", key), http.StatusForbidden)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequiredKeyPrefix(t *testing.T) {
+	setupTransactionLog(t)
+	setConfig(t, func(c *config) { c.RequiredKeyPrefix = "tenant-a:" })
+	router := setupRouter()
+	router.HandleFunc("/v1:batchPut", keyValueBatchPutHandler).Methods("POST")
+	router.HandleFunc("/v1", keyValueListHandler).Methods("GET")
+	router.Use(newRequiredPrefixMiddleware(cfg.RequiredKeyPrefix))
+
+	do := func(method, path, body string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return rr.Code
+	}
+
+	for _, method := range []string{"PUT", "GET", "HEAD", "DELETE"} {
+		if code := do(method, "/v1/tenant-b:key", "value"); code != http.StatusForbidden {
+			t.Errorf("%s of another tenant: got status %d, want %d", method, code, http.StatusForbidden)
+		}
+	}
+	if code := do("POST", "/v1:batchPut", `{"tenant-a:key":"1","tenant-b:key":"2"}`); code != http.StatusForbidden {
+		t.Errorf("batchPut with another tenant: got status %d, want %d", code, http.StatusForbidden)
+	}
+	if code := do("GET", "/v1", ""); code != http.StatusForbidden {
+		t.Errorf("listing all the keys: got status %d, want %d", code, http.StatusForbidden)
+	}
+
+	if code := do("PUT", "/v1/tenant-a:key", "value"); code != http.StatusCreated {
+		t.Errorf("PUT with the prefix: got status %d, want %d", code, http.StatusCreated)
+	}
+	if code := do("GET", "/v1/tenant-a:key", ""); code != http.StatusOK {
+		t.Errorf("GET with the prefix: got status %d, want %d", code, http.StatusOK)
+	}
+	if code := do("POST", "/v1:batchPut", `{"tenant-a:one":"1","tenant-a:two":"2"}`); code != http.StatusCreated {
+		t.Errorf("batchPut with the prefix: got status %d, want %d", code, http.StatusCreated)
+	}
+	if code := do("DELETE", "/v1/tenant-a:key", ""); code != http.StatusOK {
+		t.Errorf("DELETE with the prefix: got status %d, want %d", code, http.StatusOK)
+	}
+}
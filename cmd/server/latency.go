@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxInjectLatency caps -inject-latency, so a test setting left on in
+// production slows the clients down without hanging them
+const maxInjectLatency = 5 * time.Second
+
+// newLatencyMiddleware delays each /v1 operation, for the client developers
+// to test their timeout handling against a real server. The delay ends early
+// when the client gives up. The read and write deadlines of the connection
+// are moved after the delay, by readTimeout and writeTimeout: the server
+// timeouts would otherwise cut the delayed bodies and responses.
+func newLatencyMiddleware(delay, readTimeout time.Duration) mux.MiddlewareFunc {
+	delay = min(delay, maxInjectLatency)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1" && !strings.HasPrefix(r.URL.Path, "/v1/") && !strings.HasPrefix(r.URL.Path, "/v1:") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				rc := http.NewResponseController(w) // Unsupported by the recorders of the tests
+				_ = rc.SetReadDeadline(time.Now().Add(readTimeout))
+				_ = rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+				next.ServeHTTP(w, r)
+			case <-r.Context().Done():
+			}
+		})
+	}
+}
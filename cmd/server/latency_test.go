@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInjectLatency(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	handler := newLatencyMiddleware(delay, time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	elapsed := func(path string) time.Duration {
+		start := time.Now()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("GET %s: got status %d, want %d", path, rr.Code, http.StatusOK)
+		}
+		return time.Since(start)
+	}
+
+	if d := elapsed("/v1/key"); d < delay {
+		t.Errorf("GET /v1/key took %v, want at least %v", d, delay)
+	}
+	// The probes are never delayed
+	if d := elapsed("/healthz"); d >= delay {
+		t.Errorf("GET /healthz took %v, want less than %v", d, delay)
+	}
+
+	// A client giving up ends the delay
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/key", nil).WithContext(ctx))
+	if d := time.Since(start); d >= delay {
+		t.Errorf("cancelled GET took %v, want less than %v", d, delay)
+	}
+}
+
+func TestInjectLatencyCapped(t *testing.T) {
+	c, err := parseConfig([]string{"-inject-latency=1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validate(); err == nil {
+		t.Error("-inject-latency=1h: got no validation error")
+	}
+}
+
+func TestInjectLatencyOverServerTimeouts(t *testing.T) {
+	// A server configured like the real one, with shorter timeouts
+	const timeout = 100 * time.Millisecond
+	srv := httptest.NewUnstartedServer(newLatencyMiddleware(2*timeout, timeout)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(append([]byte("delayed"), body...))
+	})))
+	srv.Config.ReadTimeout = timeout
+	srv.Config.WriteTimeout = timeout
+	srv.Start()
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		method, body string
+	}{
+		{method: "GET"},
+		{method: "PUT", body: strings.Repeat("v", 1<<20)}, // Over the read buffer, read after the delay
+	} {
+		req, err := http.NewRequest(tc.method, srv.URL+"/v1/key", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s with a delay over the server timeouts: %v", tc.method, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := "delayed" + tc.body; err != nil || resp.StatusCode != http.StatusOK || string(body) != want {
+			t.Errorf("%s with a delay over the server timeouts = %d, %d bytes, %v; want %d, %d bytes", tc.method, resp.StatusCode, len(body), err, http.StatusOK, len(want))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// listenerOptions tune the TCP listener
+type listenerOptions struct {
+	// KeepAlivePeriod is the interval of the keep-alive probes on accepted
+	// connections, so dead peers are detected and their connections cleaned
+	// up. Zero uses the Go default (15s), negative disables them.
+	KeepAlivePeriod time.Duration
+	// ReusePort sets SO_REUSEADDR and SO_REUSEPORT, so a restarted server
+	// binds at once, even while the old one still holds the port
+	ReusePort bool
+	// Backlog is the queue of connections not yet accepted, capped by the
+	// system (net.core.somaxconn on Linux). Zero keeps the system maximum.
+	Backlog int
+}
+
+// newListener binds the TCP listener
+func newListener(ctx context.Context, addr string, opts listenerOptions) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: opts.KeepAlivePeriod}
+	if opts.ReusePort {
+		lc.Control = reusePortControl
+	}
+
+	ln, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Backlog > 0 {
+		if err := setBacklog(ln.(*net.TCPListener), opts.Backlog); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("setting the listen backlog: %w", err)
+		}
+	}
+	return ln, nil
+}
+
+// newUnixListener binds a Unix domain socket for co-located clients. The
+// socket file is removed on Close, and a stale one left by a crash is
+// replaced.
+func newUnixListener(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// trackConnections is the http.Server ConnState hook counting the open
+// connections, as a keep-alive connection stays open between requests. It
+// also tells the hardened connections their state.
+func trackConnections(c net.Conn, state http.ConnState) {
+	if hc, ok := hardenedConnOf(c); ok {
+		hc.setState(state)
+	}
+
+	switch state {
+	case http.StateNew:
+		m.ActiveConnections.Inc()
+	case http.StateClosed, http.StateHijacked:
+		m.ActiveConnections.Dec()
+	}
+}
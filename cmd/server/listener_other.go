@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errListenerTuning = errors.New("not supported on this platform")
+
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return errListenerTuning
+}
+
+func setBacklog(_ *net.TCPListener, _ int) error {
+	return errListenerTuning
+}
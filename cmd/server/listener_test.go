@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestListenerServes(t *testing.T) {
+	ln, err := newListener(context.Background(), "127.0.0.1:0", listenerOptions{KeepAlivePeriod: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := setupRouter()
+	router.HandleFunc("/healthz", checkMuxHandler)
+	srv := &http.Server{Handler: router, ReadHeaderTimeout: time.Second}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	// Keep-alive connections are reused across requests
+	client := &http.Client{Timeout: time.Second}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://" + ln.Addr().String() + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != "imok\n" {
+			t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, "imok\n")
+		}
+	}
+}
+
+func TestUnixSocketRoundTrip(t *testing.T) {
+	setupTransactionLog(t)
+
+	path := filepath.Join(t.TempDir(), "gokvs.sock")
+	ln, err := newUnixListener(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: setupRouter(), ReadHeaderTimeout: time.Second}
+	go func() { _ = srv.Serve(ln) }()
+
+	client := &http.Client{
+		Timeout: time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	req, _ := http.NewRequest("PUT", "http://unix/v1/socket-key", strings.NewReader("socket-value"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+
+	resp, err = client.Get("http://unix/v1/socket-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "socket-value" {
+		t.Errorf("GET: got %q, want %q", body, "socket-value")
+	}
+
+	// Shutting down removes the socket file
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file still exists after shutdown: %v", err)
+	}
+}
+
+func TestActiveConnections(t *testing.T) {
+	setupMetrics()
+	before := testutil.ToFloat64(m.ActiveConnections)
+
+	ln, err := newListener(context.Background(), "127.0.0.1:0", listenerOptions{KeepAlivePeriod: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(checkMuxHandler), ReadHeaderTimeout: time.Second, ConnState: trackConnections}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	// One keep-alive connection per transport, left open once idle
+	const conns = 3
+	var transports []*http.Transport
+	for i := 0; i < conns; i++ {
+		tr := &http.Transport{}
+		transports = append(transports, tr)
+		resp, err := (&http.Client{Transport: tr, Timeout: time.Second}).Get("http://" + ln.Addr().String() + "/ruok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	waitFor := func(want float64) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for testutil.ToFloat64(m.ActiveConnections)-before != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %v active connections, want %v", testutil.ToFloat64(m.ActiveConnections)-before, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor(conns)
+	for _, tr := range transports {
+		tr.CloseIdleConnections()
+	}
+	waitFor(0)
+}
+
+func TestListenerReusePort(t *testing.T) {
+	opts := listenerOptions{ReusePort: true, Backlog: 16}
+	ln, err := newListener(context.Background(), "127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	srv := &http.Server{Handler: http.HandlerFunc(checkMuxHandler), ReadHeaderTimeout: time.Second}
+	go func() { _ = srv.Serve(ln) }()
+
+	client := &http.Client{Timeout: time.Second}
+	resp, err := client.Get("http://" + addr + "/ruok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The new server binds while the old one still listens
+	ln2, err := newListener(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatalf("binding %s while in use: %v", addr, err)
+	}
+	ln2.Close()
+
+	// The server side closes first, its connection lingers in TIME_WAIT
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ln3, err := newListener(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatalf("rebinding %s after shutdown: %v", addr, err)
+	}
+	ln3.Close()
+}
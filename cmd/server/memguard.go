@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// lowMemory is set while the heap is over -max-heap-bytes, sampled as
+// ReadMemStats stops the world and is too costly on each request
+var lowMemory atomic.Bool
+
+// checkMemory samples the heap size against the limit, and returns whether
+// the memory is critically low
+func checkMemory(limit uint64) bool {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	low := ms.HeapAlloc > limit
+	if low != lowMemory.Swap(low) {
+		log.Printf("Low memory: %t, heap %d bytes for a %d bytes limit\n", low, ms.HeapAlloc, limit)
+	}
+	return low
+}
+
+// watchMemory samples the heap size every interval
+func watchMemory(limit uint64, interval time.Duration) {
+	for range time.Tick(interval) {
+		checkMemory(limit)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+// discardResponseWriter drops the body, and implements io.StringWriter like
+// the net/http response
+type discardResponseWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *discardResponseWriter) Header() http.Header               { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error)       { return len(p), nil }
+func (w *discardResponseWriter) WriteString(s string) (int, error) { return len(s), nil }
+func (w *discardResponseWriter) WriteHeader(code int)              { w.code = code }
+
+func TestLargeGetNotCopied(t *testing.T) {
+	setupMetrics()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const size = 1 << 20
+	if err := internal.Put("large-key", strings.Repeat("x", size)); err != nil {
+		t.Fatal(err)
+	}
+	router := setupRouter()
+	req := httptest.NewRequest("GET", "/v1/large-key", nil)
+
+	const runs = 100
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < runs; i++ {
+		router.ServeHTTP(&discardResponseWriter{header: http.Header{}}, req)
+	}
+	runtime.ReadMemStats(&after)
+
+	bytes := (after.TotalAlloc - before.TotalAlloc) / runs
+	allocs := (after.Mallocs - before.Mallocs) / runs
+	if bytes >= size {
+		t.Errorf("GET allocates %d bytes/op (%d allocs/op), the value was copied", bytes, allocs)
+	}
+}
+
+func TestLargeGetLowMemory(t *testing.T) {
+	setupMetrics()
+	if err := internal.Put("large-key", strings.Repeat("x", smallValueSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := internal.Put("small-key", "x"); err != nil {
+		t.Fatal(err)
+	}
+	router := setupRouter()
+	get := func(key string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/"+key, nil))
+		return rr.Code
+	}
+
+	// Any heap is over a 1 byte limit
+	if !checkMemory(1) {
+		t.Fatal("checkMemory(1) = false, want true")
+	}
+	defer lowMemory.Store(false)
+
+	if code := get("large-key"); code != http.StatusServiceUnavailable {
+		t.Errorf("large value: got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := get("small-key"); code != http.StatusOK {
+		t.Errorf("small value: got status %d, want %d", code, http.StatusOK)
+	}
+
+	if checkMemory(1 << 62) {
+		t.Error("checkMemory(1<<62) = true, want false")
+	}
+	if code := get("large-key"); code != http.StatusOK {
+		t.Errorf("large value with memory back: got status %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// jsonMetricFamily is a metric family of the /metrics.json endpoint
+type jsonMetricFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help"`
+	Type    string       `json:"type"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+// jsonMetric holds Value for counters and gauges, Count and Sum for
+// histograms and summaries
+type jsonMetric struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  *float64          `json:"value,omitempty"`
+	Count  *uint64           `json:"count,omitempty"`
+	Sum    *float64          `json:"sum,omitempty"`
+}
+
+// newMetricsJSONHandler serves the gathered metrics as JSON, for the tools
+// that don't parse the Prometheus text format
+func newMetricsJSONHandler(g prometheus.Gatherer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		families, err := g.Gather()
+		if err != nil && len(families) == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		out := make([]jsonMetricFamily, 0, len(families))
+		for _, mf := range families {
+			f := jsonMetricFamily{
+				Name: mf.GetName(),
+				Help: mf.GetHelp(),
+				Type: mf.GetType().String(),
+			}
+			for _, metric := range mf.GetMetric() {
+				f.Metrics = append(f.Metrics, toJSONMetric(metric))
+			}
+			out = append(out, f)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			log.Printf("ERROR in json.Encode for metrics: %v\n", err)
+		}
+	}
+}
+
+func toJSONMetric(metric *dto.Metric) jsonMetric {
+	var jm jsonMetric
+	if len(metric.GetLabel()) > 0 {
+		jm.Labels = make(map[string]string, len(metric.GetLabel()))
+		for _, lp := range metric.GetLabel() {
+			jm.Labels[lp.GetName()] = lp.GetValue()
+		}
+	}
+
+	switch {
+	case metric.Counter != nil:
+		jm.Value = metric.Counter.Value
+	case metric.Gauge != nil:
+		jm.Value = metric.Gauge.Value
+	case metric.Untyped != nil:
+		jm.Value = metric.Untyped.Value
+	case metric.Histogram != nil:
+		jm.Count, jm.Sum = metric.Histogram.SampleCount, metric.Histogram.SampleSum
+	case metric.Summary != nil:
+		jm.Count, jm.Sum = metric.Summary.SampleCount, metric.Summary.SampleSum
+	}
+	return jm
+}
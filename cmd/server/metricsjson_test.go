@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsJSON(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v1/json-key", bytes.NewBufferString("value")))
+
+	rr := httptest.NewRecorder()
+	newMetricsJSONHandler(testRegistry)(rr, httptest.NewRequest("GET", "/metrics.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	var families []jsonMetricFamily
+	if err := json.Unmarshal(rr.Body.Bytes(), &families); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	for _, f := range families {
+		if f.Name != "gokvs_events_put" {
+			continue
+		}
+		if f.Type != "COUNTER" || len(f.Metrics) != 1 || f.Metrics[0].Value == nil || *f.Metrics[0].Value < 1 {
+			t.Errorf("unexpected gokvs_events_put family: %+v", f)
+		}
+		return
+	}
+	t.Errorf("gokvs_events_put not found in %s", rr.Body)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+// keyValueMultiGetHandler returns the values of a JSON array of keys as a
+// JSON object, the missing keys left out. It serves /v1/mget and
+// /v1:batchGet. With ?meta=1, each value comes with its version, size and
+// timestamps, for cache-coherence decisions.
+func keyValueMultiGetHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	var keys []string
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		http.Error(w, fmt.Sprintf("invalid keys: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !checkBatchSize(w, len(keys)) || !checkKeyPrefix(w, keys...) {
+		return
+	}
+
+	var out interface{}
+	var found int
+	if meta := r.URL.Query().Get("meta"); meta == "" || meta == "0" {
+		values := internal.GetMulti(keys)
+		out, found = values, len(values)
+	} else {
+		entries := internal.GetMany(keys)
+		out, found = entries, len(entries)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("ERROR in json.Encode for MGET\n")
+	}
+
+	m.EventsGet.Add(float64(found))
+	m.EventsGetMiss.Add(float64(len(keys) - found))
+	log.Printf("MGET keys=%d found=%d\n", len(keys), found)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidaparicio/gokvs/internal"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMultiGetWithMeta(t *testing.T) {
+	setupTransactionLog(t)
+	for _, key := range []string{"mget:a", "mget:b"} {
+		_, _ = internal.Delete(key) // Versions start over
+	}
+	before := time.Now()
+	for _, value := range []string{"v1", "version-2"} {
+		if err := internal.Put("mget:a", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := internal.Put("mget:b", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `["mget:a", "mget:b", "mget:missing"]`
+	rr := httptest.NewRecorder()
+	keyValueMultiGetHandler(rr, httptest.NewRequest("POST", "/v1/mget?meta=1", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	var entries map[string]internal.Entry
+	if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2: %s", len(entries), rr.Body)
+	}
+	a := entries["mget:a"]
+	if a.Value != "version-2" || a.Version != 2 || a.Size != len("version-2") {
+		t.Errorf("mget:a = %+v, want version-2 at version 2", a)
+	}
+	if a.Created.Before(before) || a.Modified.Before(a.Created) {
+		t.Errorf("mget:a timestamps: created %v, modified %v", a.Created, a.Modified)
+	}
+	if b := entries["mget:b"]; b.Value != "b" || b.Version != 1 {
+		t.Errorf("mget:b = %+v, want b at version 1", b)
+	}
+
+	// Plain values without ?meta
+	rr = httptest.NewRecorder()
+	keyValueMultiGetHandler(rr, httptest.NewRequest("POST", "/v1/mget", strings.NewReader(body)))
+	var values map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &values); err != nil || values["mget:b"] != "b" {
+		t.Errorf("got %s, %v; want the plain values", rr.Body, err)
+	}
+}
+
+func TestBatchGet(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	router.HandleFunc("/v1:batchGet", keyValueMultiGetHandler).Methods("POST")
+	for _, key := range []string{"batch-get:a", "batch-get:b"} {
+		if err := internal.Put(key, key+"-value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hits := testutil.ToFloat64(m.EventsGet)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/v1:batchGet", strings.NewReader(`["batch-get:a", "batch-get:b", "batch-get:missing"]`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if got := strings.TrimSpace(rr.Body.String()); got != `{"batch-get:a":"batch-get:a-value","batch-get:b":"batch-get:b-value"}` {
+		t.Errorf("got %s, want the 2 found values", got)
+	}
+	if got := testutil.ToFloat64(m.EventsGet) - hits; got != 2 {
+		t.Errorf("got %.0f GET events, want 2", got)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// otherPrefix labels the keys outside of the allowlist, bounding the series
+const otherPrefix = "other"
+
+// keyPrefix returns the first segment of a key, like "tenant" in "tenant:42"
+func keyPrefix(key string) string {
+	if i := strings.IndexAny(key, ":/"); i > 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// newPrefixMetricsMiddleware counts the key requests by prefix, for a
+// per-tenant view of the traffic. Only the allowlisted prefixes get their
+// own series, a client can't blow up the cardinality.
+func newPrefixMetricsMiddleware(prefixes []string) mux.MiddlewareFunc {
+	allowed := make(map[string]bool, len(prefixes))
+	for _, p := range prefixes {
+		allowed[p] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key, ok := mux.Vars(r)["key"]; ok {
+				prefix := keyPrefix(key)
+				if !allowed[prefix] {
+					prefix = otherPrefix
+				}
+				m.RequestsByPrefix.WithLabelValues(prefix, r.Method).Inc()
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrefixMetrics(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	router.Use(newPrefixMetricsMiddleware([]string{"acme"}))
+
+	acme := m.RequestsByPrefix.WithLabelValues("acme", "GET")
+	other := m.RequestsByPrefix.WithLabelValues(otherPrefix, "GET")
+	acmeBefore, otherBefore := testutil.ToFloat64(acme), testutil.ToFloat64(other)
+
+	for _, key := range []string{"acme:1", "acme:2", "globex:1", "plain-key"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/"+key, nil))
+	}
+
+	if got := testutil.ToFloat64(acme) - acmeBefore; got != 2 {
+		t.Errorf("acme: got %v requests, want 2", got)
+	}
+	if got := testutil.ToFloat64(other) - otherBefore; got != 2 {
+		t.Errorf("other: got %v requests, want 2", got)
+	}
+}
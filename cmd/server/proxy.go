@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/davidaparicio/gokvs/internal"
+	"github.com/gorilla/mux"
+)
+
+// newProxyHandler returns a front handler forwarding each /v1/{key} request
+// to the peer owning the key, so the cluster scales without an external proxy
+func newProxyHandler(peers []string) (http.Handler, error) {
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("proxy mode needs at least one peer")
+	}
+
+	proxies := make(map[string]*httputil.ReverseProxy, len(peers))
+	for _, peer := range peers {
+		target, err := url.Parse(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer %q: %w", peer, err)
+		}
+		if target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("invalid peer %q: expected scheme://host:port", peer)
+		}
+		proxies[peer] = httputil.NewSingleHostReverseProxy(target)
+	}
+
+	ring := internal.NewHashRing(internal.DefaultReplicas, peers...)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["key"]
+		peer := ring.Node(key)
+
+		log.Printf("PROXY key=%s peer=%s\n", key, peer)
+		proxies[peer].ServeHTTP(w, r)
+	}), nil
+}
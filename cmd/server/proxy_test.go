@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davidaparicio/gokvs/internal"
+	"github.com/gorilla/mux"
+)
+
+func TestProxyRoutesKeysToOwner(t *testing.T) {
+	// Each backend answers with its own name
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name)
+		}))
+	}
+	a, b := backend("a"), backend("b")
+	defer a.Close()
+	defer b.Close()
+	names := map[string]string{a.URL: "a", b.URL: "b"}
+
+	peers := []string{a.URL, b.URL}
+	proxy, err := newProxyHandler(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.Handle("/v1/{key}", proxy).Methods("GET", "PUT", "DELETE")
+
+	ring := internal.NewHashRing(internal.DefaultReplicas, peers...)
+	routed := make(map[string]int)
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		want := names[ring.Node(key)]
+
+		// Ask twice, the owner must not change between requests
+		for j := 0; j < 2; j++ {
+			req := httptest.NewRequest("GET", "/v1/"+key, nil)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if got := rr.Body.String(); got != want {
+				t.Fatalf("key %s routed to backend %q, want %q", key, got, want)
+			}
+		}
+		routed[want]++
+	}
+
+	if routed["a"] == 0 || routed["b"] == 0 {
+		t.Errorf("keys were not spread across backends: %v", routed)
+	}
+}
+
+func TestProxyInvalidPeer(t *testing.T) {
+	if _, err := newProxyHandler([]string{"localhost"}); err == nil {
+		t.Error("expected an error for a peer without scheme")
+	}
+	if _, err := newProxyHandler(nil); err == nil {
+		t.Error("expected an error without peers")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidaparicio/gokvs/internal"
+	"github.com/gorilla/mux"
+)
+
+// keyValueMatchHandler lists the keys matching ?pattern=, a glob like user:*:name
+func keyValueMatchHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		http.Error(w, "missing pattern", http.StatusBadRequest)
+		return
+	}
+	limit, err := queryLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	keys, err := internal.Match(pattern, limit)
+	if err != nil {
+		http.Error(w, "invalid pattern: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		log.Printf("ERROR in json.Encode for MATCH pattern=%s\n", pattern)
+	}
+
+	log.Printf("MATCH pattern=%s keys=%d\n", pattern, len(keys))
+}
+
+// keyValueListHandler lists the keys one per line, or as a JSON array with
+// Accept: application/json. Paginate with ?limit= and ?after=<last key>. An
+// empty store answers an empty list, or 204 with -empty-list-no-content.
+// With ?prefix=, it returns the matching key/value pairs as a JSON object.
+func keyValueListHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	if query := r.URL.Query(); query.Has("prefix") {
+		scanPrefix(w, query.Get("prefix"))
+		return
+	}
+
+	limit, err := queryLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	keys := internal.ListKeys()
+	if len(keys) == 0 && cfg.EmptyListNoContent {
+		w.WriteHeader(http.StatusNoContent)
+		log.Printf("LIST keys=0\n")
+		return
+	}
+	if keys == nil {
+		keys = []string{} // Encoded as [], not null
+	}
+	if after := r.URL.Query().Get("after"); after != "" {
+		keys = keys[sort.Search(len(keys), func(i int) bool { return keys[i] > after }):]
+	}
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(keys)
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, key := range keys {
+			if _, err = io.WriteString(w, key+"\n"); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("ERROR in LIST: %v\n", err)
+	}
+
+	log.Printf("LIST keys=%d\n", len(keys))
+}
+
+func scanPrefix(w http.ResponseWriter, prefix string) {
+	pairs := internal.Scan(prefix)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pairs); err != nil {
+		log.Printf("ERROR in json.Encode for SCAN prefix=%s\n", prefix)
+	}
+
+	log.Printf("SCAN prefix=%s keys=%d\n", prefix, len(pairs))
+}
+
+// scanStreamBatch is the number of values read under one lock and flushed
+// at once by the streaming scan
+const scanStreamBatch = 100
+
+// scanEntry is a line of the streaming scan
+type scanEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// keyValueScanStreamHandler streams the key/value pairs whose key starts with
+// ?prefix= as newline-delimited JSON, sorted by key. Only the matching keys
+// are listed at once, the values are read scanStreamBatch at a time without
+// holding the store lock in between: the keys deleted meanwhile are skipped.
+func keyValueScanStreamHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	prefix := r.URL.Query().Get("prefix")
+	keys := internal.ScanKeys(prefix)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	count := 0
+	for start := 0; start < len(keys); start += scanStreamBatch {
+		batch := keys[start:min(start+scanStreamBatch, len(keys))]
+		values := internal.GetMulti(batch)
+		for _, key := range batch {
+			value, ok := values[key]
+			if !ok {
+				continue
+			}
+			if err := enc.Encode(scanEntry{Key: key, Value: value}); err != nil {
+				log.Printf("ERROR in SCAN STREAM prefix=%s: %v\n", prefix, err)
+				return // The client is gone
+			}
+			count++
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	log.Printf("SCAN STREAM prefix=%s keys=%d\n", prefix, count)
+}
+
+// keyValueChangesHandler lists the keys modified after ?since=<RFC 3339 time>,
+// oldest change first
+func keyValueChangesHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	since, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, "invalid since, expected an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+
+	keys := internal.ChangedSince(since)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		log.Printf("ERROR in json.Encode for CHANGES since=%s\n", since.Format(time.RFC3339Nano))
+	}
+
+	log.Printf("CHANGES since=%s keys=%d\n", since.Format(time.RFC3339Nano), len(keys))
+}
+
+// historyEntry is an event of the history of a key. The log records no
+// time, the sequence number orders the events.
+type historyEntry struct {
+	Sequence uint64 `json:"sequence"`
+	Type     string `json:"type"`
+	Value    string `json:"value,omitempty"`
+}
+
+// keyValueHistoryHandler lists the events of the key in the transaction log,
+// oldest first, as an audit trail. Each request reads the whole log, rotated
+// segments included, a cost growing with the log until it's compacted: it's
+// meant for audits, not for the hot path.
+func keyValueHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+	key := mux.Vars(r)["key"]
+
+	events, err := transact.History(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	written := false // The clears are listed too, but name no key
+	for _, e := range events {
+		written = written || e.Key == key
+	}
+	if !written {
+		http.Error(w, internal.ErrorNoSuchKey.Error(), http.StatusNotFound)
+		return
+	}
+
+	history := make([]historyEntry, len(events))
+	for i, e := range events {
+		history[i] = historyEntry{Sequence: e.Sequence, Type: e.EventType.String(), Value: e.Value}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		log.Printf("ERROR in json.Encode for HISTORY key=%s\n", key)
+	}
+
+	log.Printf("HISTORY key=%s events=%d\n", key, len(history))
+}
+
+// queryLimit parses the optional ?limit= query parameter, 0 if absent
+func queryLimit(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid limit %q", s)
+	}
+	return limit, nil
+}
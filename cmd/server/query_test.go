@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+func TestMatchHandler(t *testing.T) {
+	setupMetrics()
+	for _, key := range []string{"user:1:name", "user:2:name", "user:1:email", "session:1"} {
+		if err := internal.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		keyValueMatchHandler(rr, httptest.NewRequest("GET", "/v1/match?"+query, nil))
+		return rr
+	}
+
+	rr := get("pattern=user:*:name")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	var keys []string
+	if err := json.Unmarshal(rr.Body.Bytes(), &keys); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(keys, ","); got != "user:1:name,user:2:name" {
+		t.Errorf("got keys %s, want user:1:name,user:2:name", got)
+	}
+
+	if rr := get("pattern=user:*&limit=1"); strings.TrimSpace(rr.Body.String()) != `["user:1:email"]` {
+		t.Errorf("limit: got %s, want [\"user:1:email\"]", rr.Body)
+	}
+
+	for _, query := range []string{"", "pattern=user:[", "pattern=*&limit=-1"} {
+		if rr := get(query); rr.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want %d", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestListHandler(t *testing.T) {
+	setupMetrics()
+	for _, key := range []string{"list:a", "list:b", "list:c"} {
+		if err := internal.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := internal.PutWithTTL("list:expired", "value", time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	list := func(query, accept string) string {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1?"+query, nil)
+		req.Header.Set("Accept", accept)
+		keyValueListHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+		}
+		return rr.Body.String()
+	}
+
+	if got := list("after=list:&limit=2", ""); got != "list:a\nlist:b\n" {
+		t.Errorf("got %q, want the first page", got)
+	}
+	var keys []string
+	if err := json.Unmarshal([]byte(list("after=list:b&limit=2", "application/json")), &keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) == 0 || keys[0] != "list:c" || (len(keys) > 1 && keys[1] == "list:expired") {
+		t.Errorf("got keys %v, want list:c without the expired key", keys)
+	}
+}
+
+func TestListHandlerPrefix(t *testing.T) {
+	setupMetrics()
+	for _, key := range []string{"tree:user:1", "tree:user:2", "tree:group:1"} {
+		if err := internal.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	keyValueListHandler(rr, httptest.NewRequest("GET", "/v1?prefix=tree:user:", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if got := strings.TrimSpace(rr.Body.String()); got != `{"tree:user:1":"value","tree:user:2":"value"}` {
+		t.Errorf("got %s, want the 2 user pairs", got)
+	}
+}
+
+func TestScanStreamHandler(t *testing.T) {
+	setupMetrics()
+	const n = 1000
+	for i := 0; i < n; i++ {
+		if err := internal.Put(fmt.Sprintf("stream:%04d", i), strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := internal.Put("streamed-not", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	keyValueScanStreamHandler(rr, httptest.NewRequest("GET", "/v1/scan/stream?prefix=stream:", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if !rr.Flushed {
+		t.Error("the stream was never flushed")
+	}
+
+	dec := json.NewDecoder(rr.Body)
+	count := 0
+	for dec.More() {
+		var e scanEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("stream:%04d", count); e.Key != want || e.Value != strconv.Itoa(count) {
+			t.Fatalf("entry %d = %+v, want key %s", count, e, want)
+		}
+		count++
+	}
+	if count != n {
+		t.Errorf("got %d entries, want %d", count, n)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	router.HandleFunc("/v1/{key}/history", keyValueHistoryHandler).Methods("GET")
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+	do("PUT", "/v1/audited", "v1")
+	do("PUT", "/v1/other", "x")
+	do("PUT", "/v1/audited", "v2")
+	do("DELETE", "/v1/audited", "")
+	do("PUT", "/v1/audited", "v3")
+
+	rr := do("GET", "/v1/audited/history", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	var history []historyEntry
+	if err := json.NewDecoder(rr.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	want := []historyEntry{
+		{Sequence: 1, Type: "put", Value: "v1"},
+		{Sequence: 3, Type: "put", Value: "v2"},
+		{Sequence: 4, Type: "delete"},
+		{Sequence: 5, Type: "put", Value: "v3"},
+	}
+	if fmt.Sprint(history) != fmt.Sprint(want) {
+		t.Errorf("got history %v, want %v", history, want)
+	}
+
+	transact.WriteClear() // Listed in the histories, but no key of its own
+	if rr := do("GET", "/v1/never-written/history", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown key: got status %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestListHandlerEmptyStore(t *testing.T) {
+	setupMetrics()
+	if _, err := internal.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1", nil)
+		req.Header.Set("Accept", "application/json")
+		keyValueListHandler(rr, req)
+		return rr
+	}
+
+	if rr := list(); rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("default: got %d %q, want %d []", rr.Code, rr.Body, http.StatusOK)
+	}
+
+	setConfig(t, func(c *config) { c.EmptyListNoContent = true })
+	if rr := list(); rr.Code != http.StatusNoContent || rr.Body.Len() != 0 {
+		t.Errorf("-empty-list-no-content: got %d %q, want %d without a body", rr.Code, rr.Body, http.StatusNoContent)
+	}
+}
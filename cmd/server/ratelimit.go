@@ -0,0 +1,152 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// tokenBucket refills rate tokens per second, up to burst tokens
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Allow takes a token, if any
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// newRateLimitMiddleware answers 429 to requests over the global limit or the
+// limit of their HTTP method, as writes cost more than reads
+func newRateLimitMiddleware(global float64, perMethod map[string]float64, burst int) mux.MiddlewareFunc {
+	var globalBucket *tokenBucket
+	if global > 0 {
+		globalBucket = newTokenBucket(global, burst)
+	}
+	methodBuckets := make(map[string]*tokenBucket, len(perMethod))
+	for method, rate := range perMethod {
+		methodBuckets[method] = newTokenBucket(rate, burst)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if b, ok := methodBuckets[r.Method]; ok && !b.Allow() {
+				tooManyRequests(w)
+				return
+			}
+			if globalBucket != nil && !globalBucket.Allow() {
+				tooManyRequests(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// keyBuckets holds the token buckets of the most recently seen keys, the
+// least recently used one is dropped beyond size
+type keyBuckets struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	size    int
+	lru     *list.List               // Front is the most recently used
+	buckets map[string]*list.Element // Key -> element holding a *keyBucket
+}
+
+type keyBucket struct {
+	key    string
+	bucket *tokenBucket
+}
+
+func newKeyBuckets(rate float64, burst, size int) *keyBuckets {
+	return &keyBuckets{rate: rate, burst: burst, size: size, lru: list.New(), buckets: make(map[string]*list.Element)}
+}
+
+// Allow takes a token from the bucket of the key, created full if unknown
+func (k *keyBuckets) Allow(key string) bool {
+	k.mu.Lock()
+	e, ok := k.buckets[key]
+	if ok {
+		k.lru.MoveToFront(e)
+	} else {
+		e = k.lru.PushFront(&keyBucket{key: key, bucket: newTokenBucket(k.rate, k.burst)})
+		k.buckets[key] = e
+		if k.lru.Len() > k.size {
+			oldest := k.lru.Remove(k.lru.Back()).(*keyBucket)
+			delete(k.buckets, oldest.key)
+		}
+	}
+	b := e.Value.(*keyBucket).bucket
+	k.mu.Unlock()
+
+	return b.Allow()
+}
+
+// newKeyRateLimitMiddleware answers 429 to the requests over the limit of
+// their key, so a hot key can't starve the others. Only the size most recently
+// used keys are tracked, bounding the memory.
+func newKeyRateLimitMiddleware(rate float64, burst, size int) mux.MiddlewareFunc {
+	buckets := newKeyBuckets(rate, burst, size)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key, ok := mux.Vars(r)["key"]; ok && !buckets.Allow(key) {
+				tooManyRequests(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
+// parseMethodRates parses "PUT=5,DELETE=5" into requests per second by method
+func parseMethodRates(s string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, item := range splitList(s) {
+		method, rate, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid method rate %q, expected METHOD=rate", item)
+		}
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("invalid method rate %q, expected a positive number", item)
+		}
+		rates[strings.ToUpper(strings.TrimSpace(method))] = r
+	}
+	return rates, nil
+}
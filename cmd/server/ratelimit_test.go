@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPerMethodRateLimit(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	router.Use(newRateLimitMiddleware(0, map[string]float64{"PUT": 1, "GET": 100}, 0))
+
+	do := func(method string) int {
+		req := httptest.NewRequest(method, "/v1/limited-key", bytes.NewBufferString("value"))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Writes faster than 1 per second: only the first one goes through
+	if code := do("PUT"); code != http.StatusCreated {
+		t.Fatalf("first PUT: got status %d, want %d", code, http.StatusCreated)
+	}
+	for i := 0; i < 5; i++ {
+		if code := do("PUT"); code != http.StatusTooManyRequests {
+			t.Errorf("PUT #%d: got status %d, want %d", i+2, code, http.StatusTooManyRequests)
+		}
+	}
+
+	// Reads stay under their own limit
+	for i := 0; i < 20; i++ {
+		if code := do("GET"); code != http.StatusOK {
+			t.Errorf("GET #%d: got status %d, want %d", i+1, code, http.StatusOK)
+		}
+	}
+}
+
+func TestGlobalRateLimit(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	router.Use(newRateLimitMiddleware(2, nil, 0))
+
+	var limited int
+	for i := 0; i < 5; i++ {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/unknown-key", nil))
+		if rr.Code == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited != 3 {
+		t.Errorf("got %d limited requests, want 3", limited)
+	}
+}
+
+func TestParseMethodRates(t *testing.T) {
+	rates, err := parseMethodRates("put=5, DELETE=2.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rates["PUT"] != 5 || rates["DELETE"] != 2.5 {
+		t.Errorf("unexpected rates: %v", rates)
+	}
+
+	for _, bad := range []string{"PUT", "PUT=abc", "PUT=0"} {
+		if _, err := parseMethodRates(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestKeyRateLimit(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	router.Use(newKeyRateLimitMiddleware(1, 3, 100))
+
+	get := func(key string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/"+key, nil))
+		return rr.Code
+	}
+
+	var limited int
+	for i := 0; i < 10; i++ {
+		if get("hot-key") == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited != 7 {
+		t.Errorf("hot key: got %d limited requests, want 7", limited)
+	}
+
+	// The other keys are unaffected
+	for i := 0; i < 3; i++ {
+		if code := get("cold-key"); code == http.StatusTooManyRequests {
+			t.Errorf("cold key GET #%d: got status %d", i+1, code)
+		}
+	}
+}
+
+func TestKeyBucketsBounded(t *testing.T) {
+	buckets := newKeyBuckets(1, 1, 2)
+	for _, key := range []string{"a", "b", "c"} {
+		buckets.Allow(key)
+	}
+	if len(buckets.buckets) != 2 || buckets.lru.Len() != 2 {
+		t.Fatalf("tracking %d keys, want 2", len(buckets.buckets))
+	}
+	if _, ok := buckets.buckets["a"]; ok {
+		t.Error("the least recently used key is still tracked")
+	}
+}
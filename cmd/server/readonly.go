@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// newReadOnlyMiddleware rejects the writes with 405 and keeps serving the
+// reads, for read replicas or during a maintenance. The admin actions don't
+// write to the store, and stay allowed.
+func newReadOnlyMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isWriteRequest(r) && !strings.HasPrefix(r.URL.Path, "/admin/") {
+				http.Error(w, "Read-only mode", http.StatusMethodNotAllowed)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// maintenance is set while the writes are paused, e.g. during a backup. Unlike
+// the read-only mode, it's toggled at runtime and the log stays writable.
+var maintenance atomic.Bool
+
+// maintenanceRetryAfter is the Retry-After, in seconds, of the writes
+// refused during a maintenance
+const maintenanceRetryAfter = "30"
+
+// setMaintenance pauses (or resumes) the writes, reflected by the read-only
+// gauge
+func setMaintenance(enabled bool) {
+	maintenance.Store(enabled)
+	if enabled || cfg.ReadOnly {
+		m.ReadOnly.Set(1)
+	} else {
+		m.ReadOnly.Set(0)
+	}
+}
+
+// newMaintenanceMiddleware rejects the writes with 503 during a maintenance,
+// so the clients retry once it's over, and keeps serving the reads
+func newMaintenanceMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if maintenance.Load() && isWriteRequest(r) && !strings.HasPrefix(r.URL.Path, "/admin/") {
+				w.Header().Set("Retry-After", maintenanceRetryAfter)
+				http.Error(w, "Read-only for a maintenance, retry later", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/davidaparicio/gokvs/internal"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+
+	// Data written by the primary
+	primary, err := internal.NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary.Run()
+	primary.WritePut("replica-key", "replicated")
+	primary.Close()
+
+	setConfig(t, func(c *config) { c.ReadOnly = true })
+	if _, err := internal.Delete("replica-key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+
+	router := setupRouter()
+	router.Use(newReadOnlyMiddleware())
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/replica-key", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "replicated" {
+		t.Errorf("GET: got %d %q, want %d %q", rr.Code, rr.Body, http.StatusOK, "replicated")
+	}
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, "/v1/replica-key", bytes.NewBufferString("overwritten")))
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: got status %d, want %d", method, rr.Code, http.StatusMethodNotAllowed)
+		}
+	}
+	if value, _ := internal.Get("replica-key"); value != "replicated" {
+		t.Errorf("value changed to %q in read-only mode", value)
+	}
+
+	// The POST routes that only read are served
+	router.HandleFunc("/v1/mget", keyValueMultiGetHandler).Methods("POST")
+	router.HandleFunc("/v1:batchGet", keyValueMultiGetHandler).Methods("POST")
+	for _, path := range []string{"/v1/mget", "/v1:batchGet"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", path, bytes.NewBufferString(`["replica-key"]`)))
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "replicated") {
+			t.Errorf("POST %s: got %d %q, want %d with the value", path, rr.Code, rr.Body, http.StatusOK)
+		}
+	}
+
+	// The dry-runs are served, they mutate nothing
+	router.HandleFunc("/v1:batch", keyValueBatchHandler).Methods("POST")
+	for path, want := range map[string]int{
+		"/v1:batch?dry-run=1": http.StatusOK,
+		"/v1:batch":           http.StatusMethodNotAllowed,
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", path, bytes.NewBufferString(`[{"op":"delete","key":"replica-key"}]`)))
+		if rr.Code != want {
+			t.Errorf("POST %s: got status %d, want %d", path, rr.Code, want)
+		}
+	}
+	if value, _ := internal.Get("replica-key"); value != "replicated" {
+		t.Errorf("value changed to %q by a dry-run in read-only mode", value)
+	}
+}
+
+func TestMaintenanceToggle(t *testing.T) {
+	setupTransactionLog(t)
+	setConfig(t, func(c *config) { c.AdminToken = "secret" })
+	t.Cleanup(func() { setMaintenance(false) })
+
+	router := setupRouter()
+	router.HandleFunc("/admin/readonly", adminAuth(adminReadOnlyHandler)).Methods("POST")
+	router.HandleFunc("/v1/mget", keyValueMultiGetHandler).Methods("POST")
+	router.HandleFunc("/v1:batchGet", keyValueMultiGetHandler).Methods("POST")
+	router.HandleFunc("/v1:batch", keyValueBatchHandler).Methods("POST")
+	router.Use(newMaintenanceMiddleware())
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	do("PUT", "/v1/maintained-key", "v1")
+
+	if rr := do("POST", "/admin/readonly?enabled=true", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("enable: got status %d, want %d", rr.Code, http.StatusNoContent)
+	}
+	if got := testutil.ToFloat64(m.ReadOnly); got != 1 {
+		t.Errorf("read-only gauge = %v, want 1", got)
+	}
+	for _, method := range []string{"PUT", "DELETE"} {
+		rr := do(method, "/v1/maintained-key", "v2")
+		if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: got status %d, Retry-After %q; want %d with a Retry-After", method, rr.Code, rr.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+		}
+	}
+	if rr := do("GET", "/v1/maintained-key", ""); rr.Code != http.StatusOK || rr.Body.String() != "v1" {
+		t.Errorf("GET: got %d %q, want %d %q", rr.Code, rr.Body, http.StatusOK, "v1")
+	}
+	for _, path := range []string{"/v1/mget", "/v1:batchGet"} {
+		if rr := do("POST", path, `["maintained-key"]`); rr.Code != http.StatusOK {
+			t.Errorf("POST %s: got status %d, want %d", path, rr.Code, http.StatusOK)
+		}
+	}
+	if rr := do("POST", "/v1:batch?dry-run=true", `[{"op":"delete","key":"maintained-key"}]`); rr.Code != http.StatusOK {
+		t.Errorf("batch dry-run: got status %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	if rr := do("POST", "/admin/readonly?enabled=false", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("disable: got status %d, want %d", rr.Code, http.StatusNoContent)
+	}
+	if got := testutil.ToFloat64(m.ReadOnly); got != 0 {
+		t.Errorf("read-only gauge = %v, want 0", got)
+	}
+	if rr := do("PUT", "/v1/maintained-key", "v2"); rr.Code != http.StatusCreated {
+		t.Errorf("PUT after the maintenance: got status %d, want %d", rr.Code, http.StatusCreated)
+	}
+}
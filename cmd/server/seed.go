@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+// loadSeedFile stores the key/value pairs of a JSON object file, or of a
+// .csv file in the export format, as defaults: the keys already set by the
+// replay are kept. The seeded values are logged like the PUTs, and the seed
+// applies to an empty log only: a seeded key deleted since stays deleted on
+// the next start, even once the log is compacted. It returns how many keys
+// were seeded.
+func loadSeedFile(filename string) (int, error) {
+	if transact.LastSequence() > 0 {
+		return 0, nil
+	}
+
+	// #nosec [G304] [-- Acceptable risk, the path comes from the operator]
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, fmt.Errorf("cannot open seed file: %w", err)
+	}
+	defer f.Close()
+
+	var pairs map[string]string
+	if strings.EqualFold(filepath.Ext(filename), ".csv") {
+		pairs, err = readCSV(f)
+	} else {
+		err = json.NewDecoder(f).Decode(&pairs)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid seed file %s: %w", filename, err)
+	}
+
+	ops := make([]internal.Op, 0, len(pairs))
+	for key, value := range pairs {
+		ops = append(ops, internal.Op{Op: internal.OpPut, Key: key, Value: value, If: internal.IfAbsent})
+	}
+	applied, err := internal.Batch(ops)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i, ok := range applied {
+		if !ok {
+			continue
+		}
+		if !cfg.ReadOnly { // Nothing is logged, the seed applies on each start
+			transact.WritePut(ops[i].Key, ops[i].Value)
+		}
+		count++
+	}
+	return count, nil
+}
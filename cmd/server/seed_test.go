@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/davidaparicio/gokvs/internal"
+)
+
+func TestLoadSeedFile(t *testing.T) {
+	setupTransactionLog(t)
+	dir := t.TempDir()
+	jsonSeed := filepath.Join(dir, "seed.json")
+	if err := os.WriteFile(jsonSeed, []byte(`{"seed:a":"default-a","seed:replayed":"default"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	csvSeed := filepath.Join(dir, "seed.csv")
+	if err := os.WriteFile(csvSeed, []byte("key,value\nseed:b,\"default, b\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Set by the replay, the seed doesn't override it
+	if err := internal.Put("seed:replayed", "from-the-log"); err != nil {
+		t.Fatal(err)
+	}
+
+	if count, err := loadSeedFile(jsonSeed); err != nil || count != 1 {
+		t.Errorf("JSON seed: got %d keys, %v; want 1", count, err)
+	}
+	setupTransactionLog(t) // The seed applies to an empty log only
+	if count, err := loadSeedFile(csvSeed); err != nil || count != 1 {
+		t.Errorf("CSV seed: got %d keys, %v; want 1", count, err)
+	}
+
+	for key, want := range map[string]string{
+		"seed:a":        "default-a",
+		"seed:b":        "default, b",
+		"seed:replayed": "from-the-log",
+	} {
+		if got, err := internal.Get(key); err != nil || got != want {
+			t.Errorf("Get(%q) = %q, %v; want %q", key, got, err, want)
+		}
+	}
+
+	if _, err := loadSeedFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected an error for a missing seed file")
+	}
+}
+
+func TestSeededKeyDeleted(t *testing.T) {
+	setupMetrics()
+	dir := t.TempDir()
+	seed := filepath.Join(dir, "seed.json")
+	if err := os.WriteFile(seed, []byte(`{"seed:deleted":"default","seed:kept":"default"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "transactions.log")
+	start := func() {
+		t.Helper()
+		if err := initializeTransactionLog(filename); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSeedFile(seed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _ = internal.Delete("seed:deleted")
+	_, _ = internal.Delete("seed:kept")
+
+	start()
+	if _, err := internal.Delete("seed:deleted"); err != nil {
+		t.Fatal(err)
+	}
+	transact.WriteDelete("seed:deleted")
+	transact.Close()
+
+	// Restarted, the replay finds the seeded PUT then its DELETE
+	_, _ = internal.Delete("seed:kept")
+	start()
+	defer transact.Close()
+	if _, err := internal.Get("seed:deleted"); !errors.Is(err, internal.ErrorNoSuchKey) {
+		t.Errorf("Get(seed:deleted) after restart error = %v, want %v", err, internal.ErrorNoSuchKey)
+	}
+	if got, err := internal.Get("seed:kept"); err != nil || got != "default" {
+		t.Errorf("Get(seed:kept) after restart = %q, %v; want %q", got, err, "default")
+	}
+}
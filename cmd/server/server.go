@@ -1,17 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/davidaparicio/gokvs/internal"
 	"github.com/gorilla/mux"
@@ -21,12 +28,34 @@ import (
 )
 
 var transact *internal.TransactionLog
+
+// writeTimeout bounds the time to handle a request and write its response
+const writeTimeout = 1 * time.Second
+
+// runningLog publishes transact once replayed and running, to the shutdown
+var runningLog atomic.Pointer[internal.TransactionLog]
 var m *internal.Metrics
 
+// accessLogSeq numbers the requests, to log 1 in -access-log-sample
+var accessLogSeq atomic.Uint64
+
+// sampleAccessLog tells whether to log the request, the first of every
+// cfg.AccessLogSample ones
+func sampleAccessLog() bool {
+	n := uint64(cfg.AccessLogSample)
+	return n <= 1 || (accessLogSeq.Add(1)-1)%n == 0
+}
+
 // prometheusMiddleware implements mux.MiddlewareFunc + loggingMiddleware
 func prometheusLoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Println(r.Method, r.RequestURI)
+		if sampleAccessLog() {
+			if id := clientIdentity(r); id != "" {
+				log.Println(r.Method, r.RequestURI, "client="+id)
+			} else {
+				log.Println(r.Method, r.RequestURI)
+			}
+		}
 		//route := mux.CurrentRoute(r); path, _ := route.GetPathTemplate()
 		timer := prometheus.NewTimer(m.RequestDurationHistogram.WithLabelValues(r.Method, r.RequestURI))
 		next.ServeHTTP(w, r)
@@ -39,31 +68,209 @@ func notAllowedHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Not Allowed", http.StatusMethodNotAllowed)
 }
 
+// browserNoiseHandler answers the requests browsers send on their own, without
+// counting them as not allowed: 204 for the favicon, 404 for robots.txt
+func browserNoiseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/favicon.ico" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.NotFound(w, r)
+}
+
 func keyValuePutHandler(w http.ResponseWriter, r *http.Request) {
 	m.QueriesInflight.Inc()
 	defer m.QueriesInflight.Dec()
 	vars := mux.Vars(r)
 	key := vars["key"]
 
-	value, err := io.ReadAll(r.Body)
-	defer r.Body.Close()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var value string
+	var err error
+	if from := r.URL.Query().Get("from"); from != "" {
+		if value, err = fetchValue(r.Context(), from); err != nil {
+			http.Error(w, err.Error(), fetchErrorStatus(err))
+			return
+		}
+	} else {
+		value, err = readValue(r.Body, r.ContentLength)
+		defer r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := validateWrite(key, value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = internal.Put(key, string(value))
+	var expiry time.Time
+	var previous string
+	var existed bool
+	ttl := r.URL.Query().Get("ttl")
+	old, cas := expectedValue(r)
+	returnPrevious := r.Header.Get("X-Return-Previous") == "true"
+	if returnPrevious && (ttl != "" || cas || r.Header.Get("X-If-Key") != "") {
+		http.Error(w, "X-Return-Previous can't be combined with ttl or a precondition", http.StatusBadRequest)
+		return
+	}
+
+	createOnly := r.Header.Get("If-None-Match") == "*"
+	if createOnly && (ttl != "" || cas || returnPrevious || r.Header.Get("X-If-Key") != "") {
+		http.Error(w, "If-None-Match: * can't be combined with ttl or another precondition", http.StatusBadRequest)
+		return
+	}
+
+	if requestCancelled(w, r) {
+		return
+	}
+	if createOnly {
+		var created bool
+		if created, err = internal.SetIfNotExists(key, value); err == nil && !created {
+			http.Error(w, fmt.Sprintf("key %s already exists", key), http.StatusConflict)
+			return
+		}
+	} else if otherKey := r.Header.Get("X-If-Key"); otherKey != "" {
+		if ttl != "" || cas {
+			http.Error(w, "X-If-Key can't be combined with ttl or a compare-and-swap", http.StatusBadRequest)
+			return
+		}
+		if !checkKeyPrefix(w, otherKey) {
+			return
+		}
+		var stored bool
+		if stored, err = internal.PutIf(key, value, otherKey, r.Header.Get("X-If-Value")); err == nil && !stored {
+			http.Error(w, fmt.Sprintf("key %s doesn't hold the X-If-Value", otherKey), http.StatusPreconditionFailed)
+			return
+		}
+	} else if cas {
+		if ttl != "" {
+			http.Error(w, "ttl can't be set by a compare-and-swap", http.StatusBadRequest)
+			return
+		}
+		var swapped bool
+		if swapped, err = internal.CompareAndSwap(key, old, value); err == nil && !swapped {
+			http.Error(w, "current value doesn't match", http.StatusPreconditionFailed)
+			return
+		}
+	} else if ttl != "" {
+		d, parseErr := time.ParseDuration(ttl)
+		if parseErr != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid ttl %q, expected a positive duration like 30s", ttl), http.StatusBadRequest)
+			return
+		}
+		if cfg.SlidingTTL || r.URL.Query().Has("sliding") {
+			expiry, err = internal.PutWithSlidingTTL(key, value, d)
+		} else {
+			expiry = time.Now().Add(d)
+			err = internal.PutWithExpiry(key, value, expiry)
+		}
+	} else if returnPrevious {
+		previous, existed, err = internal.PutAndGet(key, value)
+	} else {
+		err = internal.Put(key, value)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		storeError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	// The previous value replaces the empty 201, only when there was one
+	if existed {
+		if _, err := io.WriteString(w, previous); err != nil {
+			log.Printf("ERROR in w.Write for PUT key=%s\n", key)
+		}
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
 
-	transact.WritePut(key, string(value))
+	transact.WritePut(key, value) // Even if the client is gone, the store changed
+	if !expiry.IsZero() {
+		transact.WriteExpire(key, expiry)
+	}
 
 	m.EventsPut.Inc()
-	log.Printf("PUT key=%s value=%s\n", key, string(value))
+	log.Printf("PUT key=%s value=%s\n", key, value)
+}
+
+// expectedValue returns the value a compare-and-swap PUT expects to replace,
+// from ?cas= or else the If-Match header (the raw value, not an ETag)
+func expectedValue(r *http.Request) (string, bool) {
+	if query := r.URL.Query(); query.Has("cas") {
+		return query.Get("cas"), true
+	}
+	if values := r.Header.Values("If-Match"); len(values) > 0 {
+		return values[0], true
+	}
+	return "", false
+}
+
+// smallValueSize is the largest Content-Length preallocated by readValue,
+// bigger bodies grow as they are read so a client can't claim gigabytes
+const smallValueSize = 64 << 10
+
+// valueBufPool holds the buffers readValue reads the bodies into, under
+// write-heavy load they are reused instead of garbage collected
+var valueBufPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// maxPooledValueBuf is the largest buffer put back in valueBufPool, a single
+// huge PUT mustn't stay pinned in memory
+const maxPooledValueBuf = 1 << 20
+
+// readValue reads a request body into a pooled buffer, converted once to the
+// stored string: a value costs a single allocation, whatever its size,
+// instead of the io.ReadAll buffer growth plus the string([]byte) copy
+func readValue(body io.Reader, size int64) (string, error) {
+	buf := valueBufPool.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledValueBuf {
+			buf.Reset()
+			valueBufPool.Put(buf)
+		}
+	}()
+
+	buf.Reset()
+	if size > 0 && size <= smallValueSize {
+		buf.Grow(int(size) + bytes.MinRead) // ReadFrom wants room to read the EOF
+	}
+	if _, err := buf.ReadFrom(body); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// storeError answers a failed store write, 503 if the store lock was too
+// contended so the client retries
+func storeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, internal.ErrorLockTimeout) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// requestCancelled answers 503 to a request cancelled or timed out before
+// its write. Once the store is changed the write is logged, even if the client
+// is gone, so the store and the log don't diverge.
+func requestCancelled(w http.ResponseWriter, r *http.Request) bool {
+	if err := r.Context().Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	return false
+}
+
+// validateWrite checks a key/value pair against the write settings
+func validateWrite(key, value string) error {
+	if err := internal.ValidateKey(key); err != nil {
+		return err
+	}
+	if cfg.RequireUTF8 && (!utf8.ValidString(key) || !utf8.ValidString(value)) {
+		return errors.New("key and value must be valid UTF-8")
+	}
+	return nil
 }
 
 func keyValueGetHandler(w http.ResponseWriter, r *http.Request) {
@@ -72,8 +279,25 @@ func keyValueGetHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
 
-	value, err := internal.Get(key)
+	query := r.URL.Query()
+	var value string
+	var stamp time.Time
+	var err error
+	if query.Has("with-timestamp") {
+		value, stamp, err = internal.GetWithTimestamp(key)
+	} else {
+		value, err = internal.Get(key)
+	}
 	if errors.Is(err, internal.ErrorNoSuchKey) {
+		m.EventsGetMiss.Inc()
+		// Fallback value for config-style reads, never stored
+		if query.Has("default") {
+			setValueContentType(w)
+			if _, err := io.WriteString(w, query.Get("default")); err != nil {
+				log.Printf("ERROR in w.Write for GET key=%s\n", key)
+			}
+			return
+		}
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
@@ -81,75 +305,277 @@ func keyValueGetHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if cfg.InterpolateDepth > 0 {
+		value, err = internal.Interpolate(value, cfg.InterpolateDepth, func(ref string) bool {
+			return strings.HasPrefix(ref, cfg.RequiredKeyPrefix) // The tenant reads its own keys only
+		})
+		if errors.Is(err, internal.ErrorForbiddenReference) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	// Serving a large value needs buffers, and may push the heap over the edge
+	if len(value) > smallValueSize && lowMemory.Load() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Low memory, try again later", http.StatusServiceUnavailable)
+		return
+	}
 
-	if _, err := w.Write([]byte(value)); err != nil {
-		log.Printf("ERROR in w.Write for GET key=%s\n", key)
+	if query.Has("with-timestamp") {
+		writeTimestamped(w, value, stamp)
+	} else {
+		setValueContentType(w)
+		if _, err := io.WriteString(w, value); err != nil { // Skips the []byte(value) copy
+			log.Printf("ERROR in w.Write for GET key=%s\n", key)
+		}
 	}
 
 	m.EventsGet.Inc()
 	log.Printf("GET key=%s\n", key)
 }
 
+// keyValueHeadHandler checks the existence of a key without sending its value,
+// counted as a GET in the metrics
+func keyValueHeadHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+	key := mux.Vars(r)["key"]
+
+	size, ok := internal.Size(key)
+	if !ok {
+		m.EventsGetMiss.Inc()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	setValueContentType(w)
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.WriteHeader(http.StatusOK)
+
+	m.EventsGet.Inc()
+	log.Printf("HEAD key=%s\n", key)
+}
+
+// setValueContentType sets the -default-content-type of the values, as no
+// content type is stored per key. Without it, net/http sniffs the value.
+func setValueContentType(w http.ResponseWriter) {
+	if cfg.DefaultContentType != "" {
+		w.Header().Set("Content-Type", cfg.DefaultContentType)
+	}
+}
+
+// timestampedValue is the GET ?with-timestamp response, without a timestamp
+// if the value was stored before -record-timestamps or replayed at startup
+type timestampedValue struct {
+	Value     string     `json:"value"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+func writeTimestamped(w http.ResponseWriter, value string, stamp time.Time) {
+	tv := timestampedValue{Value: value}
+	if !stamp.IsZero() {
+		tv.Timestamp = &stamp
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tv); err != nil {
+		log.Printf("ERROR in json.Encode for GET with timestamp: %v\n", err)
+	}
+}
+
+// clearConfirmation is the X-Confirm header value DELETE /v1 requires
+const clearConfirmation = "flush-all"
+
+// keyValueClearHandler deletes all the keys, guarded against accidents by a
+// required X-Confirm: flush-all header. The clear is logged, a replay clears
+// the keys written before it too.
+func keyValueClearHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	if r.Header.Get("X-Confirm") != clearConfirmation {
+		http.Error(w, "deleting all the keys needs the X-Confirm: "+clearConfirmation+" header", http.StatusPreconditionRequired)
+		return
+	}
+
+	n, err := internal.Clear()
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	transact.WriteClear()
+	w.WriteHeader(http.StatusNoContent)
+
+	m.EventsClear.Inc()
+	log.Printf("CLEAR keys=%d\n", n)
+}
+
 func keyValueDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	m.QueriesInflight.Inc()
 	defer m.QueriesInflight.Dec()
 	vars := mux.Vars(r)
 	key := vars["key"]
+	if err := internal.ValidateKey(key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	err := internal.Delete(key)
+	if requestCancelled(w, r) {
+		return
+	}
+	var existed bool
+	var err error
+	if cfg.SoftDeleteWindow > 0 {
+		existed, err = internal.SoftDelete(key)
+	} else {
+		existed, err = internal.Delete(key)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		storeError(w, err)
+		return
+	}
+	if !existed { // Nothing deleted, nothing to log
+		http.Error(w, internal.ErrorNoSuchKey.Error(), http.StatusNotFound)
 		return
 	}
 
-	transact.WriteDelete(key)
+	transact.WriteDelete(key) // Even if the client is gone, the store changed
 
 	m.EventsDelete.Inc()
 	log.Printf("DELETE key=%s\n", key)
 }
 
+func keyValueUndeleteHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+	vars := mux.Vars(r)
+	key := vars["key"]
+	if err := internal.ValidateKey(key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	value, err := internal.Undelete(key, cfg.SoftDeleteWindow)
+	if errors.Is(err, internal.ErrorNoSuchKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	// Logged as a PUT, so the restored value survives a replay
+	transact.WritePut(key, value)
+
+	m.EventsPut.Inc()
+	log.Printf("UNDELETE key=%s\n", key)
+}
+
+// evictKey logs the eviction of a key by the bounded store as a DELETE
+func evictKey(key string) {
+	transact.WriteDelete(key)
+	m.Evictions.Inc()
+	log.Printf("EVICT key=%s\n", key)
+}
+
 func checkMuxHandler(w http.ResponseWriter, r *http.Request) {
 	if _, err := w.Write([]byte("imok\n")); err != nil {
 		log.Printf("ERROR in w.Write for ruok\n")
 	}
 }
 
-func initializeTransactionLog() error {
+func initializeTransactionLog(filename string) error {
 	var err error
 
-	transact, err = internal.NewTransactionLogger("/tmp/transactions.log")
+	transact, err = internal.NewTransactionLoggerWithConfig(internal.LoggerConfig{
+		Type:         cfg.LogType,
+		Path:         filename,
+		ReadOnly:     cfg.ReadOnly,
+		MaxLineBytes: cfg.LogMaxLineBytes,
+		MaxLogBytes:  cfg.LogMaxBytes,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create transaction logger: %w", err)
 	}
+	if transact.Recovered() {
+		m.LogRecoveries.Inc()
+	}
 
-	events, errors := transact.ReadEvents()
-	count, ok, e := 0, true, internal.Event{}
-
-	for ok && err == nil {
-		select {
-		case err, ok = <-errors:
-
-		case e, ok = <-events:
-			switch e.EventType {
-			case internal.EventDelete: // Got a DELETE event!
-				err = internal.Delete(e.Key)
-			case internal.EventPut: // Got a PUT event!
-				err = internal.Put(e.Key, e.Value)
-			}
-			m.EventsReplayed.Inc()
-			count++
-		}
+	transact.TolerateDuplicates(cfg.ReplayDupSeq)
+	loadCheckpoint(filename)
+	start := time.Now()
+	count, err := transact.ReplayWithRetry(replayEvent, cfg.ReplayAttempts, cfg.ReplayBackoff)
+	m.EventsReplayed.Add(float64(count))
+	for t, n := range transact.ReplayedByType() {
+		m.EventsReplayedByType.WithLabelValues(t.String()).Add(float64(n))
+	}
+	if count > 0 {
+		m.ReplayRate.Set(float64(count) / time.Since(start).Seconds())
 	}
 	log.Printf("%d events replayed\n", count)
+	if skipped := transact.Skipped(); skipped > 0 {
+		log.Printf("%d events skipped, their sequence number was already seen\n", skipped)
+	}
 
 	transact.Run()
+	runningLog.Store(transact)
 
 	return err
 }
 
+func replayEvent(e internal.Event) error {
+	switch e.EventType {
+	case internal.EventDelete: // Got a DELETE event!
+		_, err := internal.Delete(e.Key)
+		return err
+	case internal.EventPut: // Got a PUT event!
+		return internal.Put(e.Key, e.Value)
+	case internal.EventClear: // Got a flush-all
+		_, err := internal.Clear()
+		return err
+	case internal.EventExpire: // Got a TTL, after its PUT
+		nanos, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid expiry of key %s: %w", e.Key, err)
+		}
+		if err := internal.ExpireAt(e.Key, time.Unix(0, nanos)); !errors.Is(err, internal.ErrorNoSuchKey) {
+			return err
+		}
+	case internal.EventBounds: // Got Increment bounds, after its PUT
+		min, max, err := internal.ParseBounds(e.Value)
+		if err != nil {
+			return fmt.Errorf("invalid bounds of key %s: %w", e.Key, err)
+		}
+		if err := internal.SetBounds(e.Key, min, max); !errors.Is(err, internal.ErrorNoSuchKey) {
+			return err
+		}
+	}
+	return nil
+}
+
 func main() {
 	internal.PrintVersion()
 
+	var err error
+	if cfg, err = parseConfig(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.ValidateConfig {
+		os.Exit(runValidateConfig(cfg, os.Stderr))
+	}
+	if err := cfg.validate(); err != nil { // The same checks, before starting
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+
+	cfg.GCPercent = applyGCPercent(cfg.GCPercent)
+
 	// Create a non-global registry.
 	reg := prometheus.NewRegistry()
 	// Keep all the golang default metrics
@@ -158,42 +584,162 @@ func main() {
 	m = internal.NewMetrics(reg)
 	m.Info.With(prometheus.Labels{"version": internal.Version}).Set(1)
 
+	setMaintenance(cfg.Maintenance)
+	if cfg.LockWaitMetrics {
+		m.RegisterLockWait(reg)
+	}
+	internal.SetCaseInsensitive(cfg.CaseInsensitiveKeys)
+	internal.SetLockTimeout(cfg.LockTimeout)
+	internal.SetMaxKeyLength(cfg.MaxKeyLength)
+
 	// Initializes the transaction log and loads existing data, if any.
-	// Blocks until all data is read.
-	err := initializeTransactionLog()
-	if err != nil {
-		panic(err)
+	// The server listens meanwhile, but answers 503 until it's ready.
+	go func() {
+		err := startupReplay(cfg.LogPath, func() error {
+			m.RegisterReplayPending(reg, transact)
+			if cfg.SeedFile != "" {
+				count, err := loadSeedFile(cfg.SeedFile)
+				if err != nil {
+					return err
+				}
+				log.Printf("%d keys seeded from %s\n", count, cfg.SeedFile)
+			}
+			internal.SetRecordTimestamps(cfg.RecordTimestamps) // After the replay, its times would be wrong
+			if cfg.MaxEntries > 0 {
+				internal.SetMaxEntries(cfg.MaxEntries, evictKey) // After the replay, so the evictions are logged
+			}
+			if cfg.CheckpointInterval > 0 && !cfg.ReadOnly {
+				go checkpointEvery(cfg.LogPath, cfg.CheckpointInterval)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if cfg.MaxHeapBytes > 0 {
+		go watchMemory(cfg.MaxHeapBytes, time.Second)
+	}
+	if cfg.StatsDAddr != "" {
+		if err := emitStatsD(cfg.StatsDAddr, reg, cfg.StatsDInterval); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Delete the expired keys never read again, stopped on shutdown
+	sweeperCtx, stopSweeper := context.WithCancel(context.Background())
+	var sweeperDone <-chan struct{}
+	if cfg.ExpirySweepInterval > 0 {
+		sweeperDone = internal.StartExpirySweeper(sweeperCtx, cfg.ExpirySweepInterval)
+	}
+
+	// Finalize the soft deletes once their undo window is over
+	if cfg.SoftDeleteWindow > 0 {
+		go func() {
+			for range time.Tick(cfg.SoftDeleteWindow) {
+				internal.PurgeTombstones(cfg.SoftDeleteWindow)
+			}
+		}()
 	}
 
 	// Create a new mux router
 	r := mux.NewRouter()
 
 	r.Use(prometheusLoggingMiddleware)
+	r.Use(requestTimeoutMiddleware)
+	r.Use(readinessMiddleware)
+	if cfg.RateLimit > 0 || len(cfg.MethodRateLimits) > 0 {
+		r.Use(newRateLimitMiddleware(cfg.RateLimit, cfg.MethodRateLimits, cfg.RateBurst))
+	}
+	if cfg.KeyRateLimit > 0 {
+		r.Use(newKeyRateLimitMiddleware(cfg.KeyRateLimit, cfg.RateBurst, cfg.KeyRateKeys))
+	}
+	if cfg.RequiredKeyPrefix != "" {
+		r.Use(newRequiredPrefixMiddleware(cfg.RequiredKeyPrefix))
+	}
+	if len(cfg.MetricsKeyPrefixes) > 0 {
+		r.Use(newPrefixMetricsMiddleware(cfg.MetricsKeyPrefixes))
+	}
+	if cfg.ReadOnly {
+		log.Printf("Read-only mode, rejecting the writes")
+		r.Use(newReadOnlyMiddleware())
+	}
+	r.Use(newMaintenanceMiddleware())
+	if cfg.MaxInflightWrites > 0 {
+		r.Use(newWriteLimitMiddleware(cfg.MaxInflightWrites))
+	}
+	if cfg.InjectLatency > 0 {
+		log.Printf("WARNING: injecting %v of latency in each operation, for testing only", min(cfg.InjectLatency, maxInjectLatency))
+		r.Use(newLatencyMiddleware(cfg.InjectLatency, cfg.RequestTimeout))
+	}
 
 	// Associate a path with a handler function on the router
-	r.HandleFunc("/v1/{key}", keyValueGetHandler).Methods("GET")
-	r.HandleFunc("/v1/{key}", keyValuePutHandler).Methods("PUT")
-	r.HandleFunc("/v1/{key}", keyValueDeleteHandler).Methods("DELETE")
+	if len(cfg.Peers) > 0 {
+		proxy, err := newProxyHandler(cfg.Peers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Proxy mode, routing keys to %d peers", len(cfg.Peers))
+		r.Handle("/v1/{key}", proxy).Methods("GET", "HEAD", "PUT", "DELETE")
+	} else {
+		r.HandleFunc("/v1", keyValueListHandler).Methods("GET")
+		r.HandleFunc("/v1", keyValueClearHandler).Methods("DELETE")
+		r.HandleFunc("/v1/match", keyValueMatchHandler).Methods("GET") // Before /v1/{key}
+		r.HandleFunc("/v1/changes", keyValueChangesHandler).Methods("GET")
+		r.HandleFunc("/v1/scan/stream", keyValueScanStreamHandler).Methods("GET")
+		r.HandleFunc("/v1/export", keyValueExportHandler).Methods("GET")
+		r.HandleFunc("/v1/import", keyValueImportHandler).Methods("POST")
+		r.HandleFunc("/v1/mget", keyValueMultiGetHandler).Methods("POST")
+		r.HandleFunc("/v1/swap", keyValueSwapHandler).Methods("POST")
+		r.HandleFunc("/v1/{key}", keyValueGetHandler).Methods("GET")
+		r.HandleFunc("/v1/{key}", keyValueHeadHandler).Methods("HEAD")
+		r.HandleFunc("/v1/{key}", keyValuePutHandler).Methods("PUT")
+		r.HandleFunc("/v1/{key}", keyValueDeleteHandler).Methods("DELETE")
+		r.HandleFunc("/v1/{key}/history", keyValueHistoryHandler).Methods("GET")
+		r.HandleFunc("/v1/{key}/undelete", keyValueUndeleteHandler).Methods("POST")
+		r.HandleFunc("/v1/{key}/copy", keyValueCopyHandler).Methods("POST")
+		r.HandleFunc("/v1/{key}/rename", keyValueRenameHandler).Methods("POST")
+		r.HandleFunc("/v1/{key}/incr", keyValueIncrementHandler).Methods("POST")
+		r.HandleFunc("/v1/{key}/bounds", keyValueBoundsHandler).Methods("PUT")
+		r.HandleFunc("/v1/{key}/append", keyValueAppendHandler).Methods("POST")
+		r.HandleFunc("/v1:batch", keyValueBatchHandler).Methods("POST")
+		r.HandleFunc("/v1:batchGet", keyValueMultiGetHandler).Methods("POST")
+		r.HandleFunc("/v1:batchPut", keyValueBatchPutHandler).Methods("POST")
+		r.HandleFunc("/v1:snapshot", keyValueSnapshotHandler).Methods("GET")
+		r.HandleFunc("/v1:restore", keyValueRestoreHandler).Methods("POST")
+	}
+
+	r.HandleFunc("/admin/config", adminAuth(adminConfigHandler)).Methods("GET")
+	r.HandleFunc("/admin/flush-log", adminAuth(adminFlushLogHandler)).Methods("POST")
+	r.HandleFunc("/admin/compact-log", adminAuth(adminCompactLogHandler)).Methods("POST")
+	r.HandleFunc("/admin/readonly", adminAuth(adminReadOnlyHandler)).Methods("POST")
 
 	r.HandleFunc("/healthz", checkMuxHandler)
+	r.HandleFunc("/readyz", readyzHandler)
 	r.HandleFunc("/ruok", checkMuxHandler)
 
 	// Expose metrics and custom registry via an HTTP server
 	// using the HandleFor function. "/metrics" is the usual endpoint for that.
 	r.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	r.HandleFunc("/metrics.json", newMetricsJSONHandler(reg)).Methods("GET")
+
+	r.HandleFunc("/favicon.ico", browserNoiseHandler)
+	r.HandleFunc("/robots.txt", browserNoiseHandler)
 
 	r.HandleFunc("/", notAllowedHandler)
 	r.HandleFunc("/v1", notAllowedHandler)
 	r.HandleFunc("/v1/{key}", notAllowedHandler)
 
 	srv := &http.Server{
-		Addr:              ":8080",
-		ReadTimeout:       1 * time.Second,
-		WriteTimeout:      1 * time.Second,
-		IdleTimeout:       30 * time.Second,
-		ReadHeaderTimeout: 2 * time.Second,
+		Addr:              cfg.Addr,
+		ReadTimeout:       cfg.RequestTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ReadHeaderTimeout: cfg.HeaderTimeout,
 		Handler:           r,
-		//TLSConfig: tlsConfig,
+		ConnState:         trackConnections,
+		ConnContext:       hardenedConnContext,
 	}
 
 	// Improvement possible https://pkg.go.dev/golang.org/x/sync/errgroup
@@ -217,14 +763,27 @@ func main() {
 		log.Printf("Caught the following signal: %+v", sig)
 
 		log.Printf("Gracefully shutting down server..")
-		if err := srv.Shutdown(context.Background()); err != nil {
+		if err := drainAndShutdown(srv, cfg.DrainGrace); err != nil {
 			log.Printf("Unable to shutdown server: %v", err)
 		} else {
 			log.Printf("Server stopped")
 		}
 
+		stopSweeper()
+		if sweeperDone != nil {
+			<-sweeperDone
+		}
+
 		log.Printf("Gracefully shutting down TransactionLogger...")
-		if err := transact.Close(); err != nil {
+		if tl := runningLog.Load(); tl == nil {
+			log.Printf("Stopped during the replay")
+		} else if !cfg.ShutdownFlush {
+			if dropped, err := tl.Abort(); err != nil {
+				log.Printf("Unable to abort FileTransactionLogger: %v", err)
+			} else {
+				log.Printf("FileTransactionLogger aborted, %d pending events dropped", dropped)
+			}
+		} else if err := tl.Close(); err != nil {
 			log.Printf("Unable to close FileTransactionLogger: %v", err)
 		} else {
 			log.Printf("FileTransactionLogger closed")
@@ -233,9 +792,47 @@ func main() {
 		wg.Done()
 	}()
 
-	log.Println("Server running on port 8080")
-	// Bind to a port and pass in the mux router
-	if err := srv.ListenAndServe(); err != nil {
+	// Bind to a port and/or a Unix socket and pass in the mux router
+	if cfg.TLSClientCA != "" && cfg.TLSCert == "" { // Never plaintext without the client authentication asked for
+		log.Fatal("-tls-client-ca needs -tls-cert and -tls-key")
+	}
+	var listeners []net.Listener
+	if cfg.Addr != "" {
+		ln, err := newListener(context.Background(), cfg.Addr, listenerOptions{
+			KeepAlivePeriod: cfg.KeepAlivePeriod,
+			ReusePort:       cfg.ReusePort,
+			Backlog:         cfg.ListenBacklog,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cfg.TLSCert != "" {
+			tlsConfig, err := newTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+			if err != nil {
+				log.Fatal(err)
+			}
+			listeners = append(listeners, newTLSListener(ln, tlsConfig))
+		} else {
+			listeners = append(listeners, newHardenedListener(ln))
+		}
+	}
+	if cfg.UnixSocket != "" {
+		ln, err := newUnixListener(cfg.UnixSocket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, newHardenedListener(ln)) // Shutdown closes it, removing the socket file
+	}
+	if len(listeners) == 0 {
+		log.Fatal("nothing to listen on, set -addr and/or -unix-socket")
+	}
+
+	serveErrors := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		log.Printf("Server running on %s", ln.Addr())
+		go func(ln net.Listener) { serveErrors <- srv.Serve(ln) }(ln)
+	}
+	if err := <-serveErrors; err != nil {
 		if err == http.ErrServerClosed {
 			log.Printf("Server stopping...")
 		} else {
@@ -2,18 +2,67 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/davidaparicio/gokvs/internal"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
+var metricsOnce sync.Once
+var testRegistry *prometheus.Registry
+
+// setupMetrics initializes the global metrics once, as NewMetrics also
+// registers collectors on the default registry and cannot run twice
+func setupMetrics() {
+	metricsOnce.Do(func() {
+		testRegistry = prometheus.NewRegistry()
+		m = internal.NewMetrics(testRegistry)
+	})
+}
+
+// setupTransactionLog points the global logger to a fresh temporary file
+func setupTransactionLog(t *testing.T) {
+	t.Helper()
+	setupMetrics()
+
+	var err error
+	transact, err = internal.NewTransactionLogger(filepath.Join(t.TempDir(), "transactions.log"))
+	if err != nil {
+		t.Fatalf("Failed to create transaction logger: %v", err)
+	}
+	transact.Run()
+	tl := transact // Closed once, even if replaced meanwhile
+	t.Cleanup(func() { tl.Close() })
+}
+
+// setConfig overrides the global configuration for the duration of the test
+func setConfig(t *testing.T, update func(c *config)) {
+	t.Helper()
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	update(&cfg)
+}
+
 func setupRouter() *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/v1/{key}", keyValueGetHandler).Methods("GET")
+	r.HandleFunc("/v1/{key}", keyValueHeadHandler).Methods("HEAD")
 	r.HandleFunc("/v1/{key}", keyValuePutHandler).Methods("PUT")
 	r.HandleFunc("/v1/{key}", keyValueDeleteHandler).Methods("DELETE")
 	return r
@@ -21,8 +70,7 @@ func setupRouter() *mux.Router {
 
 func TestKeyValueHandlers(t *testing.T) {
 	// Initialize metrics with a new registry
-	reg := prometheus.NewRegistry()
-	m = internal.NewMetrics(reg)
+	setupMetrics()
 	var err error
 	transact, err = internal.NewTransactionLogger("/tmp/test-transactions.log")
 	if err != nil {
@@ -70,6 +118,13 @@ func TestKeyValueHandlers(t *testing.T) {
 			expectedCode:  http.StatusNotFound,
 			expectedValue: "",
 		},
+		{
+			name:          "Delete missing value",
+			method:        "DELETE",
+			key:           "test-key",
+			expectedCode:  http.StatusNotFound,
+			expectedValue: "",
+		},
 	}
 
 	for _, tt := range tests {
@@ -127,3 +182,741 @@ func TestHealthCheck(t *testing.T) {
 			rr.Body.String(), expected)
 	}
 }
+
+func TestSoftDeleteUndelete(t *testing.T) {
+	setupTransactionLog(t)
+	setConfig(t, func(c *config) { c.SoftDeleteWindow = time.Minute })
+
+	router := setupRouter()
+	router.HandleFunc("/v1/{key}/undelete", keyValueUndeleteHandler).Methods("POST")
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	do("PUT", "/v1/undo-key", "undo-value")
+	do("DELETE", "/v1/undo-key", "")
+	if rr := do("GET", "/v1/undo-key", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE: got status %d, want %d", rr.Code, http.StatusNotFound)
+	}
+
+	if rr := do("POST", "/v1/undo-key/undelete", ""); rr.Code != http.StatusOK {
+		t.Fatalf("undelete: got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if rr := do("GET", "/v1/undo-key", ""); rr.Body.String() != "undo-value" {
+		t.Errorf("GET after undelete: got %q, want %q", rr.Body.String(), "undo-value")
+	}
+
+	if rr := do("POST", "/v1/never-deleted/undelete", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("undelete of unknown key: got status %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestRequireUTF8(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+
+	put := func(path, body string) int {
+		req := httptest.NewRequest("PUT", path, bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Binary values are accepted by default
+	if code := put("/v1/binary-key", "\xff\xfe"); code != http.StatusCreated {
+		t.Errorf("binary value: got status %d, want %d", code, http.StatusCreated)
+	}
+
+	setConfig(t, func(c *config) { c.RequireUTF8 = true })
+
+	if code := put("/v1/utf8-key", "\xff\xfe"); code != http.StatusBadRequest {
+		t.Errorf("invalid UTF-8 value: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := put("/v1/%FF%FE", "value"); code != http.StatusBadRequest {
+		t.Errorf("invalid UTF-8 key: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := put("/v1/utf8-key", "héllo wörld ✓"); code != http.StatusCreated {
+		t.Errorf("valid UTF-8 value: got status %d, want %d", code, http.StatusCreated)
+	}
+}
+
+func TestGetHitMissCounters(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+
+	if err := internal.Put("hit-key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	hits, misses := testutil.ToFloat64(m.EventsGet), testutil.ToFloat64(m.EventsGetMiss)
+
+	for _, key := range []string{"hit-key", "hit-key", "hit-key", "miss-key"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/"+key, nil))
+	}
+
+	if got := testutil.ToFloat64(m.EventsGet) - hits; got != 3 {
+		t.Errorf("got %v hits, want 3", got)
+	}
+	if got := testutil.ToFloat64(m.EventsGetMiss) - misses; got != 1 {
+		t.Errorf("got %v misses, want 1", got)
+	}
+}
+
+func TestGetDefaultOnMiss(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	rr := get("/v1/default-missing?default=fallback")
+	if rr.Code != http.StatusOK || rr.Body.String() != "fallback" {
+		t.Errorf("missing key with default: got %d %q, want %d %q", rr.Code, rr.Body, http.StatusOK, "fallback")
+	}
+	if _, err := internal.Get("default-missing"); err == nil {
+		t.Error("the default value should not be stored")
+	}
+
+	// An empty default is still a default
+	if rr := get("/v1/default-missing?default="); rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("empty default: got %d %q, want %d \"\"", rr.Code, rr.Body, http.StatusOK)
+	}
+	if rr := get("/v1/default-missing"); rr.Code != http.StatusNotFound {
+		t.Errorf("missing key without default: got status %d, want %d", rr.Code, http.StatusNotFound)
+	}
+
+	if err := internal.Put("default-present", "stored"); err != nil {
+		t.Fatal(err)
+	}
+	if rr := get("/v1/default-present?default=fallback"); rr.Body.String() != "stored" {
+		t.Errorf("present key: got %q, want %q", rr.Body, "stored")
+	}
+}
+
+func TestLogRecoveriesCounter(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	recoveries := testutil.ToFloat64(m.LogRecoveries)
+
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	transact.WritePut("recovery-key", "value")
+	transact.Close()
+	if got := testutil.ToFloat64(m.LogRecoveries) - recoveries; got != 0 {
+		t.Errorf("fresh log: got %v recoveries, want 0", got)
+	}
+
+	// Reopening the populated log
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+	if got := testutil.ToFloat64(m.LogRecoveries) - recoveries; got != 1 {
+		t.Errorf("populated log: got %v recoveries, want 1", got)
+	}
+}
+
+func TestReadValue(t *testing.T) {
+	for _, size := range []int64{-1, 5, smallValueSize + 1} {
+		value, err := readValue(bytes.NewBufferString("value"), size)
+		if err != nil || value != "value" {
+			t.Errorf("readValue(size=%d) = %q, %v; want %q", size, value, err, "value")
+		}
+	}
+}
+
+// Compares readValue with the former io.ReadAll + string([]byte) copy,
+// run with -benchmem to see the allocations per op
+func BenchmarkReadValue(b *testing.B) {
+	value := bytes.Repeat([]byte("v"), 100)
+	r := bytes.NewReader(value)
+	var body io.Reader = struct{ io.Reader }{r} // Hides WriteTo, like a request body
+
+	b.Run("ReadAll", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(value)
+			buf, err := io.ReadAll(body)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_ = string(buf)
+		}
+	})
+
+	b.Run("readValue", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(value)
+			if _, err := readValue(body, int64(len(value))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Reads PUT bodies concurrently, as under the stress tests, with and
+// without a Content-Length; run with -benchmem to see the allocations per op
+func BenchmarkReadValueParallel(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		value []byte
+		size  int64
+	}{
+		{"Small", bytes.Repeat([]byte("v"), 100), 100},
+		{"Chunked", bytes.Repeat([]byte("v"), 16<<10), -1},
+		{"Large", bytes.Repeat([]byte("v"), 256<<10), 256 << 10},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bc.value)))
+			b.RunParallel(func(pb *testing.PB) {
+				r := bytes.NewReader(bc.value)
+				var body io.Reader = struct{ io.Reader }{r} // Hides WriteTo, like a request body
+				for pb.Next() {
+					r.Reset(bc.value)
+					if _, err := readValue(body, bc.size); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestGetWithTimestamp(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+
+	internal.SetRecordTimestamps(true)
+	defer internal.SetRecordTimestamps(false)
+
+	before := time.Now()
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v1/audit-key", bytes.NewBufferString("logged")))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/audit-key?with-timestamp", nil))
+	var tv timestampedValue
+	if err := json.Unmarshal(rr.Body.Bytes(), &tv); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rr.Body, err)
+	}
+	if tv.Value != "logged" || tv.Timestamp == nil || tv.Timestamp.Before(before) || tv.Timestamp.After(time.Now()) {
+		t.Errorf("got %+v, want the value with a timestamp after %v", tv, before)
+	}
+
+	// The plain GET is untouched
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/audit-key", nil))
+	if rr.Body.String() != "logged" {
+		t.Errorf("plain GET: got %q, want %q", rr.Body, "logged")
+	}
+}
+
+func TestBrowserNoise(t *testing.T) {
+	setupMetrics()
+	notAllowed := testutil.ToFloat64(m.HttpNotAllowed)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/favicon.ico", browserNoiseHandler)
+	router.HandleFunc("/robots.txt", browserNoiseHandler)
+	router.HandleFunc("/", notAllowedHandler)
+
+	for path, want := range map[string]int{"/favicon.ico": http.StatusNoContent, "/robots.txt": http.StatusNotFound} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != want {
+			t.Errorf("%s: got status %d, want %d", path, rr.Code, want)
+		}
+	}
+	if got := testutil.ToFloat64(m.HttpNotAllowed) - notAllowed; got != 0 {
+		t.Errorf("http_405 increased by %v, want 0", got)
+	}
+}
+
+func TestStoreErrorLockTimeout(t *testing.T) {
+	rr := httptest.NewRecorder()
+	storeError(rr, fmt.Errorf("put: %w", internal.ErrorLockTimeout))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d with Retry-After %q, want %d with a Retry-After", rr.Code, rr.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+}
+
+func TestPutTTLSurvivesReplay(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	router := setupRouter()
+
+	put := func(url string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PUT", url, bytes.NewBufferString("value")))
+		return rr.Code
+	}
+	if code := put("/v1/ttl-short?ttl=50ms"); code != http.StatusCreated {
+		t.Fatalf("PUT with ttl: got status %d, want %d", code, http.StatusCreated)
+	}
+	if code := put("/v1/ttl-long?ttl=1h"); code != http.StatusCreated {
+		t.Fatalf("PUT with ttl: got status %d, want %d", code, http.StatusCreated)
+	}
+	if code := put("/v1/ttl-bad?ttl=-1s"); code != http.StatusBadRequest {
+		t.Errorf("PUT with a negative ttl: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	transact.Close()
+
+	// Replayed once the short TTL is over
+	time.Sleep(60 * time.Millisecond)
+	for _, key := range []string{"ttl-short", "ttl-long"} {
+		_, _ = internal.Delete(key)
+	}
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+
+	if _, err := internal.Get("ttl-short"); err != internal.ErrorNoSuchKey {
+		t.Errorf("ttl-short after replay: got error %v, want %v", err, internal.ErrorNoSuchKey)
+	}
+	if value, err := internal.Get("ttl-long"); err != nil || value != "value" {
+		t.Errorf("ttl-long after replay = %q, %v; want %q", value, err, "value")
+	}
+}
+
+func TestReplayRate(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	logger, err := internal.NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Run()
+	const events = 1000
+	for i := 0; i < events; i++ {
+		logger.WritePut("replay-rate-"+strconv.Itoa(i%10), "value")
+	}
+	logger.Close()
+
+	start := time.Now()
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	defer transact.Close()
+
+	// The replay itself is shorter than the measured call
+	rate := testutil.ToFloat64(m.ReplayRate)
+	if want := events / elapsed.Seconds(); rate < want {
+		t.Errorf("got %.0f events per second, want at least %.0f", rate, want)
+	}
+}
+
+func TestHeadHandler(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	if err := internal.Put("head-key", "some value"); err != nil {
+		t.Fatal(err)
+	}
+
+	head := func(key string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("HEAD", "/v1/"+key, nil))
+		return rr
+	}
+
+	hits := testutil.ToFloat64(m.EventsGet)
+	rr := head("head-key")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if got := rr.Header().Get("Content-Length"); got != "10" {
+		t.Errorf("got Content-Length %s, want 10", got)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("got body %q, want none", rr.Body)
+	}
+	if got := testutil.ToFloat64(m.EventsGet) - hits; got != 1 {
+		t.Errorf("got %.0f GET events, want 1", got)
+	}
+
+	if rr := head("head-unknown"); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown key: got status %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestCompareAndSwapPut(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	router := setupRouter()
+	if err := internal.Put("cas-key", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(url, ifMatch, value string) int {
+		req := httptest.NewRequest("PUT", url, bytes.NewBufferString(value))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := put("/v1/cas-key", "v0", "v2"); code != http.StatusPreconditionFailed {
+		t.Errorf("stale If-Match: got status %d, want %d", code, http.StatusPreconditionFailed)
+	}
+	if code := put("/v1/cas-key", "v1", "v2"); code != http.StatusCreated {
+		t.Errorf("matching If-Match: got status %d, want %d", code, http.StatusCreated)
+	}
+	if code := put("/v1/cas-key?cas=v2", "", "v3"); code != http.StatusCreated {
+		t.Errorf("matching ?cas=: got status %d, want %d", code, http.StatusCreated)
+	}
+	if code := put("/v1/cas-missing?cas=", "", "v1"); code != http.StatusPreconditionFailed {
+		t.Errorf("missing key: got status %d, want %d", code, http.StatusPreconditionFailed)
+	}
+	transact.Close()
+
+	_, _ = internal.Delete("cas-key")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+	if value, err := internal.Get("cas-key"); err != nil || value != "v3" {
+		t.Errorf("cas-key after replay = %q, %v; want %q", value, err, "v3")
+	}
+}
+
+func TestAccessLogSample(t *testing.T) {
+	setupMetrics()
+	setConfig(t, func(c *config) { c.AccessLogSample = 10 })
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	handler := prometheusLoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	const requests = 100
+	for i := 0; i < requests; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/sampled", nil))
+	}
+
+	if got := strings.Count(logs.String(), "GET /v1/sampled"); got != requests/10 {
+		t.Errorf("got %d requests logged, want %d", got, requests/10)
+	}
+}
+
+func TestGetInterpolation(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	for key, value := range map[string]string{
+		"tpl:host":     "db.local",
+		"tpl:port":     "5432",
+		"tpl:addr":     "${tpl:host}:${tpl:port}",
+		"tpl:url":      "postgres://${tpl:addr}/app",
+		"tpl:cycle":    "loop ${tpl:loop}",
+		"tpl:loop":     "back ${tpl:cycle}",
+		"tpl:leak":     "${secret:token}",
+		"secret:token": "s3cr3t",
+	} {
+		if err := internal.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(key string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/"+key, nil))
+		return rr
+	}
+
+	// Disabled by default
+	if got := get("tpl:addr").Body.String(); got != "${tpl:host}:${tpl:port}" {
+		t.Errorf("got %q, want the raw value", got)
+	}
+
+	setConfig(t, func(c *config) { c.InterpolateDepth = 4 })
+	if got := get("tpl:url").Body.String(); got != "postgres://db.local:5432/app" {
+		t.Errorf("got %q, want the interpolated value", got)
+	}
+	if rr := get("tpl:cycle"); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("cycle: got status %d, want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+
+	// A tenant can't read the keys of the others through a reference
+	setConfig(t, func(c *config) { c.RequiredKeyPrefix = "tpl:" })
+	if rr := get("tpl:leak"); rr.Code != http.StatusForbidden || strings.Contains(rr.Body.String(), "s3cr3t") {
+		t.Errorf("reference outside of the prefix: got status %d %q, want %d", rr.Code, rr.Body.String(), http.StatusForbidden)
+	}
+	if got := get("tpl:url").Body.String(); got != "postgres://db.local:5432/app" {
+		t.Errorf("got %q, want the interpolated value within the prefix", got)
+	}
+}
+
+func TestReplayedByType(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	logger, err := internal.NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Run()
+	for _, key := range []string{"replayed-a", "replayed-b", "replayed-c"} {
+		logger.WritePut(key, "value")
+	}
+	logger.WriteDelete("replayed-a")
+	logger.WriteDelete("replayed-b")
+	logger.Close()
+
+	replayed := func(eventType string) float64 {
+		return testutil.ToFloat64(m.EventsReplayedByType.WithLabelValues(eventType))
+	}
+	puts, deletes := replayed("put"), replayed("delete")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+
+	if got := replayed("put") - puts; got != 3 {
+		t.Errorf("got %.0f puts replayed, want 3", got)
+	}
+	if got := replayed("delete") - deletes; got != 2 {
+		t.Errorf("got %.0f deletes replayed, want 2", got)
+	}
+}
+
+func TestClearHandler(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	router := setupRouter()
+	router.HandleFunc("/v1", keyValueClearHandler).Methods("DELETE")
+
+	put := func(key string) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PUT", "/v1/"+key, bytes.NewBufferString("value")))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("PUT %s: got status %d, want %d", key, rr.Code, http.StatusCreated)
+		}
+	}
+	flush := func(confirm string) int {
+		req := httptest.NewRequest("DELETE", "/v1", nil)
+		if confirm != "" {
+			req.Header.Set("X-Confirm", confirm)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	put("clear-before")
+	if code := flush(""); code != http.StatusPreconditionRequired {
+		t.Errorf("unconfirmed: got status %d, want %d", code, http.StatusPreconditionRequired)
+	}
+	if !internal.Exists("clear-before") {
+		t.Fatal("unconfirmed clear deleted the keys")
+	}
+	if code := flush("flush-all"); code != http.StatusNoContent {
+		t.Errorf("confirmed: got status %d, want %d", code, http.StatusNoContent)
+	}
+	if n := internal.Count(); n != 0 {
+		t.Errorf("got %d keys after the clear, want 0", n)
+	}
+	put("clear-after")
+	transact.Close()
+
+	// The replay clears the keys written before the clear only
+	if err := internal.Put("clear-before", "stale"); err != nil {
+		t.Fatal(err)
+	}
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+	if internal.Exists("clear-before") || !internal.Exists("clear-after") {
+		t.Error("replay didn't restore the state of the clear")
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	internal.SetMaxKeyLength(16)
+	defer internal.SetMaxKeyLength(0)
+
+	do := func(method, path string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewBufferString("value")))
+		return rr.Code
+	}
+
+	for _, path := range []string{"/v1/tab%09key", "/v1/newline%0Akey", "/v1/" + strings.Repeat("k", 17)} {
+		for _, method := range []string{"PUT", "DELETE"} {
+			if code := do(method, path); code != http.StatusBadRequest {
+				t.Errorf("%s %s: got status %d, want %d", method, path, code, http.StatusBadRequest)
+			}
+		}
+	}
+	if code := do("PUT", "/v1/"+strings.Repeat("k", 16)); code != http.StatusCreated {
+		t.Errorf("PUT of a 16 bytes key: got status %d, want %d", code, http.StatusCreated)
+	}
+
+	// A batch is refused as a whole
+	rr := httptest.NewRecorder()
+	keyValueBatchPutHandler(rr, httptest.NewRequest("POST", "/v1:batchPut", bytes.NewBufferString(`{"ok-key":"1","bad\tkey":"2"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("batchPut with a tab: got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	if internal.Exists("ok-key") {
+		t.Error("batchPut with an invalid key stored the valid ones")
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	if err := internal.Put("typed-key", "<html>"); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(method string) string {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, "/v1/typed-key", nil))
+		return rr.Header().Get("Content-Type")
+	}
+
+	setConfig(t, func(c *config) { c.DefaultContentType = "application/octet-stream" })
+	for _, method := range []string{"GET", "HEAD"} {
+		if got := get(method); got != "application/octet-stream" {
+			t.Errorf("%s: got Content-Type %q, want %q", method, got, "application/octet-stream")
+		}
+	}
+}
+
+func TestPutIfOtherKey(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	if err := internal.Put("flag:writes", "off"); err != nil {
+		t.Fatal(err)
+	}
+	if err := internal.Put("guarded-key", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(value string) int {
+		req := httptest.NewRequest("PUT", "/v1/guarded-key", bytes.NewBufferString(value))
+		req.Header.Set("X-If-Key", "flag:writes")
+		req.Header.Set("X-If-Value", "on")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := put("v2"); code != http.StatusPreconditionFailed {
+		t.Errorf("flag off: got status %d, want %d", code, http.StatusPreconditionFailed)
+	}
+	if value, _ := internal.Get("guarded-key"); value != "v1" {
+		t.Errorf("guarded-key after a failed precondition = %q, want %q", value, "v1")
+	}
+
+	if err := internal.Put("flag:writes", "on"); err != nil {
+		t.Fatal(err)
+	}
+	if code := put("v2"); code != http.StatusCreated {
+		t.Errorf("flag on: got status %d, want %d", code, http.StatusCreated)
+	}
+	if value, _ := internal.Get("guarded-key"); value != "v2" {
+		t.Errorf("guarded-key after a met precondition = %q, want %q", value, "v2")
+	}
+}
+
+func TestPutReturnPrevious(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+
+	put := func(value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/v1/previous-key", bytes.NewBufferString(value))
+		req.Header.Set("X-Return-Previous", "true")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := put("v1"); rr.Code != http.StatusCreated || rr.Body.Len() != 0 {
+		t.Errorf("new key: got %d %q, want %d \"\"", rr.Code, rr.Body, http.StatusCreated)
+	}
+	if rr := put("v2"); rr.Code != http.StatusOK || rr.Body.String() != "v1" {
+		t.Errorf("overwrite: got %d %q, want %d %q", rr.Code, rr.Body, http.StatusOK, "v1")
+	}
+	if value, _ := internal.Get("previous-key"); value != "v2" {
+		t.Errorf("previous-key = %q, want %q", value, "v2")
+	}
+}
+
+func TestPutIfNoneMatch(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	_, _ = internal.Delete("leader")
+
+	put := func(value string) int {
+		req := httptest.NewRequest("PUT", "/v1/leader", bytes.NewBufferString(value))
+		req.Header.Set("If-None-Match", "*")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := put("node-a"); code != http.StatusCreated {
+		t.Errorf("missing key: got status %d, want %d", code, http.StatusCreated)
+	}
+	puts := testutil.ToFloat64(m.EventsPut)
+	if code := put("node-b"); code != http.StatusConflict {
+		t.Errorf("existing key: got status %d, want %d", code, http.StatusConflict)
+	}
+	if value, _ := internal.Get("leader"); value != "node-a" {
+		t.Errorf("leader = %q, want %q", value, "node-a")
+	}
+	if got := testutil.ToFloat64(m.EventsPut) - puts; got != 0 {
+		t.Errorf("got %v PUT events for a conflict, want 0", got)
+	}
+}
+
+func TestCancelledWriteNotApplied(t *testing.T) {
+	setupTransactionLog(t)
+	router := setupRouter()
+	if err := internal.Put("cancel-deleted", "value"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = internal.Delete("cancel-put")
+
+	// Cancelled before the write, the store isn't changed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, req := range []*http.Request{
+		httptest.NewRequest("PUT", "/v1/cancel-put", strings.NewReader("value")),
+		httptest.NewRequest("DELETE", "/v1/cancel-deleted", nil),
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req.WithContext(ctx))
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("cancelled %s %s: got status %d, want %d", req.Method, req.URL.Path, rr.Code, http.StatusServiceUnavailable)
+		}
+	}
+	if _, err := internal.Get("cancel-put"); !errors.Is(err, internal.ErrorNoSuchKey) {
+		t.Errorf("Get(cancel-put) after a cancelled PUT error = %v, want %v", err, internal.ErrorNoSuchKey)
+	}
+	if _, err := internal.Get("cancel-deleted"); err != nil {
+		t.Errorf("Get(cancel-deleted) after a cancelled DELETE error = %v", err)
+	}
+}
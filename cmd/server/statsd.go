@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdMetrics are the metrics mirrored to StatsD, read from the registry
+var statsdMetrics = map[string]bool{
+	"gokvs_events_get":       true,
+	"gokvs_events_put":       true,
+	"gokvs_events_delete":    true,
+	"gokvs_queries_inflight": true,
+}
+
+// statsdPusher sends the counters as the increase since its last push, and
+// the gauges as their value
+type statsdPusher struct {
+	w    io.Writer
+	g    prometheus.Gatherer
+	last map[string]float64 // Counter values at the last push
+}
+
+func newStatsdPusher(w io.Writer, g prometheus.Gatherer) *statsdPusher {
+	return &statsdPusher{w: w, g: g, last: make(map[string]float64)}
+}
+
+// push sends the metrics in a single packet, "gokvs_events_put" becoming
+// "gokvs.events_put"
+func (p *statsdPusher) push() error {
+	families, err := p.g.Gather()
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	for _, mf := range families {
+		if !statsdMetrics[mf.GetName()] || len(mf.GetMetric()) == 0 {
+			continue
+		}
+		name := strings.Replace(mf.GetName(), "_", ".", 1)
+		metric := mf.GetMetric()[0]
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			value := metric.GetCounter().GetValue()
+			fmt.Fprintf(&b, "%s:%g|c\n", name, value-p.last[mf.GetName()])
+			p.last[mf.GetName()] = value
+		case dto.MetricType_GAUGE:
+			fmt.Fprintf(&b, "%s:%g|g\n", name, metric.GetGauge().GetValue())
+		}
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+
+	_, err = io.WriteString(p.w, b.String())
+	return err
+}
+
+// emitStatsD pushes the metrics to the StatsD server at addr every interval
+func emitStatsD(addr string, g prometheus.Gatherer, interval time.Duration) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return fmt.Errorf("invalid -statsd-addr: %w", err)
+	}
+
+	p := newStatsdPusher(conn, g)
+	go func() {
+		for range time.Tick(interval) {
+			if err := p.push(); err != nil {
+				log.Printf("ERROR pushing the metrics to StatsD: %v\n", err)
+			}
+		}
+	}()
+	return nil
+}
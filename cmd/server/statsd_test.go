@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestStatsDPush(t *testing.T) {
+	// Fake StatsD server
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reg := prometheus.NewRegistry()
+	puts := prometheus.NewCounter(prometheus.CounterOpts{Namespace: "gokvs", Name: "events_put"})
+	inflight := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "gokvs", Name: "queries_inflight"})
+	other := prometheus.NewCounter(prometheus.CounterOpts{Namespace: "gokvs", Name: "events_expire"})
+	reg.MustRegister(puts, inflight, other)
+
+	receive := func() string {
+		t.Helper()
+		buf := make([]byte, 1500)
+		_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	p := newStatsdPusher(conn, reg)
+	puts.Add(3)
+	inflight.Set(2)
+	other.Inc()
+	if err := p.push(); err != nil {
+		t.Fatal(err)
+	}
+	got := receive()
+	for _, want := range []string{"gokvs.events_put:3|c\n", "gokvs.queries_inflight:2|g\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got packet %q, missing %q", got, want)
+		}
+	}
+	if strings.Contains(got, "events_expire") {
+		t.Errorf("got packet %q, with a metric not mirrored", got)
+	}
+
+	// The counters are sent as the increase since the last push
+	puts.Add(2)
+	inflight.Set(0)
+	if err := p.push(); err != nil {
+		t.Fatal(err)
+	}
+	got = receive()
+	for _, want := range []string{"gokvs.events_put:2|c\n", "gokvs.queries_inflight:0|g\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got packet %q, missing %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/davidaparicio/gokvs/internal"
+	"github.com/gorilla/mux"
+)
+
+// keyValueSwapHandler atomically exchanges the values of the two keys of a
+// JSON array, both logged as PUTs
+func keyValueSwapHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	var keys []string
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		http.Error(w, fmt.Sprintf("invalid keys: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(keys) != 2 {
+		http.Error(w, fmt.Sprintf("expected 2 keys, got %d", len(keys)), http.StatusBadRequest)
+		return
+	}
+	if !checkKeyPrefix(w, keys...) {
+		return
+	}
+	for _, key := range keys {
+		if err := internal.ValidateKey(key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	valueA, valueB, err := internal.SwapKeys(keys[0], keys[1])
+	if errors.Is(err, internal.ErrorNoSuchKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	transact.WritePut(keys[0], valueA)
+	transact.WritePut(keys[1], valueB)
+	m.EventsPut.Add(2)
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("SWAP keys=%s,%s\n", keys[0], keys[1])
+}
+
+// keyValueCopyHandler atomically copies the value of the key to ?to=, logged
+// as a PUT
+func keyValueCopyHandler(w http.ResponseWriter, r *http.Request) {
+	keyValueCopyOrRename(w, r, false)
+}
+
+// keyValueRenameHandler atomically moves the value of the key to ?to=, logged
+// as a PUT of ?to= then a DELETE of the key
+func keyValueRenameHandler(w http.ResponseWriter, r *http.Request) {
+	keyValueCopyOrRename(w, r, true)
+}
+
+func keyValueCopyOrRename(w http.ResponseWriter, r *http.Request, rename bool) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+
+	src, dst := mux.Vars(r)["key"], r.URL.Query().Get("to")
+	if dst == "" {
+		http.Error(w, "missing to", http.StatusBadRequest)
+		return
+	}
+	if dst == src {
+		http.Error(w, "to must be another key", http.StatusBadRequest)
+		return
+	}
+	if !checkKeyPrefix(w, dst) {
+		return
+	}
+	for _, key := range []string{src, dst} {
+		if err := internal.ValidateKey(key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	op, copyKey := "COPY", internal.Copy
+	if rename {
+		op, copyKey = "RENAME", internal.Rename
+	}
+	value, err := copyKey(src, dst)
+	if errors.Is(err, internal.ErrorNoSuchKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	transact.WritePut(dst, value)
+	m.EventsPut.Inc()
+	if rename {
+		transact.WriteDelete(src)
+		m.EventsDelete.Inc()
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("%s key=%s to=%s\n", op, src, dst)
+}
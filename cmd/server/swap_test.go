@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/davidaparicio/gokvs/internal"
+	"github.com/gorilla/mux"
+)
+
+func TestSwapHandler(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	swap := func(body string) int {
+		rr := httptest.NewRecorder()
+		keyValueSwapHandler(rr, httptest.NewRequest("POST", "/v1/swap", strings.NewReader(body)))
+		return rr.Code
+	}
+	for key, value := range map[string]string{"swap:blue": "v1", "swap:green": "v2"} {
+		if err := internal.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		transact.WritePut(key, value)
+	}
+
+	if code := swap(`["swap:blue", "swap:green"]`); code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", code, http.StatusNoContent)
+	}
+	if code := swap(`["swap:blue", "swap:missing"]`); code != http.StatusNotFound {
+		t.Errorf("missing key: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if code := swap(`["swap:blue"]`); code != http.StatusBadRequest {
+		t.Errorf("single key: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	transact.Close()
+
+	check := func(when string) {
+		t.Helper()
+		for key, want := range map[string]string{"swap:blue": "v2", "swap:green": "v1"} {
+			if value, err := internal.Get(key); err != nil || value != want {
+				t.Errorf("%s: %s = %q, %v; want %q", when, key, value, err, want)
+			}
+		}
+	}
+	check("after the swap")
+
+	for _, key := range []string{"swap:blue", "swap:green"} {
+		_, _ = internal.Delete(key)
+	}
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+	check("after replay")
+}
+
+func TestCopyRenameHandlers(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/{key}/copy", keyValueCopyHandler).Methods("POST")
+	router.HandleFunc("/v1/{key}/rename", keyValueRenameHandler).Methods("POST")
+	post := func(path string) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", path, nil))
+		return rr.Code
+	}
+	if err := internal.Put("copy:src", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	transact.WritePut("copy:src", "v1")
+
+	if code := post("/v1/copy:src/copy?to=copy:dst"); code != http.StatusNoContent {
+		t.Fatalf("copy: got status %d, want %d", code, http.StatusNoContent)
+	}
+	if code := post("/v1/copy:dst/rename?to=copy:moved"); code != http.StatusNoContent {
+		t.Fatalf("rename: got status %d, want %d", code, http.StatusNoContent)
+	}
+	if code := post("/v1/copy:missing/copy?to=copy:dst"); code != http.StatusNotFound {
+		t.Errorf("missing key: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if code := post("/v1/copy:src/rename?to=copy:src"); code != http.StatusBadRequest {
+		t.Errorf("rename to itself: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	transact.Close()
+
+	check := func(when string) {
+		t.Helper()
+		for key, want := range map[string]string{"copy:src": "v1", "copy:moved": "v1"} {
+			if value, err := internal.Get(key); err != nil || value != want {
+				t.Errorf("%s: %s = %q, %v; want %q", when, key, value, err, want)
+			}
+		}
+		if _, err := internal.Get("copy:dst"); !errors.Is(err, internal.ErrorNoSuchKey) {
+			t.Errorf("%s: renamed copy:dst still exists", when)
+		}
+	}
+	check("after the rename")
+
+	for _, key := range []string{"copy:src", "copy:moved"} {
+		_, _ = internal.Delete(key)
+	}
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+	check("after replay")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/davidaparicio/gokvs/internal"
+	"github.com/gorilla/mux"
+)
+
+// maxDeltaSize bounds the body of an increment, an int64 and some spaces
+const maxDeltaSize = 64
+
+// keyValueIncrementHandler adds the integer delta of the body (1 if empty) to
+// the value of the key and returns the new value, logged as a PUT
+func keyValueIncrementHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+	key := mux.Vars(r)["key"]
+	if err := internal.ValidateKey(key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxDeltaSize))
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	delta := int64(1)
+	if s := strings.TrimSpace(string(body)); s != "" {
+		if delta, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid delta %q, expected an integer", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if requestCancelled(w, r) {
+		return
+	}
+	n, err := internal.Increment(key, delta)
+	if errors.Is(err, internal.ErrorNotInteger) || errors.Is(err, internal.ErrorOverflow) || errors.Is(err, internal.ErrorOutOfBounds) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	value := strconv.FormatInt(n, 10)
+	if _, err := io.WriteString(w, value); err != nil {
+		log.Printf("ERROR in w.Write for INCR key=%s\n", key)
+	}
+
+	transact.WritePut(key, value)
+
+	m.EventsPut.Inc()
+	log.Printf("INCR key=%s delta=%d value=%s\n", key, delta, value)
+}
+
+// keyValueBoundsHandler sets the bounds ?min= and ?max= an increment of the
+// key can't cross, for quota counters; without either, that side is
+// unbounded. The key must exist, a DELETE drops its bounds.
+func keyValueBoundsHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	query := r.URL.Query()
+	min, max, err := internal.ParseBounds(query.Get("min") + ":" + query.Get("max"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = internal.SetBounds(key, min, max)
+	if errors.Is(err, internal.ErrorNoSuchKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, internal.ErrorInvalidBounds) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	transact.WriteBounds(key, min, max)
+	log.Printf("BOUNDS key=%s bounds=%s\n", key, internal.FormatBounds(min, max))
+}
+
+// keyValueAppendHandler appends the body to the value of the key, the whole
+// new value logged as a PUT so a replay doesn't depend on the appends
+func keyValueAppendHandler(w http.ResponseWriter, r *http.Request) {
+	m.QueriesInflight.Inc()
+	defer m.QueriesInflight.Dec()
+	key := mux.Vars(r)["key"]
+
+	suffix, err := readValue(r.Body, r.ContentLength)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := validateWrite(key, suffix); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if requestCancelled(w, r) {
+		return
+	}
+	value, err := internal.Append(key, suffix)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	transact.WritePut(key, value)
+
+	m.EventsPut.Inc()
+	log.Printf("APPEND key=%s suffix=%s\n", key, suffix)
+}
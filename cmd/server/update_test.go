@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/davidaparicio/gokvs/internal"
+	"github.com/gorilla/mux"
+)
+
+func TestIncrementHandler(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = internal.Delete("incr-hits")
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/{key}/incr", keyValueIncrementHandler).Methods("POST")
+
+	incr := func(key, delta string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/"+key+"/incr", strings.NewReader(delta)))
+		return rr
+	}
+
+	for _, tt := range []struct{ delta, want string }{{"", "1"}, {"5", "6"}, {"-2", "4"}} {
+		rr := incr("incr-hits", tt.delta)
+		if rr.Code != http.StatusOK || rr.Body.String() != tt.want {
+			t.Errorf("increment by %q: got %d %q, want 200 %q", tt.delta, rr.Code, rr.Body, tt.want)
+		}
+	}
+	if rr := incr("incr-hits", "abc"); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid delta: got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	if err := internal.Put("incr-text", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if rr := incr("incr-text", "1"); rr.Code != http.StatusConflict {
+		t.Errorf("non-integer value: got status %d, want %d", rr.Code, http.StatusConflict)
+	}
+	transact.Close()
+
+	_, _ = internal.Delete("incr-hits")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+	if value, err := internal.Get("incr-hits"); err != nil || value != "4" {
+		t.Errorf("incr-hits after replay = %q, %v; want %q", value, err, "4")
+	}
+}
+
+func TestIncrementBoundsHandler(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = internal.Delete("incr-quota")
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/{key}/incr", keyValueIncrementHandler).Methods("POST")
+	router.HandleFunc("/v1/{key}/bounds", keyValueBoundsHandler).Methods("PUT")
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+
+	if rr := do("PUT", "/v1/incr-quota/bounds?max=3", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("bounds of a missing key: got status %d, want %d", rr.Code, http.StatusNotFound)
+	}
+	do("POST", "/v1/incr-quota/incr", "0")
+	for _, query := range []string{"min=a", "min=5&max=1"} {
+		if rr := do("PUT", "/v1/incr-quota/bounds?"+query, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("bounds ?%s: got status %d, want %d", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+	if rr := do("PUT", "/v1/incr-quota/bounds?min=0&max=3", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("bounds: got status %d, want %d", rr.Code, http.StatusNoContent)
+	}
+
+	// Up to the max, then refused
+	for i := 1; i <= 3; i++ {
+		if rr := do("POST", "/v1/incr-quota/incr", ""); rr.Code != http.StatusOK {
+			t.Fatalf("increment %d: got status %d, want %d", i, rr.Code, http.StatusOK)
+		}
+	}
+	if rr := do("POST", "/v1/incr-quota/incr", ""); rr.Code != http.StatusConflict {
+		t.Errorf("increment over the max: got status %d, want %d", rr.Code, http.StatusConflict)
+	}
+	transact.Close()
+
+	// The bounds are replayed from the log
+	_, _ = internal.Delete("incr-quota")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+	if _, err := internal.Increment("incr-quota", 1); !errors.Is(err, internal.ErrorOutOfBounds) {
+		t.Errorf("increment over the max after replay: got error %v, want %v", err, internal.ErrorOutOfBounds)
+	}
+}
+
+func TestAppendHandler(t *testing.T) {
+	setupMetrics()
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = internal.Delete("append-lines")
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/{key}/append", keyValueAppendHandler).Methods("POST")
+
+	for _, line := range []string{"first\n", "second\n"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/append-lines/append", strings.NewReader(line)))
+		if rr.Code != http.StatusOK {
+			t.Errorf("append %q: got status %d, want %d", line, rr.Code, http.StatusOK)
+		}
+	}
+	transact.Close()
+
+	_, _ = internal.Delete("append-lines")
+	if err := initializeTransactionLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer transact.Close()
+	if value, err := internal.Get("append-lines"); err != nil || value != "first\nsecond\n" {
+		t.Errorf("append-lines after replay = %q, %v; want %q", value, err, "first\nsecond\n")
+	}
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Batch operations
+const (
+	OpPut    = "put"
+	OpDelete = "delete"
+)
+
+// Batch operation conditions, on the key existence when the op is applied
+const (
+	IfExists = "exists"
+	IfAbsent = "absent"
+)
+
+var ErrorInvalidOp = errors.New("invalid batch operation")
+
+// Op is one operation of an atomic batch
+type Op struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	If    string `json:"if,omitempty"` // Skip the op unless the condition holds
+}
+
+// Batch applies the ops in order under the locks of all their shards, so
+// readers never see a half-applied batch. Each condition is evaluated
+// against the state left by the previous ops. It returns which ops were
+// applied, the ones whose condition failed are skipped without affecting
+// the others.
+func Batch(ops []Op) ([]bool, error) {
+	for i, op := range ops {
+		if err := op.validate(); err != nil {
+			return nil, fmt.Errorf("op %d: %w", i, err)
+		}
+	}
+
+	applied := make([]bool, len(ops))
+
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+	unlock, err := lockKeys(keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		s := shardOf(op.Key)
+		_, exists := s.m[op.Key]
+		exists = exists && !s.expiredLocked(op.Key, time.Now())
+		if (op.If == IfExists && !exists) || (op.If == IfAbsent && exists) {
+			continue
+		}
+
+		switch op.Op {
+		case OpPut:
+			s.putLocked(op.Key, op.Value)
+		case OpDelete:
+			s.deleteLocked(op.Key)
+		}
+		applied[i] = true
+	}
+	unlock()
+
+	evictOverflow()
+	return applied, nil
+}
+
+// Effects of an op, reported by PreviewBatch
+const (
+	ChangeNew       = "new"
+	ChangeOverwrite = "overwrite"
+	ChangeDelete    = "delete"
+)
+
+// PreviewBatch returns the effect each op would have if the batch was
+// applied now, "" for the skipped ops and the deletes of missing keys,
+// without changing the store
+func PreviewBatch(ops []Op) ([]string, error) {
+	for i, op := range ops {
+		if err := op.validate(); err != nil {
+			return nil, fmt.Errorf("op %d: %w", i, err)
+		}
+	}
+
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+	defer rlockKeys(keys...)()
+
+	changes := make([]string, len(ops))
+	written := make(map[string]bool) // Existence of the keys after the previous ops
+	now := time.Now()
+	for i, op := range ops {
+		exists, ok := written[op.Key]
+		if !ok {
+			s := shardOf(op.Key)
+			_, exists = s.m[op.Key]
+			exists = exists && !s.expiredLocked(op.Key, now)
+		}
+		if (op.If == IfExists && !exists) || (op.If == IfAbsent && exists) {
+			continue
+		}
+
+		switch {
+		case op.Op == OpPut && exists:
+			changes[i] = ChangeOverwrite
+		case op.Op == OpPut:
+			changes[i] = ChangeNew
+		case exists:
+			changes[i] = ChangeDelete
+		}
+		written[op.Key] = op.Op == OpPut
+	}
+	return changes, nil
+}
+
+// PutMulti stores all the pairs under the locks of all their shards, so
+// readers never see some of them stored and not the others
+func PutMulti(pairs map[string]string) error {
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	unlock, err := lockKeys(keys...)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range pairs {
+		shardOf(key).putLocked(key, value)
+	}
+	unlock()
+
+	evictOverflow()
+	return nil
+}
+
+func (op Op) validate() error {
+	if op.Op != OpPut && op.Op != OpDelete {
+		return fmt.Errorf("%w: unknown op %q", ErrorInvalidOp, op.Op)
+	}
+	if op.If != "" && op.If != IfExists && op.If != IfAbsent {
+		return fmt.Errorf("%w: unknown condition %q", ErrorInvalidOp, op.If)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBatchConditions(t *testing.T) {
+	resetStore(t, map[string]string{"existing": "old"})
+
+	applied, err := Batch([]Op{
+		{Op: OpPut, Key: "existing", Value: "new", If: IfAbsent}, // Skipped, the key exists
+		{Op: OpPut, Key: "fresh", Value: "value", If: IfAbsent},
+		{Op: OpDelete, Key: "missing", If: IfExists}, // Skipped, nothing to delete
+		{Op: OpPut, Key: "fresh", Value: "updated", If: IfExists},
+		{Op: OpPut, Key: "plain", Value: "value"},
+	})
+	if err != nil {
+		t.Fatalf("Batch() error = %v", err)
+	}
+
+	want := []bool{false, true, false, true, true}
+	for i := range want {
+		if applied[i] != want[i] {
+			t.Errorf("op %d: applied = %v, want %v", i, applied[i], want[i])
+		}
+	}
+
+	for key, value := range map[string]string{"existing": "old", "fresh": "updated", "plain": "value"} {
+		if got, _ := Get(key); got != value {
+			t.Errorf("Get(%q) got = %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestBatchInvalidOp(t *testing.T) {
+	resetStore(t, nil)
+
+	for _, ops := range [][]Op{
+		{{Op: OpPut, Key: "a", Value: "1"}, {Op: "incr", Key: "b"}},
+		{{Op: OpPut, Key: "a", Value: "1"}, {Op: OpPut, Key: "b", If: "maybe"}},
+	} {
+		if _, err := Batch(ops); !errors.Is(err, ErrorInvalidOp) {
+			t.Errorf("Batch() error = %v, want %v", err, ErrorInvalidOp)
+		}
+		// Nothing applied when the batch is rejected
+		if _, err := Get("a"); !errors.Is(err, ErrorNoSuchKey) {
+			t.Error("rejected batch was partially applied")
+		}
+	}
+}
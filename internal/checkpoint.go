@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// CheckpointVersion is the format version of the checkpoint files
+const CheckpointVersion = 1
+
+// ErrorInvalidCheckpoint is returned for a checkpoint file that can't be loaded
+var ErrorInvalidCheckpoint = errors.New("invalid checkpoint")
+
+// Checkpoint is the state of the store once the events of the transaction
+// log up to Sequence are applied. Its file is a JSON object:
+//
+//	{"version":1,"sequence":42,"pairs":{"key":"value"},"expiries":{"key":1700000000000000000},"bounds":{"key":"0:100"}}
+//
+// with the expiries in Unix nanoseconds, like the EventExpire values, and the
+// Increment bounds like the EventBounds ones.
+type Checkpoint struct {
+	Version  int               `json:"version"`
+	Sequence uint64            `json:"sequence"`
+	Pairs    map[string]string `json:"pairs"`
+	Expiries map[string]int64  `json:"expiries,omitempty"`
+	Bounds   map[string]string `json:"bounds,omitempty"`
+}
+
+// TakeCheckpoint copies the store under the read locks of all the shards, as
+// the checkpoint of the events up to seq. The store can be ahead of seq, the
+// events after it are replayed again over the checkpoint. The expired keys
+// are left out.
+func TakeCheckpoint(seq uint64) Checkpoint {
+	defer rlockShards(allShards())()
+
+	c := Checkpoint{
+		Version:  CheckpointVersion,
+		Sequence: seq,
+		Pairs:    make(map[string]string),
+		Expiries: make(map[string]int64),
+		Bounds:   make(map[string]string),
+	}
+	now := time.Now()
+	for _, s := range store.shards {
+		for key, value := range s.m {
+			if s.expiredLocked(key, now) {
+				continue
+			}
+			c.Pairs[key] = value
+			if at, ok := s.expiry[key]; ok {
+				c.Expiries[key] = at.UnixNano()
+			}
+			if meta := s.meta[key]; meta.Min != nil || meta.Max != nil {
+				c.Bounds[key] = FormatBounds(meta.Min, meta.Max)
+			}
+		}
+	}
+	return c
+}
+
+// LoadCheckpoint stores the pairs of the checkpoint, with their expiry and
+// bounds, under the locks of all the shards. The keys expired since are
+// skipped.
+func LoadCheckpoint(c Checkpoint) error {
+	bounds := make(map[string][2]*int64, len(c.Bounds))
+	for key, b := range c.Bounds {
+		min, max, err := ParseBounds(b)
+		if err != nil {
+			return fmt.Errorf("%w: key %s: %w", ErrorInvalidCheckpoint, key, err)
+		}
+		bounds[key] = [2]*int64{min, max}
+	}
+
+	unlock, err := lockShards(allShards())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for key, value := range c.Pairs {
+		nanos, expires := c.Expiries[key]
+		if expires && !now.Before(time.Unix(0, nanos)) {
+			continue
+		}
+
+		s := shardOf(key)
+		s.putLocked(key, value)
+		if expires {
+			s.expiry[key] = time.Unix(0, nanos)
+		}
+		if b, ok := bounds[key]; ok {
+			meta := s.meta[key]
+			meta.Min, meta.Max = b[0], b[1]
+			s.meta[key] = meta
+		}
+	}
+	unlock()
+
+	evictOverflow()
+	return nil
+}
+
+// WriteCheckpoint writes the checkpoint to path. The file is written next to
+// it then renamed over it, a crash leaves the previous checkpoint.
+func WriteCheckpoint(path string, c Checkpoint) error {
+	tmp := path + ".tmp"
+	if err := writeCheckpointFile(tmp, c); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("cannot replace checkpoint: %w", err)
+	}
+	return nil
+}
+
+func writeCheckpointFile(name string, c Checkpoint) error {
+	// #nosec [G304] [-- Acceptable risk, for the CWE-22]
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create checkpoint: %w", err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		return fmt.Errorf("cannot write checkpoint: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("cannot write checkpoint: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync checkpoint: %w", err)
+	}
+	return file.Close()
+}
+
+// ReadCheckpoint reads the checkpoint at path. A missing file returns an
+// error wrapping os.ErrNotExist.
+func ReadCheckpoint(path string) (Checkpoint, error) {
+	var c Checkpoint
+
+	// #nosec [G304] [-- Acceptable risk, for the CWE-22]
+	file, err := os.Open(path)
+	if err != nil {
+		return c, fmt.Errorf("cannot open checkpoint: %w", err)
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(bufio.NewReader(file)).Decode(&c); err != nil {
+		return c, fmt.Errorf("%w: %w", ErrorInvalidCheckpoint, err)
+	}
+	if c.Version != CheckpointVersion {
+		return c, fmt.Errorf("%w: version %d, this reader supports %d", ErrorInvalidCheckpoint, c.Version, CheckpointVersion)
+	}
+	return c, nil
+}
+
+// ReplayAfter makes Replay skip the events up to seq, covered by a loaded
+// checkpoint. The new events are numbered after seq, even if the log ends
+// before it.
+func (l *TransactionLog) ReplayAfter(seq uint64) {
+	l.MarkSnapshot(seq)
+	l.replayAfter = seq
+}
@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	resetStore(t, map[string]string{"kept": "v1", "a key\twith tab": "a value\n"})
+	if err := PutWithTTL("expiring", "v1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	max := int64(100)
+	if err := SetBounds("kept", nil, &max); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "transactions.log.checkpoint")
+	if err := WriteCheckpoint(path, TakeCheckpoint(42)); err != nil {
+		t.Fatal(err)
+	}
+	resetStore(t, nil)
+
+	c, err := ReadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Sequence != 42 {
+		t.Errorf("Sequence = %d, want 42", c.Sequence)
+	}
+	if err := LoadCheckpoint(c); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"kept": "v1", "a key\twith tab": "a value\n", "expiring": "v1"} {
+		if got, err := Get(key); err != nil || got != want {
+			t.Errorf("Get(%q) = %q, %v; want %q", key, got, err, want)
+		}
+	}
+	if _, ok := shardOf("expiring").expiry["expiring"]; !ok {
+		t.Error("expiring: expiry not restored")
+	}
+	if meta := shardOf("kept").meta["kept"]; meta.Min != nil || meta.Max == nil || *meta.Max != max {
+		t.Errorf("kept: bounds %s not restored, want :%d", FormatBounds(meta.Min, meta.Max), max)
+	}
+}
+
+func TestReadCheckpointErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := ReadCheckpoint(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing checkpoint: got error %v, want %v", err, os.ErrNotExist)
+	}
+
+	newer := filepath.Join(dir, "newer")
+	if err := os.WriteFile(newer, []byte(`{"version":2,"sequence":1,"pairs":{}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadCheckpoint(newer); !errors.Is(err, ErrorInvalidCheckpoint) {
+		t.Errorf("newer checkpoint: got error %v, want %v", err, ErrorInvalidCheckpoint)
+	}
+}
+
+func TestReplayAfter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	for i := 0; i < 5; i++ {
+		tl.WritePut("key", "value")
+	}
+	tl.Close()
+
+	for _, tc := range []struct {
+		after     uint64
+		wantCount int
+		wantLast  uint64
+	}{
+		{after: 3, wantCount: 2, wantLast: 5},
+		{after: 10, wantCount: 0, wantLast: 10}, // Numbered after the checkpoint
+	} {
+		tl, err := NewReadOnlyTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tl.ReplayAfter(tc.after)
+		count, err := tl.Replay(func(Event) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tc.wantCount || tl.LastSequence() != tc.wantLast {
+			t.Errorf("ReplayAfter(%d): got %d events, last sequence %d; want %d, %d", tc.after, count, tl.LastSequence(), tc.wantCount, tc.wantLast)
+		}
+		tl.Close()
+	}
+}
+
+func TestCompactAfterCheckpoint(t *testing.T) {
+	resetStore(t, map[string]string{"deleted": "v1", "expired": "v1", "kept": "v1"})
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	tl.WritePut("deleted", "v1")
+	tl.WritePut("expired", "v1")
+	tl.WritePut("kept", "v1")
+	tl.Wait()
+	c := TakeCheckpoint(tl.LastSequence())
+	tl.MarkSnapshot(c.Sequence)
+
+	// Deleted or expired after the checkpoint, then compacted
+	tl.WriteDelete("deleted")
+	tl.WritePut("expired", "v2")
+	tl.WriteExpire("expired", time.Now().Add(-time.Second))
+	tl.WritePut("added", "v1")
+	if _, err := tl.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarted from the checkpoint, the DELETEs are replayed
+	resetStore(t, nil)
+	if err := LoadCheckpoint(c); err != nil {
+		t.Fatal(err)
+	}
+	rl, err := NewReadOnlyTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	rl.ReplayAfter(c.Sequence)
+	if _, err := rl.Replay(func(e Event) error {
+		switch e.EventType {
+		case EventDelete:
+			_, err := Delete(e.Key)
+			return err
+		case EventPut:
+			return Put(e.Key, e.Value)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"deleted", "expired"} {
+		if _, err := Get(key); !errors.Is(err, ErrorNoSuchKey) {
+			t.Errorf("Get(%q) after the replay error = %v, want %v", key, err, ErrorNoSuchKey)
+		}
+	}
+	for _, key := range []string{"kept", "added"} {
+		if _, err := Get(key); err != nil {
+			t.Errorf("Get(%q) after the replay error = %v", key, err)
+		}
+	}
+}
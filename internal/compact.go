@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ErrorReadOnlyLog is returned when rewriting a log opened for the replay only
+var ErrorReadOnlyLog = errors.New("read-only transaction log")
+
+// Compact rewrites the log keeping only the events that still matter: the
+// last PUT of each stored key, its expiry and its bounds. The deleted,
+// cleared and expired keys are left out, but the DELETEs and CLEARs after
+// the snapshot (see MarkSnapshot) are kept, and the expiries after it become
+// DELETEs: the checkpoint can hold their keys. The events keep their
+// sequence numbers, the new writes go on from the last one. The pending
+// events are written first, the new ones wait meanwhile. The rotated
+// segments are merged in the log.
+//
+// The compacted log is written next to the log, then renamed over it: a
+// crash leaves either of them, complete. It returns how many events were
+// dropped.
+func (l *TransactionLog) Compact() (int, error) {
+	if l.readOnly {
+		return 0, ErrorReadOnlyLog
+	}
+
+	l.barrier()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	name := l.file.Name()
+	kept, total, err := l.survivingEvents(name)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := name + ".compact"
+	if err := writeCompacted(tmp, kept); err != nil {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		_ = os.Remove(tmp)
+		return 0, fmt.Errorf("cannot replace transaction log: %w", err)
+	}
+
+	// #nosec [G304] [-- Acceptable risk, for the CWE-22]
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("cannot open compacted transaction log: %w", err)
+	}
+	_ = l.file.Close() // Renamed over, nothing left to write in it
+	l.file, l.source = file, file
+	l.schemaVersion = SchemaVersion
+	if fi, err := file.Stat(); err == nil {
+		l.size = fi.Size()
+	}
+
+	// The compacted log holds the events of the rotated segments too. A crash
+	// before they are removed leaves their events twice, see TolerateDuplicates
+	if err := removeSegments(name); err != nil {
+		return 0, err
+	}
+
+	return total - len(kept), nil
+}
+
+// survivingEvents reads the log at name through its own handle, and returns
+// the events Compact keeps, in order, and how many events it read
+func (l *TransactionLog) survivingEvents(name string) ([]Event, int, error) {
+	rl, err := NewReadOnlyTransactionLogger(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rl.Close()
+	rl.TolerateDuplicates(l.tolerateDups)
+	rl.maxLineBytes = l.maxLineBytes
+
+	snapshot := atomic.LoadUint64(&l.snapshotSeq)
+	var tombstones []Event // The DELETEs and CLEARs replayed over the snapshot
+	events, errs := rl.ReadEvents()
+	puts := make(map[string]Event)
+	expiries := make(map[string]Event)
+	bounds := make(map[string][2]Event) // The PUT they were set on, and the bounds
+	total := 0
+	for e := range events {
+		total++
+		switch e.EventType {
+		case EventDelete:
+			delete(puts, e.Key)
+			delete(expiries, e.Key)
+			delete(bounds, e.Key)
+			if snapshot > 0 && e.Sequence > snapshot {
+				tombstones = append(tombstones, e)
+			}
+		case EventPut: // Stored forever, unless an EventExpire follows
+			puts[e.Key] = e
+			delete(expiries, e.Key)
+		case EventClear:
+			puts = make(map[string]Event)
+			expiries = make(map[string]Event)
+			bounds = make(map[string][2]Event)
+			if snapshot > 0 && e.Sequence > snapshot {
+				tombstones = append(tombstones[:0], e) // Superseded by the CLEAR
+			}
+		case EventExpire:
+			if _, ok := puts[e.Key]; ok {
+				expiries[e.Key] = e
+			}
+		case EventBounds:
+			if put, ok := puts[e.Key]; ok {
+				bounds[e.Key] = [2]Event{put, e}
+			}
+		}
+	}
+	if err := <-errs; err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	kept := make([]Event, 0, len(puts)+len(expiries)+len(bounds)+len(tombstones))
+	kept = append(kept, tombstones...)
+	for key, e := range expiries {
+		nanos, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: invalid expiry of key %s: %w", ErrorCorruptLog, key, err)
+		}
+		if !now.Before(time.Unix(0, nanos)) {
+			// The checkpoint can hold an older value, deleted on replay
+			if put := puts[key]; snapshot > 0 && (put.Sequence > snapshot || e.Sequence > snapshot) {
+				kept = append(kept, Event{Sequence: e.Sequence, EventType: EventDelete, Key: key})
+			}
+			delete(puts, key)
+			continue
+		}
+		kept = append(kept, e)
+	}
+	for key, b := range bounds {
+		put, ok := puts[key]
+		if !ok {
+			continue
+		}
+		// The bounds need their key when replayed, set by an older PUT
+		if b[0].Sequence != put.Sequence {
+			kept = append(kept, b[0])
+		}
+		kept = append(kept, b[1])
+	}
+	for _, e := range puts {
+		kept = append(kept, e)
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Sequence < kept[j].Sequence })
+
+	return kept, total, nil
+}
+
+// writeCompacted writes the events to a new log at name, synced once written
+func writeCompacted(name string, events []Event) error {
+	// #nosec [G304] [-- Acceptable risk, for the CWE-22]
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create compacted transaction log: %w", err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	if _, err := io.WriteString(w, schemaHeader(SchemaVersion)); err != nil {
+		return fmt.Errorf("cannot write compacted transaction log: %w", err)
+	}
+	for _, e := range events {
+		if _, err := fmt.Fprintf(w, "%d\t%d\t%s\t%s\n",
+			e.Sequence, e.EventType, url.QueryEscape(e.Key), url.QueryEscape(e.Value)); err != nil {
+			return fmt.Errorf("cannot write compacted transaction log: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("cannot write compacted transaction log: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync compacted transaction log: %w", err)
+	}
+	return file.Close()
+}
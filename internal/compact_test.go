@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func readState(t *testing.T, filename string) map[string]string {
+	t.Helper()
+	tl, err := NewReadOnlyTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	state, err := BuildState(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestCompact(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "compact.log")
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	tl.WritePut("cleared", "gone")
+	tl.WriteClear()
+	tl.WritePut("kept", "v1")
+	tl.WritePut("overwritten", "v1")
+	tl.WritePut("deleted", "v1")
+	tl.WritePut("overwritten", "v2")
+	tl.WriteDelete("deleted")
+	tl.WritePut("expired", "v1")
+	tl.WriteExpire("expired", time.Now().Add(-time.Second))
+	tl.WritePut("expiring", "v1")
+	tl.WriteExpire("expiring", time.Now().Add(time.Hour))
+	tl.WritePut("a key\twith tab", "a value\n")
+	tl.Wait()
+
+	before := readState(t, filename)
+	dropped, err := tl.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 7; dropped != want {
+		t.Errorf("Compact() dropped %d events, want %d", dropped, want)
+	}
+	if after := readState(t, filename); !reflect.DeepEqual(after, before) {
+		t.Errorf("state after Compact() = %v, want %v", after, before)
+	}
+
+	// The writes go on in the compacted log, after the last sequence number
+	tl.WritePut("added", "v1")
+	tl.WriteDelete("kept")
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tl2, err := NewReadOnlyTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+	state, err := BuildState(tl2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"overwritten": "v2", "expiring": "v1", "a key\twith tab": "a value\n", "added": "v1"}
+	if !reflect.DeepEqual(state, want) {
+		t.Errorf("state = %v, want %v", state, want)
+	}
+	if got, want := tl2.LastSequence(), uint64(14); got != want {
+		t.Errorf("LastSequence() = %d, want %d", got, want)
+	}
+}
+
+func TestCompactReadOnly(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "compact.log")
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Close()
+
+	tl2, err := NewReadOnlyTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+	if _, err := tl2.Compact(); !errors.Is(err, ErrorReadOnlyLog) {
+		t.Errorf("Compact() error = %v, want %v", err, ErrorReadOnlyLog)
+	}
+}
+
+func TestCompactKeepsBounds(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "compact.log")
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	defer tl.Close()
+	max := int64(10)
+	tl.WritePut("quota", "0")
+	tl.WriteBounds("quota", nil, &max)
+	tl.WritePut("quota", "1") // Keeps the bounds
+	tl.WritePut("quota", "2")
+	tl.WritePut("dropped", "0")
+	tl.WriteBounds("dropped", nil, &max)
+	tl.WriteDelete("dropped")
+
+	if _, err := tl.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bounds are replayed after a PUT of their key
+	rl, err := NewReadOnlyTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	var replayed []string
+	if _, err := rl.Replay(func(e Event) error {
+		replayed = append(replayed, e.EventType.String()+" "+e.Key+" "+e.Value)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"put quota 0", "bounds quota :10", "put quota 2"}
+	if !reflect.DeepEqual(replayed, want) {
+		t.Errorf("compacted log = %q, want %q", replayed, want)
+	}
+}
@@ -1,42 +1,734 @@
 package internal
 
 import (
+	"bufio"
+	"container/list"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// var store = make(map[string]string)
+// store holds the keys in shards, each with its own lock: the single key
+// operations only lock the shard of their key, the ones spanning several
+// keys lock all their shards in order, and the whole store operations lock
+// all the shards so their view stays consistent.
 var store = struct {
-	sync.RWMutex
-	m map[string]string
-}{m: make(map[string]string)}
+	shards []*shard
+	lru    atomic.Pointer[lru] // Access order of the keys, nil unless bounded by SetMaxEntries
+}{
+	shards: newShards(shardCount),
+}
+
+// Meta describes a stored value. The replayed values are timed at the
+// replay, as the transaction log has no timestamps.
+type Meta struct {
+	Version  uint64    `json:"version"` // Puts of the key, from 1
+	Size     int       `json:"size"`    // Value length, in bytes
+	Created  time.Time `json:"created"`
+	Modified time.Time `json:"modified"`
+	Min      *int64    `json:"min,omitempty"` // Lowest value Increment reaches, see SetBounds
+	Max      *int64    `json:"max,omitempty"` // Highest value Increment reaches
+}
+
+// Entry is a value with its metadata
+type Entry struct {
+	Value string `json:"value"`
+	Meta
+}
+
+// lru orders the keys from the most to the least recently used, to evict the
+// last one once the store is full
+type lru struct {
+	sync.Mutex // The keys of all the shards share the order
+	order      *list.List
+	elements   map[string]*list.Element
+	max        int
+	onEvict    func(key string)
+}
+
+// touch moves the key first, the caller holds the lock of its shard
+func (l *lru) touch(key string) {
+	l.Lock()
+	if e, ok := l.elements[key]; ok {
+		l.order.MoveToFront(e)
+	} else {
+		l.elements[key] = l.order.PushFront(key)
+	}
+	l.Unlock()
+}
+
+// remove forgets the key, the caller holds the write lock of its shard
+func (l *lru) remove(key string) {
+	l.Lock()
+	if e, ok := l.elements[key]; ok {
+		l.order.Remove(e)
+		delete(l.elements, key)
+	}
+	l.Unlock()
+}
+
+// last returns the least recently used key, false if over the maximum
+func (l *lru) last() (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.order.Len() <= l.max {
+		return "", false
+	}
+	return l.order.Back().Value.(string), true
+}
+
+// evictOverflow deletes the least recently used keys over the maximum. The
+// writes call it once they released their shards, the evicted keys may be
+// in any shard. onEvict is called once all the shards are released.
+func evictOverflow() {
+	l := store.lru.Load()
+	if l == nil {
+		return
+	}
+
+	var evicted []string
+	for {
+		key, over := l.last()
+		if !over {
+			break
+		}
+
+		s := shardOf(key)
+		s.Lock()
+		if last, _ := l.last(); last == key { // Not used meanwhile
+			if _, ok := s.m[key]; ok {
+				s.deleteLocked(key)
+				evicted = append(evicted, key)
+			} else {
+				l.remove(key)
+			}
+		}
+		s.Unlock()
+	}
+
+	if l.onEvict != nil {
+		for _, key := range evicted {
+			l.onEvict(key)
+		}
+	}
+}
+
+// SetMaxEntries bounds the store to maxEntries keys, a Put over it evicting
+// the least recently used key, read or written. The keys already stored are
+// ordered by their last change, and evicted at once over the bound. Zero
+// disables the bound. onEvict is called for each evicted key once its shard
+// is released, it can block.
+func SetMaxEntries(maxEntries int, onEvict func(key string)) {
+	unlock := lockAllShards()
+	if maxEntries <= 0 {
+		store.lru.Store(nil)
+		unlock()
+		return
+	}
+
+	var keys []string
+	modified := make(map[string]time.Time)
+	for _, s := range store.shards {
+		for key := range s.m {
+			keys = append(keys, key)
+			modified[key] = s.meta[key].Modified
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return modified[keys[i]].After(modified[keys[j]])
+	})
+
+	l := &lru{order: list.New(), elements: make(map[string]*list.Element, len(keys)), max: maxEntries, onEvict: onEvict}
+	for _, key := range keys {
+		l.elements[key] = l.order.PushBack(key)
+	}
+	store.lru.Store(l)
+	unlock()
+
+	evictOverflow()
+}
+
+type tombstone struct {
+	value     string
+	deletedAt time.Time
+}
 
 var ErrorNoSuchKey = errors.New("no such key")
 
+// ErrorLockTimeout is returned by the writes that waited for the store lock
+// longer than the lock timeout
+var ErrorLockTimeout = errors.New("store lock timeout")
+
+// lockTimeout bounds the wait for the store lock in the writes, 0 waits forever
+var lockTimeout atomic.Int64
+
+// lockRetryInterval is the pause between two attempts to take the store lock
+const lockRetryInterval = 50 * time.Microsecond
+
+// SetLockTimeout bounds how long a write waits for the store lock, so a long
+// write delays the others at most timeout. Zero waits forever.
+func SetLockTimeout(timeout time.Duration) {
+	lockTimeout.Store(int64(timeout))
+}
+
 func Get(key string) (string, error) {
-	store.RLock()
-	value, ok := store.m[key]
-	store.RUnlock()
+	s := shardOf(key)
+	s.rlockTimed()
+	storedKey, value, ok := s.getLocked(key)
+	at, expired := s.expiry[storedKey] // Still there but not found: expired
+	ttl, sliding := s.sliding[storedKey]
+	s.RUnlock()
 
 	if !ok {
+		if expired {
+			s.removeExpired(storedKey)
+		}
 		return "", ErrorNoSuchKey
 	}
+	if sliding {
+		s.slideExpiry(storedKey, at, ttl)
+	}
 
 	return value, nil
 }
 
+// Exists reports whether the key is stored, without copying its value
+func Exists(key string) bool {
+	_, ok := Size(key)
+	return ok
+}
+
+// Size returns the length of the value of the key, false if it isn't stored
+func Size(key string) (int, bool) {
+	s := shardOf(key)
+	s.RLock()
+	defer s.RUnlock()
+
+	_, value, ok := s.getLocked(key)
+	return len(value), ok
+}
+
+// GetWithTimestamp returns the value and the time it was Put, a zero time if
+// it wasn't recorded (see SetRecordTimestamps)
+func GetWithTimestamp(key string) (string, time.Time, error) {
+	s := shardOf(key)
+	s.RLock()
+	defer s.RUnlock()
+
+	storedKey, value, ok := s.getLocked(key)
+	if !ok {
+		return "", time.Time{}, ErrorNoSuchKey
+	}
+
+	return value, s.stamps[storedKey], nil
+}
+
+// GetMany returns the entries of the keys found, read under the locks of all
+// their shards so they are consistent with each other
+func GetMany(keys []string) map[string]Entry {
+	defer rlockKeys(keys...)()
+
+	entries := make(map[string]Entry, len(keys))
+	for _, key := range keys {
+		s := shardOf(key)
+		if storedKey, value, ok := s.getLocked(key); ok {
+			entries[key] = Entry{Value: value, Meta: s.meta[storedKey]}
+		}
+	}
+	return entries
+}
+
+// GetMulti returns the values of the keys found, read under the locks of all
+// their shards so they are consistent with each other
+func GetMulti(keys []string) map[string]string {
+	defer rlockKeys(keys...)()
+
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if _, value, ok := shardOf(key).getLocked(key); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// getLocked looks the key up, the caller holds s.RLock(). The stored key
+// differs from key on a case-insensitive match. An expired key isn't found.
+func (s *shard) getLocked(key string) (string, string, bool) {
+	value, ok := s.m[key]
+	if !ok && s.folded != nil {
+		key = s.folded[strings.ToLower(key)]
+		value, ok = s.m[key]
+	}
+	if ok && s.expiredLocked(key, time.Now()) {
+		return key, "", false
+	}
+	if l := store.lru.Load(); ok && l != nil {
+		l.touch(key)
+	}
+	return key, value, ok
+}
+
 func Put(key string, value string) error {
-	store.Lock()
-	store.m[key] = value
-	store.Unlock()
+	s := shardOf(key)
+	if err := s.lockTimed(); err != nil {
+		return err
+	}
+	s.putLocked(key, value)
+	s.Unlock()
+
+	evictOverflow()
 	return nil
 }
 
-func Delete(key string) error {
-	store.Lock()
-	delete(store.m, key)
-	store.Unlock()
-	return nil
+// PutAndGet stores the value like Put, and returns the value it replaced and
+// whether there was one, an expired value counting as none
+func PutAndGet(key, value string) (string, bool, error) {
+	s := shardOf(key)
+	if err := s.lockTimed(); err != nil {
+		return "", false, err
+	}
+	old, existed := s.m[key]
+	existed = existed && !s.expiredLocked(key, time.Now())
+	if !existed {
+		old = ""
+	}
+	s.putLocked(key, value)
+	s.Unlock()
+
+	evictOverflow()
+	return old, existed, nil
+}
+
+// Clear deletes all the keys, the soft-deleted ones included, and returns
+// how many were stored
+func Clear() (int, error) {
+	unlock, err := lockShards(allShards())
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	return clearLocked(), nil
+}
+
+// clearLocked deletes all the keys and returns how many were stored, the
+// caller holds the locks of all the shards
+func clearLocked() int {
+	n := 0
+	for _, s := range store.shards {
+		n += len(s.m)
+		s.m = make(map[string]string)
+		s.tombstones = make(map[string]tombstone)
+		s.meta = make(map[string]Meta)
+		s.expiry = make(map[string]time.Time)
+		s.sliding = make(map[string]time.Duration)
+		if s.folded != nil {
+			s.folded = make(map[string]string)
+		}
+		if s.stamps != nil {
+			s.stamps = make(map[string]time.Time)
+		}
+	}
+	if l := store.lru.Load(); l != nil {
+		l.Lock()
+		l.order.Init()
+		l.elements = make(map[string]*list.Element)
+		l.Unlock()
+	}
+	return n
+}
+
+// Count returns how many keys are resident, the expired ones not yet removed
+// included, counted under the locks of all the shards
+func Count() int {
+	defer rlockShards(allShards())()
+
+	n := 0
+	for _, s := range store.shards {
+		n += len(s.m)
+	}
+	return n
+}
+
+// Delete removes the key, and reports whether it existed. An expired key is
+// removed but didn't exist.
+func Delete(key string) (bool, error) {
+	s := shardOf(key)
+	if err := s.lockTimed(); err != nil {
+		return false, err
+	}
+	_, existed := s.m[key]
+	existed = existed && !s.expiredLocked(key, time.Now())
+	s.deleteLocked(key)
+	s.Unlock()
+	return existed, nil
+}
+
+// putLocked stores the value, the caller holds s.Lock(). The caller calls
+// evictOverflow once unlocked.
+func (s *shard) putLocked(key, value string) {
+	s.m[key] = value
+	delete(s.expiry, key) // Stored forever, unless PutWithTTL sets it again
+	delete(s.sliding, key)
+	delete(s.tombstones, key) // A new value supersedes the deleted one
+	if s.folded != nil {
+		s.folded[strings.ToLower(key)] = key
+	}
+	if s.stamps != nil {
+		s.stamps[key] = time.Now()
+	}
+
+	now := time.Now()
+	meta, ok := s.meta[key]
+	if !ok {
+		meta.Created = now
+	}
+	meta.Version++
+	meta.Size = len(value)
+	meta.Modified = now
+	s.meta[key] = meta
+
+	if l := store.lru.Load(); l != nil {
+		l.touch(key)
+	}
+}
+
+// deleteLocked removes the key, the caller holds s.Lock()
+func (s *shard) deleteLocked(key string) {
+	delete(s.m, key)
+	if s.folded != nil && s.folded[strings.ToLower(key)] == key {
+		delete(s.folded, strings.ToLower(key))
+	}
+	delete(s.stamps, key)
+	delete(s.meta, key)
+	delete(s.expiry, key)
+	delete(s.sliding, key)
+	if l := store.lru.Load(); l != nil {
+		l.remove(key)
+	}
+}
+
+// SetCaseInsensitive turns on (or off) the case-insensitive lookups: keys are
+// stored as-is, but Get falls back to a lowercase index on a miss. When
+// several keys only differ by case, the last written one wins.
+func SetCaseInsensitive(enabled bool) {
+	unlock := lockAllShards()
+	defer unlock()
+
+	for _, s := range store.shards {
+		if !enabled {
+			s.folded = nil
+			continue
+		}
+
+		s.folded = make(map[string]string, len(s.m))
+		for key := range s.m {
+			s.folded[strings.ToLower(key)] = key
+		}
+	}
+}
+
+// SetRecordTimestamps turns on (or off) the recording of the time of each
+// Put, for simple audit trails. The values stored before have no timestamp.
+func SetRecordTimestamps(enabled bool) {
+	unlock := lockAllShards()
+	defer unlock()
+
+	for _, s := range store.shards {
+		if !enabled {
+			s.stamps = nil
+		} else if s.stamps == nil {
+			s.stamps = make(map[string]time.Time)
+		}
+	}
+}
+
+// Match returns the sorted keys matching the glob pattern (path.Match syntax,
+// e.g. "user:*:name"), at most limit of them if limit > 0
+func Match(pattern string, limit int) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	now := time.Now()
+	unlock := rlockShards(allShards())
+	for _, s := range store.shards {
+		for key := range s.m {
+			if s.expiredLocked(key, now) {
+				continue
+			}
+			if ok, _ := path.Match(pattern, key); ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	unlock()
+
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	return keys, nil
+}
+
+// ListKeys returns the sorted keys, listed under the locks of all the shards
+// so the listing is consistent. The expired keys are left out.
+func ListKeys() []string {
+	var keys []string
+	now := time.Now()
+	unlock := rlockShards(allShards())
+	for _, s := range store.shards {
+		for key := range s.m {
+			if !s.expiredLocked(key, now) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	unlock()
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Scan returns the key/value pairs whose key starts with prefix, captured
+// under the locks of all the shards for a consistent subtree. It walks all
+// the keys: O(n) in the store size, whatever the number of matches. The
+// expired keys are left out.
+func Scan(prefix string) map[string]string {
+	pairs := make(map[string]string)
+	now := time.Now()
+	unlock := rlockShards(allShards())
+	for _, s := range store.shards {
+		for key, value := range s.m {
+			if strings.HasPrefix(key, prefix) && !s.expiredLocked(key, now) {
+				pairs[key] = value
+			}
+		}
+	}
+	unlock()
+
+	return pairs
+}
+
+// ScanKeys returns the sorted keys starting with prefix, without their values
+// so a large subtree can be streamed a few values at a time. The expired
+// keys are left out.
+func ScanKeys(prefix string) []string {
+	var keys []string
+	now := time.Now()
+	unlock := rlockShards(allShards())
+	for _, s := range store.shards {
+		for key := range s.m {
+			if strings.HasPrefix(key, prefix) && !s.expiredLocked(key, now) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	unlock()
+
+	sort.Strings(keys)
+	return keys
+}
+
+// ChangedSince returns the keys modified after since, oldest change first, for
+// the clients syncing incrementally. The expired keys are left out.
+func ChangedSince(since time.Time) []string {
+	type change struct {
+		key      string
+		modified time.Time
+	}
+
+	var changes []change
+	now := time.Now()
+	unlock := rlockShards(allShards())
+	for _, s := range store.shards {
+		for key, meta := range s.meta {
+			if meta.Modified.After(since) && !s.expiredLocked(key, now) {
+				changes = append(changes, change{key, meta.Modified})
+			}
+		}
+	}
+	unlock()
+
+	sort.Slice(changes, func(i, j int) bool {
+		if !changes[i].modified.Equal(changes[j].modified) {
+			return changes[i].modified.Before(changes[j].modified)
+		}
+		return changes[i].key < changes[j].key
+	})
+
+	keys := make([]string, len(changes))
+	for i, c := range changes {
+		keys[i] = c.key
+	}
+	return keys
+}
+
+// Pairs returns a copy of all the key/value pairs, taken under the locks of
+// all the shards
+func Pairs() map[string]string {
+	defer rlockShards(allShards())()
+
+	now := time.Now()
+	pairs := make(map[string]string)
+	for _, s := range store.shards {
+		for key, value := range s.m {
+			if !s.expiredLocked(key, now) {
+				pairs[key] = value
+			}
+		}
+	}
+	return pairs
+}
+
+// Snapshot writes all the key/value pairs as a JSON object, encoded straight
+// to w under the read locks of all the shards: the writes wait meanwhile,
+// but the store isn't copied. The expired keys are left out.
+func Snapshot(w io.Writer) error {
+	defer rlockShards(allShards())()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteByte('{')
+	now := time.Now()
+	first := true
+	for _, s := range store.shards {
+		for key, value := range s.m {
+			if s.expiredLocked(key, now) {
+				continue
+			}
+			if !first {
+				bw.WriteByte(',')
+			}
+			first = false
+
+			k, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			v, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			bw.Write(k)
+			bw.WriteByte(':')
+			bw.Write(v)
+		}
+	}
+	bw.WriteString("}\n")
+
+	return bw.Flush() // bufio keeps the first write error
+}
+
+// ErrorInvalidSnapshot is returned by Restore for a body that isn't a JSON
+// object of strings
+var ErrorInvalidSnapshot = errors.New("invalid snapshot")
+
+// Restore loads a JSON object of key/value pairs, as written by Snapshot. It
+// is decoded and its pairs validated first, by validate if set, so a
+// malformed snapshot changes nothing, then applied under the locks of all the
+// shards. With replace, the keys missing from the snapshot are deleted, else
+// they are kept. It returns the pairs, for the transaction log.
+func Restore(r io.Reader, replace bool, validate func(key, value string) error) (map[string]string, error) {
+	var pairs map[string]string
+	if err := json.NewDecoder(r).Decode(&pairs); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrorInvalidSnapshot, err)
+	}
+	for key, value := range pairs {
+		if err := ValidateKey(key); err != nil {
+			return nil, err
+		}
+		if validate == nil {
+			continue
+		}
+		if err := validate(key, value); err != nil {
+			return nil, fmt.Errorf("%w: key %q: %w", ErrorInvalidSnapshot, key, err)
+		}
+	}
+
+	unlock, err := lockShards(allShards())
+	if err != nil {
+		return nil, err
+	}
+	if replace {
+		clearLocked()
+	}
+	for key, value := range pairs {
+		shardOf(key).putLocked(key, value)
+	}
+	unlock()
+
+	evictOverflow()
+	return pairs, nil
+}
+
+// SoftDelete deletes the key but keeps its value, so Undelete can restore it.
+// It reports whether the key existed, like Delete.
+func SoftDelete(key string) (bool, error) {
+	s := shardOf(key)
+	if err := s.lock(); err != nil {
+		return false, err
+	}
+	defer s.Unlock()
+
+	value, ok := s.m[key]
+	if !ok {
+		return false, nil
+	}
+	if s.expiredLocked(key, time.Now()) {
+		s.deleteLocked(key) // Nothing to restore
+		return false, nil
+	}
+	s.deleteLocked(key)
+	s.tombstones[key] = tombstone{value: value, deletedAt: time.Now()}
+	return true, nil
+}
+
+// Undelete restores a key soft-deleted less than window ago, and returns its value
+func Undelete(key string, window time.Duration) (string, error) {
+	s := shardOf(key)
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	t, ok := s.tombstones[key]
+	if !ok || time.Since(t.deletedAt) > window {
+		s.Unlock()
+		return "", ErrorNoSuchKey
+	}
+
+	s.putLocked(key, t.value) // Drops the tombstone
+	s.Unlock()
+
+	evictOverflow()
+	return t.value, nil
+}
+
+// PurgeTombstones finalizes the soft deletes older than window, and returns
+// how many values were dropped
+func PurgeTombstones(window time.Duration) int {
+	purged := 0
+	for _, s := range store.shards {
+		s.Lock()
+		for key, t := range s.tombstones {
+			if time.Since(t.deletedAt) > window {
+				delete(s.tombstones, key)
+				purged++
+			}
+		}
+		s.Unlock()
+	}
+
+	return purged
 }
 
 /*// Fatal is equivalent to Print() followed by a call to os.Exit(2).
@@ -1,10 +1,27 @@
 package internal
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+// resetStore replaces all the keys of the store by the pairs
+func resetStore(t testing.TB, pairs map[string]string) {
+	t.Helper()
+	if _, err := Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutMulti(pairs); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestGet(t *testing.T) {
 	const key = "read-key"
 	const value = "read-value"
@@ -12,7 +29,7 @@ func TestGet(t *testing.T) {
 	var val interface{}
 	var err error
 
-	defer delete(store.m, key)
+	defer delete(shardOf(key).m, key)
 
 	// Read a non-thing
 	val, err = Get(key) //nolint:ineffassign
@@ -23,7 +40,7 @@ func TestGet(t *testing.T) {
 		t.Error("unexpected error:", err)
 	}
 
-	store.m[key] = value
+	shardOf(key).m[key] = value
 
 	val, err = Get(key)
 	if err != nil {
@@ -42,10 +59,10 @@ func TestPut(t *testing.T) {
 	var val interface{}
 	var contains bool
 
-	defer delete(store.m, key)
+	defer delete(shardOf(key).m, key)
 
 	// Sanity check
-	_, contains = store.m[key]
+	_, contains = shardOf(key).m[key]
 	if contains {
 		t.Error("key/value already exists")
 	}
@@ -56,7 +73,7 @@ func TestPut(t *testing.T) {
 		t.Error(err)
 	}
 
-	val, contains = store.m[key]
+	val, contains = shardOf(key).m[key]
 	if !contains {
 		t.Error("create failed")
 	}
@@ -72,30 +89,32 @@ func TestDelete(t *testing.T) {
 
 	var contains bool
 
-	defer delete(store.m, key)
+	defer delete(shardOf(key).m, key)
 
-	store.m[key] = value
+	shardOf(key).m[key] = value
 
-	_, contains = store.m[key]
+	_, contains = shardOf(key).m[key]
 	if !contains {
 		t.Error("key/value doesn't exist")
 	}
 
-	if err := Delete(key); err != nil {
-		t.Error("Delete returns an error: ", err)
+	if existed, err := Delete(key); err != nil || !existed {
+		t.Errorf("Delete() = %t, %v; want true", existed, err)
 	}
 
-	_, contains = store.m[key]
+	_, contains = shardOf(key).m[key]
 	if contains {
 		t.Error("Delete failed")
 	}
+
+	if existed, err := Delete(key); err != nil || existed {
+		t.Errorf("Delete() of a missing key = %t, %v; want false", existed, err)
+	}
 }
 
 func TestPutAndGet(t *testing.T) {
 	// Clear the store before testing
-	store.Lock()
-	store.m = make(map[string]string)
-	store.Unlock()
+	resetStore(t, nil)
 
 	tests := []struct {
 		name    string
@@ -143,9 +162,7 @@ func TestPutAndGet(t *testing.T) {
 }
 
 func TestGetNonExistentKey(t *testing.T) {
-	store.Lock()
-	store.m = make(map[string]string)
-	store.Unlock()
+	resetStore(t, nil)
 
 	_, err := Get("non-existent-key")
 	if err != ErrorNoSuchKey {
@@ -153,10 +170,257 @@ func TestGetNonExistentKey(t *testing.T) {
 	}
 }
 
+func TestSoftDeleteAndUndelete(t *testing.T) {
+	const key = "soft-delete-key"
+	const value = "soft-delete-value"
+
+	defer delete(shardOf(key).m, key)
+
+	if err := Put(key, value); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SoftDelete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(key); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Get() after SoftDelete() error = %v, want %v", err, ErrorNoSuchKey)
+	}
+
+	got, err := Undelete(key, time.Minute)
+	if err != nil {
+		t.Fatalf("Undelete() error = %v", err)
+	}
+	if got != value {
+		t.Errorf("Undelete() got = %v, want %v", got, value)
+	}
+	if got, _ := Get(key); got != value {
+		t.Errorf("Get() after Undelete() got = %v, want %v", got, value)
+	}
+
+	// Nothing left to restore
+	if _, err := Undelete(key, time.Minute); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("second Undelete() error = %v, want %v", err, ErrorNoSuchKey)
+	}
+}
+
+func TestUndeleteWindow(t *testing.T) {
+	const key = "expired-tombstone-key"
+
+	if err := Put(key, "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SoftDelete(key); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := Undelete(key, time.Millisecond); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Undelete() after the window error = %v, want %v", err, ErrorNoSuchKey)
+	}
+	if purged := PurgeTombstones(time.Millisecond); purged != 1 {
+		t.Errorf("PurgeTombstones() = %d, want 1", purged)
+	}
+	if _, err := Undelete(key, time.Minute); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Undelete() after purge error = %v, want %v", err, ErrorNoSuchKey)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	resetStore(t, map[string]string{
+		"user:1:name":  "alice",
+		"user:1:email": "alice@example.com",
+		"user:2:name":  "bob",
+		"user:22:name": "carol",
+		"group:1:name": "admins",
+	})
+
+	tests := []struct {
+		pattern string
+		limit   int
+		want    []string
+	}{
+		{"user:*:name", 0, []string{"user:1:name", "user:22:name", "user:2:name"}},
+		{"user:?:name", 0, []string{"user:1:name", "user:2:name"}},
+		{"*:1:*", 0, []string{"group:1:name", "user:1:email", "user:1:name"}},
+		{"user:*:name", 2, []string{"user:1:name", "user:22:name"}},
+		{"nothing*", 0, nil},
+	}
+
+	for _, tt := range tests {
+		got, err := Match(tt.pattern, tt.limit)
+		if err != nil {
+			t.Errorf("Match(%q) error = %v", tt.pattern, err)
+			continue
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Match(%q, %d) got = %v, want %v", tt.pattern, tt.limit, got, tt.want)
+		}
+	}
+
+	if _, err := Match("user:[", 0); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+}
+
+func TestExists(t *testing.T) {
+	if err := Put("exists-key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if !Exists("exists-key") {
+		t.Error("Exists() = false for a stored key")
+	}
+	if Exists("exists-unknown") {
+		t.Error("Exists() = true for an unknown key")
+	}
+	if size, ok := Size("exists-key"); !ok || size != 5 {
+		t.Errorf("Size() = %d, %v; want 5, true", size, ok)
+	}
+}
+
+func TestCount(t *testing.T) {
+	base := Count()
+	for _, key := range []string{"count:a", "count:b", "count:c"} {
+		if err := Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Put("count:a", "overwritten"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"count:b", "count:unknown"} {
+		if _, err := Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := Count() - base; got != 2 {
+		t.Errorf("Count() grew by %d, want 2", got)
+	}
+}
+
+func TestScan(t *testing.T) {
+	for _, key := range []string{"scan:user:1", "scan:user:2", "scan:group:1"} {
+		if err := Put(key, key+"-value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pairs := Scan("scan:user:")
+	if len(pairs) != 2 || pairs["scan:user:1"] != "scan:user:1-value" || pairs["scan:user:2"] != "scan:user:2-value" {
+		t.Errorf("Scan() got = %v, want the 2 user pairs", pairs)
+	}
+	if pairs := Scan("scan:nothing"); len(pairs) != 0 {
+		t.Errorf("Scan() got = %v, want none", pairs)
+	}
+}
+
+func TestChangedSince(t *testing.T) {
+	for _, key := range []string{"changes:a", "changes:b", "changes:c"} {
+		if err := Put(key, "v1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+
+	for _, key := range []string{"changes:c", "changes:a"} {
+		if err := Put(key, "v2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := strings.Join(ChangedSince(cutoff), ","); got != "changes:c,changes:a" {
+		t.Errorf("ChangedSince() got = %s, want changes:c,changes:a", got)
+	}
+	if got := ChangedSince(time.Now()); len(got) != 0 {
+		t.Errorf("ChangedSince(now) got = %v, want none", got)
+	}
+}
+
+func TestCaseInsensitiveLookup(t *testing.T) {
+	resetStore(t, nil)
+
+	SetCaseInsensitive(true)
+	defer SetCaseInsensitive(false)
+
+	if err := Put("FooBar", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"FooBar", "foobar", "FOOBAR"} {
+		if got, err := Get(key); err != nil || got != "value" {
+			t.Errorf("Get(%q) got = %q, %v; want %q", key, got, err, "value")
+		}
+	}
+
+	// The original case is kept
+	if keys, _ := Match("*", 0); len(keys) != 1 || keys[0] != "FooBar" {
+		t.Errorf("stored keys = %v, want [FooBar]", keys)
+	}
+
+	if _, err := Delete("FooBar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get("foobar"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Get() after Delete() error = %v, want %v", err, ErrorNoSuchKey)
+	}
+
+	// Disabled by default
+	SetCaseInsensitive(false)
+	if err := Put("FooBar", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get("foobar"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("case-sensitive Get() error = %v, want %v", err, ErrorNoSuchKey)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	SetLockTimeout(50 * time.Millisecond)
+	defer SetLockTimeout(0)
+
+	// A long write holding the shard lock
+	s := shardOf("contended-key")
+	s.Lock()
+	start := time.Now()
+	err := Put("contended-key", "value")
+	elapsed := time.Since(start)
+	s.Unlock()
+
+	if !errors.Is(err, ErrorLockTimeout) {
+		t.Errorf("Put() error = %v, want %v", err, ErrorLockTimeout)
+	}
+	if elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Put() gave up after %v, want about 50ms", elapsed)
+	}
+
+	if err := Put("contended-key", "value"); err != nil {
+		t.Errorf("uncontended Put() error = %v", err)
+	}
+
+	// Undelete gives up too
+	s.Lock()
+	_, err = Undelete("contended-key", time.Minute)
+	s.Unlock()
+	if !errors.Is(err, ErrorLockTimeout) {
+		t.Errorf("Undelete() error = %v, want %v", err, ErrorLockTimeout)
+	}
+
+	// The settings wait for the lock instead of giving up
+	s.Lock()
+	time.AfterFunc(100*time.Millisecond, s.Unlock)
+	SetRecordTimestamps(true)
+	SetRecordTimestamps(false)
+	if s.stamps != nil {
+		t.Error("SetRecordTimestamps(false) under contention not applied")
+	}
+}
+
 func BenchmarkGet(b *testing.B) {
 	const key = "read-key"
 	const value = "read-value"
-	store.m[key] = value
+	shardOf(key).m[key] = value
 	var err error
 
 	for i := 0; i < b.N; i++ {
@@ -172,7 +436,7 @@ func BenchmarkGet_BigInputs(b *testing.B) {
 	var err error
 
 	for i, key := range keys {
-		store.m[key] = values[i]
+		shardOf(key).m[key] = values[i]
 	}
 
 	for i := 0; i < b.N; i++ {
@@ -184,6 +448,55 @@ func BenchmarkGet_BigInputs(b *testing.B) {
 	}
 }
 
+// BenchmarkConcurrentOperations compares the throughput of a mix of Gets and
+// Puts on a sharded store and on a single shard, like a single mutex
+func BenchmarkConcurrentOperations(b *testing.B) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("bench-concurrent:%d", i)
+	}
+
+	for _, n := range []int{1, shardCount} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			shards := store.shards
+			store.shards = newShards(n)
+			defer func() { store.shards = shards }()
+
+			var seq atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := seq.Add(1)
+					key := keys[i%uint64(len(keys))]
+					if i%4 == 0 { // 25% of writes
+						if err := Put(key, "value"); err != nil {
+							b.Error(err)
+						}
+					} else {
+						_, _ = Get(key)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	for i := 0; i < 10000; i++ {
+		if err := Put(fmt.Sprintf("bench-scan:%d:%d", i%100, i), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+
+	// 100 matches out of 10000+ keys, the cost of the full walk
+	for i := 0; i < b.N; i++ {
+		if pairs := Scan("bench-scan:42:"); len(pairs) != 100 {
+			b.Fatalf("got %d pairs, want 100", len(pairs))
+		}
+	}
+}
+
 func FuzzGet(f *testing.F) {
 	var val string
 	var err error
@@ -201,3 +514,146 @@ func FuzzGet(f *testing.F) {
 		}
 	})
 }
+
+func TestValidateKey(t *testing.T) {
+	SetMaxKeyLength(8)
+	defer SetMaxKeyLength(0)
+
+	for _, key := range []string{"", "tab\tkey", "new\nline", "too-long-key"} {
+		if err := ValidateKey(key); !errors.Is(err, ErrorInvalidKey) {
+			t.Errorf("ValidateKey(%q) error = %v, want %v", key, err, ErrorInvalidKey)
+		}
+	}
+	for _, key := range []string{"key", "8-bytes!"} {
+		if err := ValidateKey(key); err != nil {
+			t.Errorf("ValidateKey(%q) error = %v, want nil", key, err)
+		}
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	if _, err := Clear(); err != nil {
+		t.Fatal(err)
+	}
+	var evicted []string
+	SetMaxEntries(3, func(key string) {
+		// Called once the shard is released, the store can be used
+		if _, err := Get(key); !errors.Is(err, ErrorNoSuchKey) {
+			t.Errorf("Get(%q) of an evicted key error = %v, want %v", key, err, ErrorNoSuchKey)
+		}
+		evicted = append(evicted, key)
+	})
+	defer func() {
+		SetMaxEntries(0, nil)
+		_, _ = Clear()
+	}()
+
+	for _, key := range []string{"lru-a", "lru-b", "lru-c"} {
+		if err := Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A read makes lru-a the most recently used, lru-b is evicted
+	if _, err := Get("lru-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Put("lru-d", "value"); err != nil {
+		t.Fatal(err)
+	}
+	// A write makes lru-c the most recently used, lru-a is evicted
+	if err := Put("lru-c", "updated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Put("lru-e", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"lru-b", "lru-a"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("evicted %v, want %v", evicted, want)
+	}
+	if want := []string{"lru-c", "lru-d", "lru-e"}; !reflect.DeepEqual(ListKeys(), want) {
+		t.Errorf("ListKeys() = %v, want %v", ListKeys(), want)
+	}
+
+	// A deleted key leaves room, nothing is evicted
+	if _, err := Delete("lru-d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Put("lru-f", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 2 {
+		t.Errorf("evicted %v after a delete, want 2 keys", evicted)
+	}
+
+	// Lowering the bound evicts at once, the least recently changed first
+	SetMaxEntries(1, func(key string) { evicted = append(evicted, key) })
+	if want := []string{"lru-b", "lru-a", "lru-c", "lru-e"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("evicted %v, want %v", evicted, want)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	resetStore(t, map[string]string{
+		"snapshot:plain":   "value",
+		"snapshot:quoted":  `say "hi"`,
+		"snapshot:newline": "line 1\nline 2",
+	})
+	if err := PutWithExpiry("snapshot:expired", "value", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf strings.Builder
+	if err := Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]string
+	if err := json.Unmarshal([]byte(buf.String()), &got); err != nil {
+		t.Fatalf("invalid snapshot %q: %v", buf.String(), err)
+	}
+	if want := Pairs(); !reflect.DeepEqual(got, want) || len(got) != 3 {
+		t.Errorf("Snapshot() = %v, want %v", got, want)
+	}
+}
+
+func TestPutAndGetPrevious(t *testing.T) {
+	const key = "previous-key"
+
+	if old, existed, err := PutAndGet(key, "v1"); err != nil || existed || old != "" {
+		t.Errorf("PutAndGet() on a new key = %q, %t, %v; want \"\", false", old, existed, err)
+	}
+	if old, existed, err := PutAndGet(key, "v2"); err != nil || !existed || old != "v1" {
+		t.Errorf("PutAndGet() on an existing key = %q, %t, %v; want %q, true", old, existed, err, "v1")
+	}
+	if value, _ := Get(key); value != "v2" {
+		t.Errorf("Get() = %q, want %q", value, "v2")
+	}
+
+	// An expired value is no previous value
+	if err := PutWithExpiry(key, "expired", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if old, existed, err := PutAndGet(key, "v3"); err != nil || existed || old != "" {
+		t.Errorf("PutAndGet() on an expired key = %q, %t, %v; want \"\", false", old, existed, err)
+	}
+}
+
+func TestRestoreValidate(t *testing.T) {
+	resetStore(t, map[string]string{"restore-kept": "v1"})
+	rejectEmpty := func(key, value string) error {
+		if value == "" {
+			return errors.New("empty value")
+		}
+		return nil
+	}
+
+	_, err := Restore(strings.NewReader(`{"restore-kept":"v2","restore-empty":""}`), true, rejectEmpty)
+	if !errors.Is(err, ErrorInvalidSnapshot) {
+		t.Errorf("Restore() of a rejected pair error = %v, want %v", err, ErrorInvalidSnapshot)
+	}
+	if want := map[string]string{"restore-kept": "v1"}; !reflect.DeepEqual(Pairs(), want) {
+		t.Errorf("store after a rejected Restore() = %v, want %v", Pairs(), want)
+	}
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of virtual nodes placed on the ring per node
+const DefaultReplicas = 100
+
+// HashRing routes keys to nodes with consistent hashing, so adding or
+// removing a node only moves the keys owned by that node.
+type HashRing struct {
+	replicas int
+	hashes   []uint32          // Sorted virtual node hashes
+	nodes    map[uint32]string // Virtual node hash -> node
+}
+
+func NewHashRing(replicas int, nodes ...string) *HashRing {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+
+	r := &HashRing{replicas: replicas, nodes: make(map[uint32]string)}
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			h := hashKey(node + "#" + strconv.Itoa(i))
+			r.hashes = append(r.hashes, h)
+			r.nodes[h] = node
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+
+	return r
+}
+
+// Node returns the node owning the key, or "" if the ring is empty
+func (r *HashRing) Node(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := hashKey(key)
+	// First virtual node clockwise from the key, wrapping around the ring
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+
+	return r.nodes[r.hashes[i]]
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	// FNV clusters similar strings (like "host:port#1", "host:port#2"),
+	// the murmur3 finalizer spreads them around the ring
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRingDeterministic(t *testing.T) {
+	nodes := []string{"node-a", "node-b", "node-c"}
+	r1 := NewHashRing(DefaultReplicas, nodes...)
+	r2 := NewHashRing(DefaultReplicas, nodes...)
+
+	owned := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		n1, n2 := r1.Node(key), r2.Node(key)
+		if n1 != n2 {
+			t.Fatalf("key %s routed to %s and %s", key, n1, n2)
+		}
+		owned[n1]++
+	}
+
+	// Every node should own a share of the keys
+	for _, node := range nodes {
+		if owned[node] == 0 {
+			t.Errorf("node %s owns no keys", node)
+		}
+	}
+}
+
+func TestHashRingStability(t *testing.T) {
+	before := NewHashRing(DefaultReplicas, "node-a", "node-b")
+	after := NewHashRing(DefaultReplicas, "node-a", "node-b", "node-c")
+
+	// Adding a node must only move keys to the new node
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if n := after.Node(key); n != before.Node(key) && n != "node-c" {
+			t.Errorf("key %s moved from %s to %s", key, before.Node(key), n)
+		}
+	}
+}
+
+func TestHashRingEmpty(t *testing.T) {
+	r := NewHashRing(0)
+	if n := r.Node("key"); n != "" {
+		t.Errorf("Node() on an empty ring = %q, want \"\"", n)
+	}
+}
+
+func TestHashRingEvenOwnership(t *testing.T) {
+	// Similar names, FNV alone clusters their virtual nodes
+	var nodes []string
+	for i := 1; i <= 8; i++ {
+		nodes = append(nodes, fmt.Sprintf("node%d", i))
+	}
+	r := NewHashRing(DefaultReplicas, nodes...)
+
+	const keys = 80000
+	owned := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		owned[r.Node(fmt.Sprintf("key-%d", i))]++
+	}
+
+	// Each node owns its fair share, give or take a third
+	fair := keys / len(nodes)
+	for _, node := range nodes {
+		if n := owned[node]; n < fair*2/3 || n > fair*4/3 {
+			t.Errorf("node %s owns %d keys, want about %d", node, n, fair)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrorInterpolationDepth is returned when the references nest deeper than
+// allowed, like a cycle does
+var ErrorInterpolationDepth = errors.New("interpolation too deep, is there a reference cycle?")
+
+// ErrorForbiddenReference is returned for a reference to a key the reader
+// can't read
+var ErrorForbiddenReference = errors.New("reference to a forbidden key")
+
+// reference matches ${key} in a value
+var reference = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// Interpolate replaces each ${key} of the value by the value of key, itself
+// interpolated, for simple config composition. The references nest at most
+// maxDepth levels. A missing key is an error wrapping ErrorNoSuchKey. Only
+// the keys allowed, if set, can be referenced, the others are an error
+// wrapping ErrorForbiddenReference.
+func Interpolate(value string, maxDepth int, allowed func(key string) bool) (string, error) {
+	if !strings.Contains(value, "${") {
+		return value, nil
+	}
+	if maxDepth <= 0 {
+		return "", ErrorInterpolationDepth
+	}
+
+	var err error
+	out := reference.ReplaceAllStringFunc(value, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		key := ref[2 : len(ref)-1]
+		if allowed != nil && !allowed(key) {
+			err = fmt.Errorf("reference ${%s}: %w", key, ErrorForbiddenReference)
+			return ""
+		}
+
+		var v string
+		if v, err = Get(key); err != nil {
+			err = fmt.Errorf("reference ${%s}: %w", key, err)
+			return ""
+		}
+		v, err = Interpolate(v, maxDepth-1, allowed)
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+	return out, nil
+}
@@ -3,18 +3,35 @@ package internal
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
 )
 
 type Metrics struct {
 	QueriesInflight          prometheus.Gauge
+	ActiveConnections        prometheus.Gauge
 	EventsReplayed           prometheus.Counter
-	EventsGet                prometheus.Counter
+	EventsReplayedByType     *prometheus.CounterVec
+	ReplayRate               prometheus.Gauge // Events per second of the startup replay
+	LogRecoveries            prometheus.Counter
+	EventsGet                prometheus.Counter // GET hits, HEAD included
+	EventsGetMiss            prometheus.Counter // GET misses, HEAD included
+	GetHitRatio              prometheus.GaugeFunc
 	EventsPut                prometheus.Counter
 	EventsDelete             prometheus.Counter
+	EventsClear              prometheus.Counter
+	Evictions                prometheus.Counter // Least recently used keys deleted to bound the store
 	HttpNotAllowed           prometheus.Counter
+	WritesShed               prometheus.Counter
+	SlowClientRejections     *prometheus.CounterVec
+	RequestsByPrefix         *prometheus.CounterVec
 	RequestsTotal            *prometheus.CounterVec
 	RequestDurationHistogram *prometheus.HistogramVec
 	Info                     *prometheus.GaugeVec
+	ReadOnly                 prometheus.Gauge
+	ReplayPending            prometheus.GaugeFunc
+	LockWait                 prometheus.Histogram // Nil unless registered by RegisterLockWait
+	ExpiredSwept             prometheus.CounterFunc
+	Keys                     prometheus.GaugeFunc
 }
 
 func NewMetrics(reg prometheus.Registerer) *Metrics {
@@ -24,20 +41,50 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			Name:      "info",
 			Help:      "Information about the GoKVs environment",
 		}, []string{"version"}),
+		ReadOnly: prometheus.NewGauge(prometheus.GaugeOpts{
+			Subsystem: "gokvs",
+			Name:      "read_only",
+			Help:      "1 if the server rejects the writes, 0 otherwise",
+		}),
 		QueriesInflight: prometheus.NewGauge(prometheus.GaugeOpts{
 			Subsystem: "gokvs",
 			Name:      "queries_inflight",
 			Help:      "total queries inflight",
 		}),
+		ActiveConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Subsystem: "gokvs",
+			Name:      "http_active_connections",
+			Help:      "open HTTP connections, idle ones included",
+		}),
 		EventsReplayed: prometheus.NewCounter(prometheus.CounterOpts{
 			Subsystem: "gokvs",
 			Name:      "events_replayed",
 			Help:      "total events replayed before starting",
 		}),
+		EventsReplayedByType: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "gokvs",
+			Name:      "events_replayed_by_type",
+			Help:      "total events replayed by type (put, delete, expire)",
+		}, []string{"type"}),
+		ReplayRate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Subsystem: "gokvs",
+			Name:      "replay_events_per_second",
+			Help:      "events replayed per second at startup, set once the replay completes",
+		}),
+		LogRecoveries: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem: "gokvs",
+			Name:      "log_recoveries",
+			Help:      "total transaction log opened with events from a previous run",
+		}),
 		EventsGet: prometheus.NewCounter(prometheus.CounterOpts{
 			Subsystem: "gokvs",
 			Name:      "events_get",
-			Help:      "total events GET",
+			Help:      "total events GET (HEAD included)",
+		}),
+		EventsGetMiss: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem: "gokvs",
+			Name:      "events_get_miss",
+			Help:      "total events GET on a missing key",
 		}),
 		EventsPut: prometheus.NewCounter(prometheus.CounterOpts{
 			Subsystem: "gokvs",
@@ -49,11 +96,36 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			Name:      "events_delete",
 			Help:      "total events DELETE",
 		}),
+		EventsClear: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem: "gokvs",
+			Name:      "events_clear",
+			Help:      "total events clearing all the keys",
+		}),
+		Evictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem: "gokvs",
+			Name:      "evictions_total",
+			Help:      "total keys evicted, the least recently used over the maximum entries",
+		}),
 		HttpNotAllowed: prometheus.NewCounter(prometheus.CounterOpts{
 			Subsystem: "http",
 			Name:      "405",
 			Help:      "total Not Allowed HTTP Error",
 		}),
+		WritesShed: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem: "gokvs",
+			Name:      "writes_shed",
+			Help:      "total writes rejected with 503, too many writes inflight",
+		}),
+		SlowClientRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "gokvs",
+			Name:      "slow_client_rejections",
+			Help:      "total slow clients rejected by reason (header_timeout, request_timeout, idle_timeout)",
+		}, []string{"reason"}),
+		RequestsByPrefix: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "gokvs",
+			Name:      "prefix_requests_total",
+			Help:      "total key requests by allowlisted key prefix, the others as \"other\"",
+		}, []string{"prefix", "method"}),
 		RequestsTotal: promauto.NewCounterVec(prometheus.CounterOpts{
 			Subsystem: "http",
 			Name:      "requests_total",
@@ -66,14 +138,88 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			Buckets:   prometheus.DefBuckets,
 		}, []string{"code", "method"}), //[]string{"path"})
 	}
+	m.ExpiredSwept = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Subsystem: "gokvs",
+		Name:      "expired_keys_swept",
+		Help:      "total expired keys deleted by the expiry sweeper",
+	}, func() float64 { return float64(SweptKeys()) })
+	m.Keys = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Subsystem: "gokvs",
+		Name:      "keys_total",
+		Help:      "keys resident in the store, read at each scrape",
+	}, func() float64 { return float64(Count()) })
+	m.GetHitRatio = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Subsystem: "gokvs",
+		Name:      "get_hit_ratio",
+		Help:      "ratio of GET hits over all GET events",
+	}, hitRatio(m.EventsGet, m.EventsGetMiss))
+
 	reg.MustRegister(m.Info)
+	reg.MustRegister(m.ReadOnly)
 	reg.MustRegister(m.QueriesInflight)
+	reg.MustRegister(m.ActiveConnections)
 	reg.MustRegister(m.EventsReplayed)
+	reg.MustRegister(m.EventsReplayedByType)
+	reg.MustRegister(m.ReplayRate)
+	reg.MustRegister(m.LogRecoveries)
 	reg.MustRegister(m.EventsGet)
+	reg.MustRegister(m.EventsGetMiss)
+	reg.MustRegister(m.GetHitRatio)
+	reg.MustRegister(m.ExpiredSwept)
+	reg.MustRegister(m.Keys)
 	reg.MustRegister(m.EventsPut)
 	reg.MustRegister(m.EventsDelete)
+	reg.MustRegister(m.EventsClear)
+	reg.MustRegister(m.Evictions)
 	reg.MustRegister(m.HttpNotAllowed)
+	reg.MustRegister(m.WritesShed)
+	reg.MustRegister(m.SlowClientRejections)
+	reg.MustRegister(m.RequestsByPrefix)
 	reg.MustRegister(m.RequestsTotal)
 	reg.MustRegister(m.RequestDurationHistogram)
 	return m
 }
+
+// hitRatio computes hits/(hits+misses) on scrape, 0 before the first GET
+func hitRatio(hits, misses prometheus.Counter) func() float64 {
+	return func() float64 {
+		h, m := counterValue(hits), counterValue(misses)
+		if h+m == 0 {
+			return 0
+		}
+		return h / (h + m)
+	}
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	var pb dto.Metric
+	if err := c.Write(&pb); err != nil {
+		return 0
+	}
+	return pb.GetCounter().GetValue()
+}
+
+// RegisterReplayPending exposes how many events the next startup would
+// replay from the transaction log, to know when a snapshot is worth it
+func (m *Metrics) RegisterReplayPending(reg prometheus.Registerer, l *TransactionLog) {
+	m.ReplayPending = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Subsystem: "gokvs",
+		Name:      "replay_pending_events",
+		Help:      "estimated events replayed on the next restart",
+	}, func() float64 { return float64(l.PendingReplay()) })
+	reg.MustRegister(m.ReplayPending)
+}
+
+// RegisterLockWait times the waits for the store locks in Get, Put and
+// Delete, to diagnose the contention. Timing each of them has a cost, so it
+// is opt-in.
+func (m *Metrics) RegisterLockWait(reg prometheus.Registerer) {
+	m.LockWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: "gokvs",
+		Name:      "store_lock_wait_seconds",
+		Help:      "time waiting for the store lock in Get, Put and Delete",
+		Buckets:   prometheus.ExponentialBuckets(1e-6, 4, 10), // 1µs to 262ms
+	})
+	reg.MustRegister(m.LockWait)
+	SetLockWaitObserver(m.LockWait)
+}
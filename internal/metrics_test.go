@@ -1,9 +1,14 @@
 package internal
 
 import (
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,12 +22,18 @@ func TestNewMetrics(t *testing.T) {
 	assert.NotNil(t, metrics.Info)
 	assert.NotNil(t, metrics.QueriesInflight)
 	assert.NotNil(t, metrics.EventsReplayed)
+	assert.NotNil(t, metrics.LogRecoveries)
 	assert.NotNil(t, metrics.EventsGet)
+	assert.NotNil(t, metrics.EventsGetMiss)
+	assert.NotNil(t, metrics.GetHitRatio)
 	assert.NotNil(t, metrics.EventsPut)
 	assert.NotNil(t, metrics.EventsDelete)
+	assert.NotNil(t, metrics.EventsClear)
 	assert.NotNil(t, metrics.HttpNotAllowed)
+	assert.NotNil(t, metrics.WritesShed)
 	assert.NotNil(t, metrics.RequestsTotal)
 	assert.NotNil(t, metrics.RequestDurationHistogram)
+	assert.NotNil(t, metrics.Keys)
 
 	// Verify metrics are registered by gathering them
 	gathered, err := reg.Gather()
@@ -31,9 +42,9 @@ func TestNewMetrics(t *testing.T) {
 	// We should have 9 metric families (one for each metric)
 	//assert.Equal(t, 9, len(gathered))
 
-	// We should have 6 metric families since RequestsTotal and RequestDurationHistogram
+	// We should have 17 metric families since RequestsTotal and RequestDurationHistogram
 	// are registered by promauto
-	assert.Equal(t, 6, len(gathered))
+	assert.Equal(t, 17, len(gathered))
 
 	// Initialize metrics with labels
 	metrics.Info.WithLabelValues("1.0.0").Set(1)
@@ -59,3 +70,85 @@ func TestNewMetrics(t *testing.T) {
 	//assert.Contains(t, metrics.RequestDurationHistogram.MustCurryWith(prometheus.Labels{"handler": "dummy"}).Desc().String(), "http")
 	//assert.Contains(t, metrics.RequestDurationHistogram.MetricVec.Desc().String(), "http")
 }
+
+func TestReplayPendingGauge(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "test-transaction-log")
+	if err != nil {
+		t.Fatalf("Cannot create temporary file: %v", err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	logger, err := NewTransactionLogger(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to create transaction logger: %v", err)
+	}
+	logger.Run()
+	defer logger.Close()
+
+	metrics := &Metrics{}
+	metrics.RegisterReplayPending(prometheus.NewRegistry(), logger)
+
+	for i := 0; i < 3; i++ {
+		logger.WritePut("key", "value")
+	}
+	logger.Wait()
+	assert.Equal(t, 3.0, testutil.ToFloat64(metrics.ReplayPending))
+
+	// A snapshot covers everything written so far
+	logger.MarkSnapshot(logger.LastSequence())
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.ReplayPending))
+
+	logger.WritePut("key", "value")
+	logger.WriteDelete("key")
+	logger.Wait()
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.ReplayPending))
+}
+
+func TestGetHitRatio(t *testing.T) {
+	hits := prometheus.NewCounter(prometheus.CounterOpts{Name: "hits"})
+	misses := prometheus.NewCounter(prometheus.CounterOpts{Name: "misses"})
+	ratio := prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "ratio"}, hitRatio(hits, misses))
+
+	assert.Equal(t, 0.0, testutil.ToFloat64(ratio))
+
+	hits.Add(3)
+	misses.Inc()
+	assert.Equal(t, 0.75, testutil.ToFloat64(ratio))
+}
+
+func TestLockWaitHistogram(t *testing.T) {
+	metrics := &Metrics{}
+	metrics.RegisterLockWait(prometheus.NewRegistry())
+	defer SetLockWaitObserver(nil)
+
+	// The Gets, Puts and Deletes wait for a long write
+	const key = "lock-wait-key"
+	s := shardOf(key)
+	s.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch i % 3 {
+			case 0:
+				_, _ = Get(key)
+			case 1:
+				_ = Put(key, "value")
+			case 2:
+				_, _ = Delete(key)
+			}
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	s.Unlock()
+	wg.Wait()
+
+	var pb dto.Metric
+	if err := metrics.LockWait.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(9), pb.GetHistogram().GetSampleCount())
+	assert.Greater(t, pb.GetHistogram().GetSampleSum(), 9*0.01, "the waits last about 20ms each")
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// segmentName returns the name of the nth rotated segment of the log, 1 is
+// the most recent
+func segmentName(name string, n int) string {
+	return name + "." + strconv.Itoa(n)
+}
+
+// rotatedSegments returns the rotated segments of the log, oldest first
+func rotatedSegments(name string) []string {
+	var segments []string
+	for n := 1; ; n++ {
+		segment := segmentName(name, n)
+		if _, err := os.Stat(segment); err != nil {
+			break
+		}
+		segments = append(segments, segment)
+	}
+
+	for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+		segments[i], segments[j] = segments[j], segments[i]
+	}
+	return segments
+}
+
+// removeSegments deletes the rotated segments of the log
+func removeSegments(name string) error {
+	for _, segment := range rotatedSegments(name) {
+		if err := os.Remove(segment); err != nil {
+			return fmt.Errorf("cannot remove transaction log segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// rotate renames the log to its first segment, after shifting the older
+// ones, and goes on in a new log. The sequence numbers go on too. The caller
+// holds l.mu.
+func (l *TransactionLog) rotate() error {
+	name := l.file.Name()
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync transaction log file: %w", err)
+	}
+
+	for n := len(rotatedSegments(name)); n >= 1; n-- {
+		if err := os.Rename(segmentName(name, n), segmentName(name, n+1)); err != nil {
+			return fmt.Errorf("cannot rotate transaction log: %w", err)
+		}
+	}
+	if err := os.Rename(name, segmentName(name, 1)); err != nil {
+		return fmt.Errorf("cannot rotate transaction log: %w", err)
+	}
+
+	// Until the new log is open, the writes go on in the renamed one, read
+	// as the first segment
+	// #nosec [G304] [-- Acceptable risk, for the CWE-22]
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	n, err := io.WriteString(file, schemaHeader(SchemaVersion))
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("cannot write transaction log header: %w", err)
+	}
+
+	_ = l.file.Close()
+	l.file, l.source = file, file
+	l.schemaVersion = SchemaVersion
+	l.size = int64(n)
+	return nil
+}
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// shardCount is the number of shards of the store, each with its own lock so
+// the writes to different keys rarely wait for each other
+const shardCount = 256
+
+// shard holds the keys hashing to it, see shardOf
+type shard struct {
+	sync.RWMutex
+	m          map[string]string
+	tombstones map[string]tombstone // Soft-deleted values, kept for an undo window
+	folded     map[string]string    // Lowercase key -> stored key, nil unless case-insensitive
+	stamps     map[string]time.Time // Time of the last Put, nil unless recorded
+	meta       map[string]Meta
+	expiry     map[string]time.Time     // Absolute expiry of the keys put with a TTL
+	sliding    map[string]time.Duration // Idle TTL of the keys whose expiry each Get pushes back
+}
+
+func newShard() *shard {
+	return &shard{
+		m:          make(map[string]string),
+		tombstones: make(map[string]tombstone),
+		meta:       make(map[string]Meta),
+		expiry:     make(map[string]time.Time),
+		sliding:    make(map[string]time.Duration),
+	}
+}
+
+func newShards(n int) []*shard {
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = newShard()
+	}
+	return shards
+}
+
+// shardIndex hashes the lowercase key with FNV-1a, so the keys only differing
+// by case share a shard and its case-insensitive index
+func shardIndex(key string) int {
+	key = strings.ToLower(key) // No copy without uppercase letters
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(store.shards)))
+}
+
+func shardOf(key string) *shard {
+	return store.shards[shardIndex(key)]
+}
+
+// lock takes s.Lock(), or gives up with ErrorLockTimeout
+func (s *shard) lock() error {
+	timeout := time.Duration(lockTimeout.Load())
+	if timeout <= 0 {
+		s.Lock()
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for !s.TryLock() {
+		if time.Now().After(deadline) {
+			return ErrorLockTimeout
+		}
+		time.Sleep(lockRetryInterval)
+	}
+	return nil
+}
+
+// lockWait times the waits for the shard locks of Get, Put and Delete, when
+// set by SetLockWaitObserver
+var lockWait atomic.Pointer[lockWaitObserver]
+
+type lockWaitObserver struct {
+	prometheus.Observer
+}
+
+// SetLockWaitObserver observes the seconds Get, Put and Delete wait for their
+// shard lock, nil stops the timing
+func SetLockWaitObserver(o prometheus.Observer) {
+	if o == nil {
+		lockWait.Store(nil)
+		return
+	}
+	lockWait.Store(&lockWaitObserver{o})
+}
+
+// lockTimed is s.lock(), its wait observed if timed
+func (s *shard) lockTimed() error {
+	o := lockWait.Load()
+	if o == nil {
+		return s.lock()
+	}
+
+	start := time.Now()
+	err := s.lock()
+	o.Observe(time.Since(start).Seconds())
+	return err
+}
+
+// rlockTimed is s.RLock(), its wait observed if timed
+func (s *shard) rlockTimed() {
+	o := lockWait.Load()
+	if o == nil {
+		s.RLock()
+		return
+	}
+
+	start := time.Now()
+	s.RLock()
+	o.Observe(time.Since(start).Seconds())
+}
+
+// shardIndexes returns the sorted shards of the keys, each once
+func shardIndexes(keys []string) []int {
+	seen := make(map[int]bool, len(keys))
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		if i := shardIndex(key); !seen[i] {
+			seen[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// allShards returns the indexes of all the shards
+func allShards() []int {
+	indexes := make([]int, len(store.shards))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
+
+// lockShards write-locks the shards in order, against deadlocks, or gives up
+// with ErrorLockTimeout. It returns the function unlocking them.
+func lockShards(indexes []int) (func(), error) {
+	for n, i := range indexes {
+		if err := store.shards[i].lock(); err != nil {
+			for _, j := range indexes[:n] {
+				store.shards[j].Unlock()
+			}
+			return nil, err
+		}
+	}
+	return func() {
+		for _, i := range indexes {
+			store.shards[i].Unlock()
+		}
+	}, nil
+}
+
+// lockAllShards write-locks all the shards in order, waiting as long as it
+// takes: the settings must apply, whatever the lock timeout. It returns the
+// function unlocking them.
+func lockAllShards() func() {
+	for _, s := range store.shards {
+		s.Lock()
+	}
+	return func() {
+		for _, s := range store.shards {
+			s.Unlock()
+		}
+	}
+}
+
+// rlockShards read-locks the shards in order, and returns the function
+// unlocking them
+func rlockShards(indexes []int) func() {
+	for _, i := range indexes {
+		store.shards[i].RLock()
+	}
+	return func() {
+		for _, i := range indexes {
+			store.shards[i].RUnlock()
+		}
+	}
+}
+
+// lockKeys write-locks the shards of the keys, for the writes spanning
+// several keys
+func lockKeys(keys ...string) (func(), error) {
+	return lockShards(shardIndexes(keys))
+}
+
+// rlockKeys read-locks the shards of the keys, for the reads spanning
+// several keys
+func rlockKeys(keys ...string) func() {
+	return rlockShards(shardIndexes(keys))
+}
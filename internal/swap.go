@@ -0,0 +1,124 @@
+package internal
+
+import "time"
+
+// SwapKeys exchanges the values of two keys under the locks of both their
+// shards, for blue/green flips. Both keys must exist, else nothing changes
+// and it returns ErrorNoSuchKey. Their TTLs are cleared, like by a Put. It
+// returns the new values of keyA and keyB, for the transaction log.
+func SwapKeys(keyA, keyB string) (string, string, error) {
+	unlock, err := lockKeys(keyA, keyB)
+	if err != nil {
+		return "", "", err
+	}
+	defer unlock()
+
+	now := time.Now()
+	sA, sB := shardOf(keyA), shardOf(keyB)
+	valueA, okA := sA.m[keyA]
+	valueB, okB := sB.m[keyB]
+	if !okA || !okB || sA.expiredLocked(keyA, now) || sB.expiredLocked(keyB, now) {
+		return "", "", ErrorNoSuchKey
+	}
+
+	sA.putLocked(keyA, valueB)
+	sB.putLocked(keyB, valueA)
+
+	return valueB, valueA, nil
+}
+
+// Copy stores the value of src in dst under the locks of both their shards,
+// and returns it for the transaction log. A missing src returns
+// ErrorNoSuchKey. The TTL of dst is cleared, like by a Put.
+func Copy(src, dst string) (string, error) {
+	return copyKey(src, dst, false)
+}
+
+// Rename moves the value of src to dst under the locks of both their shards,
+// and returns it for the transaction log. A missing src returns
+// ErrorNoSuchKey. The TTL of src is not carried over, like by a Put.
+func Rename(src, dst string) (string, error) {
+	return copyKey(src, dst, true)
+}
+
+func copyKey(src, dst string, move bool) (string, error) {
+	unlock, err := lockKeys(src, dst)
+	if err != nil {
+		return "", err
+	}
+	defer evictOverflow() // Once unlocked
+	defer unlock()
+
+	s := shardOf(src)
+	value, ok := s.m[src]
+	if !ok || s.expiredLocked(src, time.Now()) {
+		return "", ErrorNoSuchKey
+	}
+	if src == dst {
+		return value, nil
+	}
+
+	shardOf(dst).putLocked(dst, value)
+	if move {
+		s.deleteLocked(src)
+	}
+	return value, nil
+}
+
+// CompareAndSwap replaces the value of the key by value only if it is old,
+// under a single lock, and returns whether it did. A missing key never
+// matches. The TTL of the key is cleared, like by a Put.
+func CompareAndSwap(key, old, value string) (bool, error) {
+	s := shardOf(key)
+	if err := s.lock(); err != nil {
+		return false, err
+	}
+	defer s.Unlock()
+
+	current, ok := s.m[key]
+	if !ok || current != old || s.expiredLocked(key, time.Now()) {
+		return false, nil
+	}
+
+	s.putLocked(key, value)
+	return true, nil
+}
+
+// SetIfNotExists stores the value only if the key is missing or expired,
+// under a single lock, and returns whether it did
+func SetIfNotExists(key, value string) (bool, error) {
+	s := shardOf(key)
+	if err := s.lock(); err != nil {
+		return false, err
+	}
+	defer evictOverflow() // Once unlocked
+	defer s.Unlock()
+
+	if _, ok := s.m[key]; ok && !s.expiredLocked(key, time.Now()) {
+		return false, nil
+	}
+
+	s.putLocked(key, value)
+	return true, nil
+}
+
+// PutIf stores the value only if the key other holds expected, under the
+// locks of both their shards, and returns whether it did. A missing other key
+// never matches. The TTL of the key is cleared, like by a Put.
+func PutIf(key, value, other, expected string) (bool, error) {
+	unlock, err := lockKeys(key, other)
+	if err != nil {
+		return false, err
+	}
+	defer evictOverflow() // Once unlocked
+	defer unlock()
+
+	s := shardOf(other)
+	current, ok := s.m[other]
+	if !ok || current != expected || s.expiredLocked(other, time.Now()) {
+		return false, nil
+	}
+
+	shardOf(key).putLocked(key, value)
+	return true, nil
+}
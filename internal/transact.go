@@ -2,11 +2,17 @@ package internal
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type EventType byte
@@ -15,26 +21,94 @@ const (
 	_                     = iota // iota == 0; ignore this value
 	EventDelete EventType = iota // iota == 1
 	EventPut                     // iota == 2; implicitly repeat last
+	EventExpire                  // iota == 3; value is the expiry in Unix nanoseconds
+	EventClear                   // iota == 4; no key, all the keys are deleted
+	EventBounds                  // iota == 5; value is the "min:max" bounds of Increment, see FormatBounds
 )
 
+func (t EventType) String() string {
+	switch t {
+	case EventDelete:
+		return "delete"
+	case EventPut:
+		return "put"
+	case EventExpire:
+		return "expire"
+	case EventClear:
+		return "clear"
+	case EventBounds:
+		return "bounds"
+	}
+	return "unknown"
+}
+
+// SchemaVersion is the format version of the new transaction logs, written
+// in their header line. Version 1 logs have no header, version 3 URL-encodes
+// the keys like the values.
+const SchemaVersion = 3
+
+// schemaHeaderPrefix starts the header line, "#" lines are not events
+const schemaHeaderPrefix = "#gokvs-log v"
+
+// ErrorUnsupportedSchema is returned for a log written by a newer version
+var ErrorUnsupportedSchema = errors.New("unsupported transaction log schema")
+
+func schemaHeader(version int) string {
+	return schemaHeaderPrefix + strconv.Itoa(version) + "\n"
+}
+
+// parseSchemaHeader returns the version of a header line
+func parseSchemaHeader(line string) (int, bool) {
+	v, ok := strings.CutPrefix(line, schemaHeaderPrefix)
+	if !ok {
+		return 0, false
+	}
+	version, err := strconv.Atoi(v)
+	return version, err == nil
+}
+
+// ErrorCorruptLog wraps the replay errors due to the log content, that
+// reading it again won't fix
+var ErrorCorruptLog = errors.New("corrupt transaction log")
+
 type Event struct {
 	Sequence  uint64
 	EventType EventType
 	Key       string
 	Value     string
+	written   chan struct{} // Set on the barriers only, closed once the events before are written
 }
 
 type TransactionLogger interface {
 	WriteDelete(key string)
 	WritePut(key, value string)
+	WriteExpire(key string, at time.Time)
+	WriteClear()
+	WriteBounds(key string, min, max *int64)
 }
 
 type TransactionLog struct { // implements TransactionLogger
-	events       chan<- Event // Write-only channel for sending events
-	errors       <-chan error
-	lastSequence uint64   // The last used event sequence number
-	file         *os.File // The location of the transaction log
-	wg           *sync.WaitGroup
+	events        chan<- Event // Write-only channel for sending events
+	errors        <-chan error
+	droppedErrors uint64            // Write errors not delivered, nobody was reading Err()
+	lastSequence  uint64            // The last used event sequence number
+	snapshotSeq   uint64            // The last sequence number covered by a snapshot
+	replayAfter   uint64            // Replay skips the events up to it, see ReplayAfter
+	recovered     bool              // The log already had events when opened
+	tolerateDups  bool              // Skip the events with an already read sequence number
+	skipped       uint64            // Events skipped by the last read
+	file          *os.File          // The location of the transaction log
+	source        io.ReadSeeker     // Read by ReadEvents, the file itself outside of tests
+	schemaVersion int               // Format version of the log, set by ReadEvents
+	aborting      uint32            // Set by Abort, the pending events are no longer written
+	aborted       uint64            // Pending events dropped by Abort
+	replayed      map[EventType]int // Events applied by the last Replay, by type
+	maxLineBytes  int               // Longest line ReadEvents accepts
+	maxBytes      int64             // Size rotating the log, 0 never rotates it
+	size          int64             // Current size of the log file
+	readOnly      bool              // Opened for the replay only
+	mu            sync.Mutex        // Guards file, held by the writes and by Compact
+	wg            *sync.WaitGroup
 }
 
 func (l *TransactionLog) WritePut(key, value string) {
@@ -47,25 +121,231 @@ func (l *TransactionLog) WriteDelete(key string) {
 	l.events <- Event{EventType: EventDelete, Key: key}
 }
 
+// WriteExpire logs the expiry of a key, written after its PUT
+func (l *TransactionLog) WriteExpire(key string, at time.Time) {
+	l.wg.Add(1)
+	l.events <- Event{EventType: EventExpire, Key: key, Value: strconv.FormatInt(at.UnixNano(), 10)}
+}
+
+// WriteClear logs the deletion of all the keys
+func (l *TransactionLog) WriteClear() {
+	l.wg.Add(1)
+	l.events <- Event{EventType: EventClear}
+}
+
+// WriteBounds logs the Increment bounds of a key, written after its PUT
+func (l *TransactionLog) WriteBounds(key string, min, max *int64) {
+	l.wg.Add(1)
+	l.events <- Event{EventType: EventBounds, Key: key, Value: FormatBounds(min, max)}
+}
+
+// WritePutContext is WritePut giving up when ctx is done, as the events
+// channel can be full. The value is then not logged, and lost on restart.
+func (l *TransactionLog) WritePutContext(ctx context.Context, key, value string) error {
+	return l.writeContext(ctx, Event{EventType: EventPut, Key: key, Value: url.QueryEscape(value)})
+}
+
+// WriteDeleteContext is WriteDelete giving up when ctx is done
+func (l *TransactionLog) WriteDeleteContext(ctx context.Context, key string) error {
+	return l.writeContext(ctx, Event{EventType: EventDelete, Key: key})
+}
+
+func (l *TransactionLog) writeContext(ctx context.Context, e Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	l.wg.Add(1)
+	select {
+	case l.events <- e:
+		return nil
+	case <-ctx.Done():
+		l.wg.Done()
+		return ctx.Err()
+	}
+}
+
 func (l *TransactionLog) Err() <-chan error {
 	return l.errors
 }
 
+// DroppedErrors returns how many write errors were dropped because the
+// Err() channel was full
+func (l *TransactionLog) DroppedErrors() uint64 {
+	return atomic.LoadUint64(&l.droppedErrors)
+}
+
+// LastSequence returns the sequence number of the last event written or read
+func (l *TransactionLog) LastSequence() uint64 {
+	return atomic.LoadUint64(&l.lastSequence)
+}
+
+// MarkSnapshot records that the events up to seq are covered by a snapshot,
+// and no longer need a replay at startup
+func (l *TransactionLog) MarkSnapshot(seq uint64) {
+	atomic.StoreUint64(&l.snapshotSeq, seq)
+}
+
+// PendingReplay estimates how many events the next startup will replay
+func (l *TransactionLog) PendingReplay() uint64 {
+	last, snapshot := l.LastSequence(), atomic.LoadUint64(&l.snapshotSeq)
+	if snapshot >= last {
+		return 0
+	}
+	return last - snapshot
+}
+
 func NewTransactionLogger(filename string) (*TransactionLog, error) {
+	// Open the transaction log file for reading and writing.
+	// Any writes to this file (created if not exist) will append/no overwrite
+	return openTransactionLog(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE)
+}
+
+// NewReadOnlyTransactionLogger opens an existing log for the replay only,
+// as read replicas must never write to it
+func NewReadOnlyTransactionLogger(filename string) (*TransactionLog, error) {
+	return openTransactionLog(filename, os.O_RDONLY)
+}
+
+// Transaction logger types of LoggerConfig
+const (
+	LoggerFile = "file"
+)
+
+// ErrorUnsupportedLogger is returned for a logger type this build lacks
+var ErrorUnsupportedLogger = errors.New("unsupported transaction logger")
+
+// DefaultMaxLineBytes is the longest event line read by default, an encoded
+// value takes up to 3 times its size
+const DefaultMaxLineBytes = 64 << 20
+
+// LoggerConfig selects and sets up a transaction logger
+type LoggerConfig struct {
+	Type         string // LoggerFile, the default if empty
+	Path         string // Location of the log
+	ReadOnly     bool   // Only replay the log, see NewReadOnlyTransactionLogger
+	MaxLineBytes int    // Longest event line read, DefaultMaxLineBytes if 0
+	MaxLogBytes  int64  // Size rotating the log to Path.1, shifting the older segments, 0 never rotates it
+}
+
+// NewTransactionLoggerWithConfig opens the transaction log described by c
+func NewTransactionLoggerWithConfig(c LoggerConfig) (*TransactionLog, error) {
+	var l *TransactionLog
+	var err error
+	switch c.Type {
+	case "", LoggerFile:
+		if c.ReadOnly {
+			l, err = NewReadOnlyTransactionLogger(c.Path)
+		} else {
+			l, err = NewTransactionLogger(c.Path)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrorUnsupportedLogger, c.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.MaxLineBytes > 0 {
+		l.maxLineBytes = c.MaxLineBytes
+	}
+	l.maxBytes = c.MaxLogBytes
+	return l, nil
+}
+
+func openTransactionLog(filename string, flag int) (*TransactionLog, error) {
 	var err error
 	var l TransactionLog = TransactionLog{wg: &sync.WaitGroup{}}
 
-	// Open the transaction log file for reading and writing.
-	// Any writes to this file (created if not exist) will append/no overwrite
 	// #nosec [G304] [-- Acceptable risk, for the CWE-22]
-	l.file, err = os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	l.file, err = os.OpenFile(filename, flag, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open transaction log file: %w", err)
 	}
+	l.source = l.file
+	l.maxLineBytes = DefaultMaxLineBytes
+	l.readOnly = flag&(os.O_WRONLY|os.O_RDWR) == 0
+
+	fi, err := l.file.Stat()
+	if err != nil {
+		_ = l.file.Close()
+		return nil, fmt.Errorf("cannot stat transaction log file: %w", err)
+	}
+
+	// A new log starts with its schema version, the existing ones keep theirs
+	l.size = fi.Size()
+	if fi.Size() == 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		n, err := io.WriteString(l.file, schemaHeader(SchemaVersion))
+		if err != nil {
+			_ = l.file.Close()
+			return nil, fmt.Errorf("cannot write transaction log header: %w", err)
+		}
+		l.size = int64(n)
+	}
+
+	// The events appended to an existing log keep its format
+	l.schemaVersion = SchemaVersion
+	if fi.Size() > 0 {
+		l.schemaVersion = l.fileSchemaVersion()
+	}
+
+	// A log with events means recovering from a previous run, not a fresh start
+	l.recovered = fi.Size() > 0 && !l.headerOnly(fi.Size()) || len(rotatedSegments(filename)) > 0
 
 	return &l, nil
 }
 
+// fileSchemaVersion returns the version in the header of the log, 1 without
+func (l *TransactionLog) fileSchemaVersion() int {
+	buf := make([]byte, len(schemaHeader(SchemaVersion))+8)
+	n, _ := l.file.ReadAt(buf, 0)
+	line, _, _ := strings.Cut(string(buf[:n]), "\n")
+	if version, ok := parseSchemaHeader(line); ok {
+		return version
+	}
+	return 1
+}
+
+// headerOnly reports whether the log holds its header and no event
+func (l *TransactionLog) headerOnly(size int64) bool {
+	header := schemaHeader(l.schemaVersion)
+	if size != int64(len(header)) {
+		return false
+	}
+	buf := make([]byte, size)
+	_, err := l.file.ReadAt(buf, 0)
+	return err == nil && string(buf) == header
+}
+
+// name returns the path of the log file, swapped by Compact
+func (l *TransactionLog) name() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Name()
+}
+
+// SchemaVersion returns the format version of the log, known once read
+func (l *TransactionLog) SchemaVersion() int {
+	return l.schemaVersion
+}
+
+// TolerateDuplicates makes ReadEvents skip the events with a sequence number
+// not above the last one read, instead of failing, to recover merged or
+// duplicated logs
+func (l *TransactionLog) TolerateDuplicates(enabled bool) {
+	l.tolerateDups = enabled
+}
+
+// Skipped returns how many duplicated events the last read skipped
+func (l *TransactionLog) Skipped() uint64 {
+	return atomic.LoadUint64(&l.skipped)
+}
+
+// Recovered reports whether the log already had events when it was opened
+func (l *TransactionLog) Recovered() bool {
+	return l.recovered
+}
+
 func (l *TransactionLog) Run() {
 	events := make(chan Event, 16)
 	l.events = events
@@ -77,16 +357,45 @@ func (l *TransactionLog) Run() {
 	// to the transaction log
 	go func() {
 		for e := range events {
-			l.lastSequence++
+			if e.written != nil { // A barrier, not logged
+				close(e.written)
+				continue
+			}
+			if atomic.LoadUint32(&l.aborting) == 1 {
+				atomic.AddUint64(&l.aborted, 1)
+				l.wg.Done()
+				continue
+			}
+
+			l.mu.Lock()
+			seq := atomic.AddUint64(&l.lastSequence, 1)
+
+			// The logs before v3 have raw keys
+			key := e.Key
+			if l.schemaVersion >= 3 {
+				key = url.QueryEscape(key)
+			}
 
 			//Write the event to the log
-			_, err := fmt.Fprintf(
+			n, err := fmt.Fprintf(
 				l.file,
 				"%d\t%d\t%s\t%s\n",
-				l.lastSequence, e.EventType, e.Key, e.Value)
+				seq, e.EventType, key, e.Value)
+			l.size += int64(n)
+			if err != nil {
+				err = fmt.Errorf("cannot write to log file: %w", err)
+			} else if l.maxBytes > 0 && l.size >= l.maxBytes {
+				err = l.rotate()
+			}
+			l.mu.Unlock()
 
 			if err != nil {
-				errors <- fmt.Errorf("cannot write to log file: %w", err)
+				// Never block the writes on an undrained errors channel
+				select {
+				case errors <- err:
+				default:
+					atomic.AddUint64(&l.droppedErrors, 1)
+				}
 			}
 
 			l.wg.Done()
@@ -94,10 +403,36 @@ func (l *TransactionLog) Run() {
 	}()
 }
 
+// Wait waits for the pending events to be written, once the writes stopped.
+// A live log, written meanwhile, waits with barrier.
 func (l *TransactionLog) Wait() {
 	l.wg.Wait()
 }
 
+// barrier waits for the events sent before it to be written, the writes
+// going on meanwhile. It returns at once if the log isn't running.
+func (l *TransactionLog) barrier() {
+	if l.events == nil {
+		return
+	}
+	written := make(chan struct{})
+	l.events <- Event{written: written}
+	<-written
+}
+
+// Flush waits for the pending events to be written and syncs the file, so
+// they are durable once it returns
+func (l *TransactionLog) Flush() error {
+	l.barrier()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync transaction log file: %w", err)
+	}
+	return nil
+}
+
 func (l *TransactionLog) Close() error {
 	l.wg.Wait()
 
@@ -105,70 +440,305 @@ func (l *TransactionLog) Close() error {
 		close(l.events) // Terminates Run loop and goroutine
 	}
 
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	return l.file.Close()
 }
 
+// Abort closes the log without writing the pending events, for a fast
+// shutdown when many writes are queued: unlike Close, the values they hold are
+// lost on restart. It returns how many events were dropped.
+func (l *TransactionLog) Abort() (uint64, error) {
+	atomic.StoreUint32(&l.aborting, 1)
+	// Closing first also interrupts a write stuck on a slow disk
+	err := l.file.Close()
+	l.wg.Wait() // Quick, the pending events are skipped
+
+	if l.events != nil {
+		close(l.events) // Terminates Run loop and goroutine
+	}
+
+	return atomic.LoadUint64(&l.aborted), err
+}
+
+// ReadEvents reads the rotated segments of the log, oldest first, then the
+// log itself, as a single sequence of events
 func (l *TransactionLog) ReadEvents() (<-chan Event, <-chan error) {
-	scanner := bufio.NewScanner(l.file)
 	outEvent := make(chan Event)
 	outError := make(chan error, 1)
+	segments := rotatedSegments(l.name())
 
 	go func() {
-		var e Event
-
 		defer close(outEvent)
 		defer close(outError)
 
 		// Seek to start of file
-		if _, err := l.file.Seek(0, 0); err != nil {
+		if _, err := l.source.Seek(0, 0); err != nil {
 			outError <- fmt.Errorf("failed to seek to start of file: %w", err)
 			return
 		}
+		atomic.StoreUint64(&l.lastSequence, 0) // Reading again, after a failed replay
+		atomic.StoreUint64(&l.skipped, 0)
 
-		for scanner.Scan() {
-			line := scanner.Text()
-
-			n, err := fmt.Sscanf(
-				line, "%d\t%d\t%s\t%s",
-				&e.Sequence, &e.EventType, &e.Key, &e.Value)
-
-			if (err != nil) && (err != io.EOF) {
-				// https://github.com/golang/go/issues/16563
-				// https://go.dev/play/p/3kOqJKusGhz
-				//log.Printf("Scanner error, failure in fmt.Sscanf: %v", err)
-				outError <- fmt.Errorf("input parse error: %w", err)
+		for _, segment := range segments {
+			if err := l.readSegmentFile(segment, outEvent); err != nil {
+				outError <- fmt.Errorf("segment %s: %w", segment, err)
 				return
 			}
+		}
+		if err := l.readSegment(l.source, outEvent); err != nil {
+			outError <- err
+		}
+	}()
 
-			// Sanity check ! All lines must have 4 fields
-			if err == nil && n < 4 {
-				outError <- fmt.Errorf("input wrong number parsed: %w", err)
-				return
-			}
+	return outEvent, outError
+}
 
-			// Sanity check ! Are the sequence numbers in increasing order?
-			if l.lastSequence >= e.Sequence {
-				outError <- fmt.Errorf("transaction numbers out of sequence")
-				return
+// readSegmentFile reads the events of a rotated segment, see readSegment
+func (l *TransactionLog) readSegmentFile(name string, out chan<- Event) error {
+	// #nosec [G304] [-- Acceptable risk, for the CWE-22]
+	file, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("transaction log read failure: %w", err)
+	}
+	defer file.Close()
+
+	return l.readSegment(file, out)
+}
+
+// readSegment reads the events of a log file, each starting with its own
+// schema header, and sends them to out. The sequence numbers must go on
+// from the previous segments.
+func (l *TransactionLog) readSegment(r io.Reader, out chan<- Event) error {
+	scanner := bufio.NewScanner(r)
+	// The buffer grows as needed, up to the limit
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), max(l.maxLineBytes, bufio.MaxScanTokenSize))
+
+	// The logs without a header predate the versioning
+	l.schemaVersion = 1
+
+	for first := true; scanner.Scan(); first = false {
+		line := scanner.Text()
+
+		if version, ok := parseSchemaHeader(line); ok && first {
+			if version < 1 || version > SchemaVersion {
+				return fmt.Errorf("%w: version %d, this reader supports up to %d", ErrorUnsupportedSchema, version, SchemaVersion)
 			}
+			l.schemaVersion = version
+			continue
+		}
 
-			uv, err := url.QueryUnescape(e.Value)
-			if err != nil {
-				outError <- fmt.Errorf("value decoding failure: %w", err)
-				return
+		var e Event
+		var err error
+		switch l.schemaVersion {
+		case 1, 2: // v2 only added the header, and EventExpire
+			e, err = parseEventV1(line)
+		case 3:
+			e, err = parseEventV3(line)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Sanity check ! Are the sequence numbers in increasing order?
+		if l.LastSequence() >= e.Sequence && l.tolerateDups {
+			atomic.AddUint64(&l.skipped, 1)
+			continue
+		}
+		if l.LastSequence() >= e.Sequence {
+			return fmt.Errorf("%w: transaction numbers out of sequence", ErrorCorruptLog)
+		}
+
+		atomic.StoreUint64(&l.lastSequence, e.Sequence) // Update last used sequence #
+
+		out <- e // Send the event along
+	}
+
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("%w: %w, over %d bytes", ErrorCorruptLog, err, l.maxLineBytes)
+	} else if err != nil {
+		return fmt.Errorf("transaction log read failure: %w", err)
+	}
+	return nil
+}
+
+// parseEventV1 parses a "seq\ttype\tkey\tvalue" line, with a URL-encoded value.
+// The line is split by hand, as fmt.Sscanf stops at blanks and fails on the
+// empty value of a DELETE or the empty key of a CLEAR.
+func parseEventV1(line string) (Event, error) {
+	var e Event
+
+	fields := strings.Split(line, "\t")
+	if len(fields) < 4 {
+		return e, fmt.Errorf("%w: event with %d fields, want 4", ErrorCorruptLog, len(fields))
+	}
+
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("%w: invalid sequence number %q", ErrorCorruptLog, fields[0])
+	}
+	e.Sequence = seq
+
+	// A raw tab in the value would split it silently
+	if len(fields) > 4 {
+		return e, fmt.Errorf("%w: event %d: value holds a raw field delimiter, not URL-encoded", ErrorCorruptLog, e.Sequence)
+	}
+
+	t, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return e, fmt.Errorf("%w: event %d: invalid type %q", ErrorCorruptLog, e.Sequence, fields[1])
+	}
+	e.EventType = EventType(t)
+	e.Key = fields[2]
+
+	uv, err := url.QueryUnescape(fields[3])
+	if err != nil {
+		return e, fmt.Errorf("%w: value decoding failure: %w", ErrorCorruptLog, err)
+	}
+	e.Value = uv
+
+	return e, nil
+}
+
+// parseEventV3 parses a v1 line with a URL-encoded key
+func parseEventV3(line string) (Event, error) {
+	e, err := parseEventV1(line)
+	if err != nil {
+		return e, err
+	}
+
+	if e.Key, err = url.QueryUnescape(e.Key); err != nil {
+		return e, fmt.Errorf("%w: event %d: key decoding failure: %w", ErrorCorruptLog, e.Sequence, err)
+	}
+	return e, nil
+}
+
+// Replay reads the events and passes them to apply, in order. It returns
+// how many events were applied.
+func (l *TransactionLog) Replay(apply func(Event) error) (int, error) {
+	events, errs := l.ReadEvents()
+
+	count := 0
+	l.replayed = make(map[EventType]int)
+	for e := range events {
+		if e.Sequence <= l.replayAfter {
+			continue // Covered by the checkpoint
+		}
+		if err := apply(e); err != nil {
+			for range events { // Let ReadEvents finish
 			}
+			return count, err
+		}
+		count++
+		l.replayed[e.EventType]++
+	}
 
-			e.Value = uv
-			l.lastSequence = e.Sequence // Update last used sequence #
+	err := <-errs
+	if err == nil && l.LastSequence() < l.replayAfter {
+		atomic.StoreUint64(&l.lastSequence, l.replayAfter) // The log ends before the checkpoint
+	}
+	return count, err
+}
+
+// ReplayedByType returns how many events of each type the last Replay applied
+func (l *TransactionLog) ReplayedByType() map[EventType]int {
+	replayed := make(map[EventType]int, len(l.replayed))
+	for t, n := range l.replayed {
+		replayed[t] = n
+	}
+	return replayed
+}
 
-			outEvent <- e // Send the event along
+// ReplayWithRetry runs Replay up to attempts times, waiting backoff then twice
+// as long between them, so a momentary I/O glitch doesn't fail the startup.
+// A corrupt or unsupported log fails at once. The events are applied
+// again from the start on each attempt, the replay must be idempotent.
+func (l *TransactionLog) ReplayWithRetry(apply func(Event) error, attempts int, backoff time.Duration) (int, error) {
+	for i := 1; ; i++ {
+		count, err := l.Replay(apply)
+		if err == nil || errors.Is(err, ErrorCorruptLog) || errors.Is(err, ErrorUnsupportedSchema) || i >= attempts {
+			return count, err
 		}
 
-		if err := scanner.Err(); err != nil {
-			outError <- fmt.Errorf("transaction log read failure: %w", err)
-			return
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// BuildState reads the whole log and returns the key/value map it leaves,
+// without touching the store. The keys past their expiry are left out.
+func BuildState(l *TransactionLog) (map[string]string, error) {
+	events, errs := l.ReadEvents()
+
+	state := make(map[string]string)
+	expiry := make(map[string]time.Time)
+	var err error
+	for e := range events {
+		if err != nil {
+			continue // Let ReadEvents finish
 		}
-	}()
 
-	return outEvent, outError
+		switch e.EventType {
+		case EventDelete:
+			delete(state, e.Key)
+			delete(expiry, e.Key)
+		case EventPut: // Stored forever, unless an EventExpire follows
+			state[e.Key] = e.Value
+			delete(expiry, e.Key)
+		case EventClear:
+			state = make(map[string]string)
+			expiry = make(map[string]time.Time)
+		case EventExpire:
+			nanos, perr := strconv.ParseInt(e.Value, 10, 64)
+			if perr != nil {
+				err = fmt.Errorf("%w: invalid expiry of key %s: %w", ErrorCorruptLog, e.Key, perr)
+				continue
+			}
+			if _, ok := state[e.Key]; ok {
+				expiry[e.Key] = time.Unix(0, nanos)
+			}
+		}
+	}
+	if rerr := <-errs; rerr != nil {
+		return nil, rerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for key, at := range expiry {
+		if !now.Before(at) {
+			delete(state, key)
+		}
+	}
+	return state, nil
+}
+
+// History returns the events of the key in the log, oldest first, the clears
+// included as they delete it too. The pending events are written first. The
+// log is read through its own handle, reading l itself would reset the
+// sequence numbers of the writes.
+func (l *TransactionLog) History(key string) ([]Event, error) {
+	l.barrier()
+
+	rl, err := NewReadOnlyTransactionLogger(l.name())
+	if err != nil {
+		return nil, err
+	}
+	defer rl.Close()
+	rl.TolerateDuplicates(l.tolerateDups)
+	rl.maxLineBytes = l.maxLineBytes
+
+	events, errs := rl.ReadEvents()
+	var history []Event
+	for e := range events {
+		if e.Key == key || e.EventType == EventClear {
+			history = append(history, e)
+		}
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return history, nil
 }
@@ -1,7 +1,16 @@
 package internal
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -294,3 +303,650 @@ eventLoop:
 	// 	t.Errorf("Failed to close logger: %v", err)
 	// }
 }
+
+func TestWriteErrorsDoNotBlock(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "test-transaction-log")
+	if err != nil {
+		t.Fatalf("Cannot create temporary file: %v", err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	logger, err := NewTransactionLogger(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to create transaction logger: %v", err)
+	}
+	logger.Run()
+
+	// Every write fails once the file is closed
+	logger.file.Close()
+
+	const writes = 5
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < writes; i++ {
+			logger.WritePut("key", "value")
+		}
+		logger.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Logger hangs on undrained write errors")
+	}
+
+	if err := <-logger.Err(); err == nil {
+		t.Error("Expected a write error")
+	}
+	if dropped := logger.DroppedErrors(); dropped != writes-1 {
+		t.Errorf("Expected %d dropped errors, got %d", writes-1, dropped)
+	}
+}
+
+func TestRecovered(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "recovered.log")
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tl.Recovered() {
+		t.Error("A fresh log is not a recovery")
+	}
+	tl.Run()
+	tl.WritePut("my-key", "my-value")
+	tl.Close()
+
+	tl2, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+	if !tl2.Recovered() {
+		t.Error("Reopening a populated log is a recovery")
+	}
+}
+
+func TestReadEventsRawDelimiter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "delimiter.log")
+	lines := "1\t2\tgood-key\tgood%09value\n" +
+		"2\t2\tbad-key\tbad\tvalue\n"
+	if err := os.WriteFile(filename, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	events, errs := tl.ReadEvents()
+	var read []Event
+	for e := range events {
+		read = append(read, e)
+	}
+
+	// An encoded tab is fine, a raw one is an error naming the event
+	if len(read) != 1 || read[0].Value != "good\tvalue" {
+		t.Errorf("got events %+v, want only the good-key one", read)
+	}
+	err = <-errs
+	if err == nil || !strings.Contains(err.Error(), "event 2") {
+		t.Errorf("got error %v, want one about event 2", err)
+	}
+}
+
+func TestReadEventsEmptyFields(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "empty-fields.log")
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	tl.WritePut("my key", "")
+	tl.WriteDelete("my key")
+	tl.WriteClear()
+	tl.Close()
+
+	tl2, err := NewReadOnlyTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+
+	events, errs := tl2.ReadEvents()
+	var read []Event
+	for e := range events {
+		read = append(read, e)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// The empty value of the PUT and DELETE, and the empty key of the CLEAR
+	want := []Event{
+		{Sequence: 1, EventType: EventPut, Key: "my key"},
+		{Sequence: 2, EventType: EventDelete, Key: "my key"},
+		{Sequence: 3, EventType: EventClear},
+	}
+	if !reflect.DeepEqual(read, want) {
+		t.Errorf("got events %+v, want %+v", read, want)
+	}
+}
+
+// flakySource fails the first read after each seek, failures times
+type flakySource struct {
+	io.ReadSeeker
+	failures int
+	failNext bool
+}
+
+func (f *flakySource) Seek(offset int64, whence int) (int64, error) {
+	f.failNext = f.failures > 0
+	return f.ReadSeeker.Seek(offset, whence)
+}
+
+func (f *flakySource) Read(p []byte) (int, error) {
+	if f.failNext {
+		f.failNext = false
+		f.failures--
+		return 0, errors.New("transient I/O error")
+	}
+	return f.ReadSeeker.Read(p)
+}
+
+func TestReplayWithRetry(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "flaky.log")
+	if err := os.WriteFile(filename, []byte("1\t2\tkey\tvalue\n2\t1\tkey\t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	var applied []Event
+	apply := func(e Event) error {
+		applied = append(applied, e)
+		return nil
+	}
+
+	// Two transient errors, the third attempt goes through
+	tl.source = &flakySource{ReadSeeker: tl.file, failures: 2}
+	count, err := tl.ReplayWithRetry(apply, 3, time.Millisecond)
+	if err != nil || count != 2 {
+		t.Fatalf("ReplayWithRetry() = %d, %v; want 2, nil", count, err)
+	}
+	if len(applied) != 2 || tl.LastSequence() != 2 {
+		t.Errorf("applied %d events up to sequence %d, want 2 up to 2", len(applied), tl.LastSequence())
+	}
+
+	// Not enough attempts
+	tl.source = &flakySource{ReadSeeker: tl.file, failures: 2}
+	if _, err := tl.ReplayWithRetry(apply, 2, time.Millisecond); err == nil {
+		t.Error("expected the transient error after 2 attempts")
+	}
+}
+
+func TestReplayCorruptLogNotRetried(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "corrupt.log")
+	if err := os.WriteFile(filename, []byte("2\t2\tkey\tvalue\n1\t2\tkey\tvalue\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	start := time.Now()
+	_, err = tl.ReplayWithRetry(func(Event) error { return nil }, 5, time.Second)
+	if !errors.Is(err, ErrorCorruptLog) {
+		t.Errorf("got error %v, want %v", err, ErrorCorruptLog)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("a corrupt log was retried")
+	}
+}
+
+func TestReadEventsDuplicateSequence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "merged.log")
+	lines := "1\t2\tkey\tfirst\n" +
+		"2\t2\tkey\tsecond\n" +
+		"2\t2\tkey\tduplicate\n" +
+		"3\t2\tkey\tthird\n"
+	if err := os.WriteFile(filename, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	var values []string
+	apply := func(e Event) error {
+		values = append(values, e.Value)
+		return nil
+	}
+
+	if _, err := tl.Replay(apply); !errors.Is(err, ErrorCorruptLog) {
+		t.Errorf("strict mode: got error %v, want %v", err, ErrorCorruptLog)
+	}
+
+	values = nil
+	tl.TolerateDuplicates(true)
+	count, err := tl.Replay(apply)
+	if err != nil || count != 3 {
+		t.Fatalf("tolerant mode: Replay() = %d, %v; want 3, nil", count, err)
+	}
+	if strings.Join(values, ",") != "first,second,third" || tl.Skipped() != 1 {
+		t.Errorf("tolerant mode: got %v with %d skipped, want [first second third] with 1 skipped", values, tl.Skipped())
+	}
+}
+
+func TestWriteContextCancelled(t *testing.T) {
+	tl, err := NewTransactionLogger(filepath.Join(t.TempDir(), "cancelled.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	// Not running: nobody drains the events, a plain write would block
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan error, 2)
+	go func() {
+		done <- tl.WritePutContext(ctx, "key", "value")
+		done <- tl.WriteDeleteContext(ctx, "key")
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("got error %v, want %v", err, context.Canceled)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("write blocked despite the cancelled context")
+		}
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	dir := t.TempDir()
+	count := func(tl *TransactionLog) (int, error) {
+		return tl.Replay(func(Event) error { return nil })
+	}
+
+	// A v1 log, without header
+	v1 := filepath.Join(dir, "v1.log")
+	if err := os.WriteFile(v1, []byte("1\t2\tkey\tvalue\n2\t1\tkey\t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := NewTransactionLogger(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := count(tl); err != nil || n != 2 || tl.SchemaVersion() != 1 {
+		t.Errorf("v1 log: got %d events, version %d, %v; want 2, version 1", n, tl.SchemaVersion(), err)
+	}
+	tl.Close()
+
+	// A v2 log keeps its raw keys when appended to
+	v2 := filepath.Join(dir, "v2.log")
+	if err := os.WriteFile(v2, []byte("#gokvs-log v2\n1\t2\tkey\tvalue\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tl, err = NewTransactionLogger(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := count(tl); err != nil || n != 1 || tl.SchemaVersion() != 2 {
+		t.Errorf("v2 log: got %d events, version %d, %v; want 1, version 2", n, tl.SchemaVersion(), err)
+	}
+	tl.Run()
+	tl.WritePut("key:2", "value")
+	tl.Close()
+	if content, _ := os.ReadFile(v2); !strings.HasSuffix(string(content), "\tkey:2\tvalue\n") {
+		t.Errorf("v2 log content = %q, want a raw key appended", content)
+	}
+
+	// A new log is written as v3
+	v3 := filepath.Join(dir, "v3.log")
+	tl, err = NewTransactionLogger(v3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	tl.WritePut("key:3", "value")
+	tl.Close()
+	if content, _ := os.ReadFile(v3); string(content) != "#gokvs-log v3\n1\t2\tkey%3A3\tvalue\n" {
+		t.Errorf("v3 log content = %q, want a header then an encoded key", content)
+	}
+	tl, err = NewTransactionLogger(v3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := count(tl); err != nil || n != 1 || tl.SchemaVersion() != 3 {
+		t.Errorf("v3 log: got %d events, version %d, %v; want 1, version 3", n, tl.SchemaVersion(), err)
+	}
+	tl.Close()
+
+	// A log from a future version is rejected, not misparsed
+	v4 := filepath.Join(dir, "v4.log")
+	if err := os.WriteFile(v4, []byte("#gokvs-log v4\n1\t2\tkey\tvalue\textra-field\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tl, err = NewTransactionLogger(v4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	if _, err := count(tl); !errors.Is(err, ErrorUnsupportedSchema) {
+		t.Errorf("v4 log: got error %v, want %v", err, ErrorUnsupportedSchema)
+	}
+}
+
+func TestReadEventsEncodedKeys(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "keys.log")
+	keys := []string{"with space", "with\ttab", "with\nnewline", "100%+plus"}
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	for _, key := range keys {
+		tl.WritePut(key, "value")
+		tl.WriteDelete(key)
+	}
+	tl.Close()
+
+	tl2, err := NewReadOnlyTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+
+	events, errs := tl2.ReadEvents()
+	var read []string
+	for e := range events {
+		read = append(read, e.Key)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	want := []string{keys[0], keys[0], keys[1], keys[1], keys[2], keys[2], keys[3], keys[3]}
+	if !reflect.DeepEqual(read, want) {
+		t.Errorf("got keys %q, want %q", read, want)
+	}
+}
+
+func TestHeaderOnlyLogNotRecovered(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "header-only.log")
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Close()
+
+	tl, err = NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	if tl.Recovered() {
+		t.Error("a log without events is not a recovery")
+	}
+}
+
+func TestShutdownQueuedWrites(t *testing.T) {
+	// A pipe nobody reads fills up like a stuck disk, queuing the writes
+	queue := func(t *testing.T) (*TransactionLog, *os.File) {
+		tl, err := NewTransactionLogger(filepath.Join(t.TempDir(), "queued.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tl.file.Close()
+		tl.file = w
+		tl.Run()
+
+		value := strings.Repeat("v", 16<<10)
+		for i := 0; i < 20; i++ {
+			tl.WritePut("key", value)
+		}
+		return tl, r
+	}
+
+	t.Run("flush", func(t *testing.T) {
+		tl, r := queue(t)
+		defer r.Close()
+
+		lines := make(chan int)
+		go func() {
+			data, _ := io.ReadAll(r)
+			lines <- strings.Count(string(data), "\n")
+		}()
+
+		if err := tl.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-lines; got != 20 {
+			t.Errorf("got %d events written, want 20", got)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		tl, r := queue(t)
+		defer r.Close()
+
+		done := make(chan uint64)
+		go func() {
+			dropped, _ := tl.Abort()
+			done <- dropped
+		}()
+
+		select {
+		case dropped := <-done:
+			if dropped == 0 {
+				t.Error("no pending event dropped")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Abort waits for the queued writes")
+		}
+	})
+}
+
+func TestBuildState(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.log")
+
+	tl, err := NewTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	tl.WritePut("cleared", "gone")
+	tl.WriteClear()
+	tl.WritePut("kept", "v1")
+	tl.WritePut("overwritten", "v1")
+	tl.WritePut("deleted", "v1")
+	tl.WritePut("overwritten", "v2")
+	tl.WriteDelete("deleted")
+	tl.WritePut("expired", "v1")
+	tl.WriteExpire("expired", time.Now().Add(-time.Second))
+	tl.WritePut("expiring", "v1")
+	tl.WriteExpire("expiring", time.Now().Add(time.Hour))
+	tl.WritePut("persisted", "v1")
+	tl.WriteExpire("persisted", time.Now().Add(-time.Second))
+	tl.WritePut("persisted", "v2") // Stored forever again
+	tl.Close()
+
+	tl2, err := NewReadOnlyTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+
+	state, err := BuildState(tl2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"kept": "v1", "overwritten": "v2", "expiring": "v1", "persisted": "v2"}
+	if !reflect.DeepEqual(state, want) {
+		t.Errorf("BuildState() = %v, want %v", state, want)
+	}
+}
+
+func TestReadEventsLargeValue(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "large.log")
+	value := strings.Repeat("a value\n", 1<<18) // 2 MiB, 4 MiB once encoded
+
+	tl, err := NewTransactionLoggerWithConfig(LoggerConfig{Path: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	tl.WritePut("large-key", value)
+	tl.Close()
+
+	read := func(maxLineBytes int) ([]Event, error) {
+		tl, err := NewTransactionLoggerWithConfig(LoggerConfig{Path: filename, ReadOnly: true, MaxLineBytes: maxLineBytes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tl.Close()
+
+		events, errs := tl.ReadEvents()
+		var read []Event
+		for e := range events {
+			read = append(read, e)
+		}
+		return read, <-errs
+	}
+
+	events, err := read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Value != value {
+		t.Errorf("got %d events, want the large value intact", len(events))
+	}
+
+	if _, err := read(1 << 20); !errors.Is(err, ErrorCorruptLog) || !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("line over the limit: got error %v, want %v", err, bufio.ErrTooLong)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transactions.log")
+	config := LoggerConfig{Path: filename, MaxLogBytes: 256}
+
+	tl, err := NewTransactionLoggerWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	const writes = 100
+	for i := 0; i < writes; i++ {
+		tl.WritePut(fmt.Sprintf("key-%d", i), "value")
+	}
+	tl.Close()
+
+	segments := rotatedSegments(filename)
+	if len(segments) < 2 {
+		t.Fatalf("got %d rotated segments, want several", len(segments))
+	}
+	if last := segments[len(segments)-1]; last != filename+".1" {
+		t.Errorf("newest segment %s, want %s.1", last, filename)
+	}
+
+	// The replay spans the segments, in order, then the log goes on after them
+	tl, err = NewTransactionLoggerWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint64
+	count, err := tl.Replay(func(e Event) error {
+		seqs = append(seqs, e.Sequence)
+		return nil
+	})
+	if err != nil || count != writes {
+		t.Fatalf("Replay() = %d, %v; want %d events", count, err, writes)
+	}
+	for i, seq := range seqs {
+		if seq != uint64(i+1) {
+			t.Fatalf("event %d has sequence number %d, want %d", i, seq, i+1)
+		}
+	}
+	tl.Run()
+	tl.WriteDelete("key-0")
+	tl.Wait()
+	if got := tl.LastSequence(); got != writes+1 {
+		t.Errorf("LastSequence() = %d, want %d", got, writes+1)
+	}
+
+	// Compact merges the segments in the log
+	if _, err := tl.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	tl.Close()
+	if segments := rotatedSegments(filename); len(segments) != 0 {
+		t.Errorf("segments left after Compact(): %v", segments)
+	}
+	tl, err = NewReadOnlyTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	state, err := BuildState(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state["key-0"]; len(state) != writes-1 || ok {
+		t.Errorf("compacted log: got %d keys, key-0 %t; want %d keys, without key-0", len(state), ok, writes-1)
+	}
+}
+
+func TestFlushUnderWrites(t *testing.T) {
+	tl, err := NewTransactionLogger(filepath.Join(t.TempDir(), "transactions.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	defer tl.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					tl.WritePut("key", "value")
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		if err := tl.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
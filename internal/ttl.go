@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrorInvalidTTL is returned for a TTL that isn't positive
+var ErrorInvalidTTL = errors.New("TTL must be positive")
+
+// PutWithTTL stores the value for ttl, then Get treats the key as missing.
+// Put stores the values forever.
+func PutWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrorInvalidTTL
+	}
+	return PutWithExpiry(key, value, time.Now().Add(ttl))
+}
+
+// PutWithExpiry stores the value until the absolute time at
+func PutWithExpiry(key, value string, at time.Time) error {
+	s := shardOf(key)
+	if err := s.lock(); err != nil {
+		return err
+	}
+	s.putLocked(key, value)
+	s.expiry[key] = at
+	s.Unlock()
+
+	evictOverflow()
+	return nil
+}
+
+// PutWithSlidingTTL stores the value until it isn't read for ttl, as each Get
+// pushes the expiry back, for an idle-eviction cache. It returns the first
+// expiry, for the transaction log: the reads are not logged, so after a
+// restart the key expires at that time and no longer slides.
+func PutWithSlidingTTL(key, value string, ttl time.Duration) (time.Time, error) {
+	if ttl <= 0 {
+		return time.Time{}, ErrorInvalidTTL
+	}
+	s := shardOf(key)
+	if err := s.lock(); err != nil {
+		return time.Time{}, err
+	}
+	at := time.Now().Add(ttl)
+	s.putLocked(key, value)
+	s.expiry[key] = at
+	s.sliding[key] = ttl
+	s.Unlock()
+
+	evictOverflow()
+	return at, nil
+}
+
+// slideExpiry pushes back the expiry at of a key read by Get. It only takes
+// the write lock when the expiry moves by a tenth of the TTL, so a hot key
+// doesn't serialize its reads.
+func (s *shard) slideExpiry(key string, at time.Time, ttl time.Duration) {
+	next := time.Now().Add(ttl)
+	if next.Sub(at) < ttl/10 {
+		return
+	}
+
+	s.Lock()
+	if _, ok := s.sliding[key]; ok && next.After(s.expiry[key]) {
+		s.expiry[key] = next
+	}
+	s.Unlock()
+}
+
+// ExpireAt sets the expiry of an existing key, and deletes it at once if at
+// is past. The replay uses it to restore the TTLs.
+func ExpireAt(key string, at time.Time) error {
+	s := shardOf(key)
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.Unlock()
+
+	if _, ok := s.m[key]; !ok {
+		return ErrorNoSuchKey
+	}
+	if !at.After(time.Now()) {
+		s.deleteLocked(key)
+		return nil
+	}
+	s.expiry[key] = at
+	return nil
+}
+
+// expiredLocked reports whether the key has a TTL over at now, the caller
+// holds s.RLock()
+func (s *shard) expiredLocked(key string, now time.Time) bool {
+	at, ok := s.expiry[key]
+	return ok && !now.Before(at)
+}
+
+// removeExpired deletes the key if it's still expired, Get found it expired
+// under the read lock and removes it lazily
+func (s *shard) removeExpired(key string) {
+	s.Lock()
+	if s.expiredLocked(key, time.Now()) {
+		s.deleteLocked(key)
+	}
+	s.Unlock()
+}
+
+// sweepBatch is the most keys deleted under one shard lock by the sweeper
+const sweepBatch = 100
+
+// sweptKeys counts the expired keys deleted by the sweeper
+var sweptKeys atomic.Uint64
+
+// SweptKeys returns how many expired keys the sweeper deleted
+func SweptKeys() uint64 {
+	return sweptKeys.Load()
+}
+
+// StartExpirySweeper deletes the expired keys every interval, as the lazy
+// expiry of Get leaves the keys never read again in memory. It stops when
+// ctx is done, then closes the returned channel.
+func StartExpirySweeper(ctx context.Context, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sweepExpired()
+			}
+		}
+	}()
+
+	return done
+}
+
+// sweepExpired sweeps the shards one after the other, and returns how many
+// keys were deleted
+func sweepExpired() int {
+	swept := 0
+	for _, s := range store.shards {
+		swept += s.sweepExpired()
+	}
+
+	sweptKeys.Add(uint64(swept))
+	return swept
+}
+
+// sweepExpired lists the expired keys of the shard under the read lock, then
+// deletes them in short write-locked bursts, so Get and Put are never blocked
+// for long
+func (s *shard) sweepExpired() int {
+	now := time.Now()
+
+	var expired []string
+	s.RLock()
+	for key := range s.expiry {
+		if s.expiredLocked(key, now) {
+			expired = append(expired, key)
+		}
+	}
+	s.RUnlock()
+
+	swept := 0
+	for len(expired) > 0 {
+		n := min(sweepBatch, len(expired))
+
+		s.Lock()
+		for _, key := range expired[:n] {
+			if s.expiredLocked(key, time.Now()) { // Not refreshed since
+				s.deleteLocked(key)
+				swept++
+			}
+		}
+		s.Unlock()
+
+		expired = expired[n:]
+	}
+	return swept
+}
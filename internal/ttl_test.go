@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// resident reports whether the key is still in its shard, even expired
+func resident(key string) bool {
+	s := shardOf(key)
+	s.RLock()
+	defer s.RUnlock()
+
+	_, ok := s.m[key]
+	return ok
+}
+
+func TestPutWithTTL(t *testing.T) {
+	const key = "ttl-key"
+
+	if err := PutWithTTL(key, "value", 0); !errors.Is(err, ErrorInvalidTTL) {
+		t.Errorf("PutWithTTL(0) error = %v, want %v", err, ErrorInvalidTTL)
+	}
+
+	if err := PutWithTTL(key, "value", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := Get(key); err != nil || value != "value" {
+		t.Errorf("Get() before expiry = %q, %v; want %q", value, err, "value")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := Get(key); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Get() after expiry error = %v, want %v", err, ErrorNoSuchKey)
+	}
+
+	// Removed lazily by the Get
+	s := shardOf(key)
+	s.RLock()
+	_, stored := s.m[key]
+	_, expiring := s.expiry[key]
+	s.RUnlock()
+	if stored || expiring {
+		t.Error("expired key still stored after Get")
+	}
+}
+
+func TestPutClearsTTL(t *testing.T) {
+	const key = "ttl-cleared-key"
+
+	if err := PutWithTTL(key, "short-lived", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := Put(key, "forever"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if value, err := Get(key); err != nil || value != "forever" {
+		t.Errorf("Get() = %q, %v; want %q", value, err, "forever")
+	}
+}
+
+func TestExpireAt(t *testing.T) {
+	const key = "expire-at-key"
+
+	if err := ExpireAt("missing-key", time.Now().Add(time.Hour)); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("ExpireAt() on a missing key error = %v, want %v", err, ErrorNoSuchKey)
+	}
+
+	if err := Put(key, "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExpireAt(key, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(key); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Get() after a past expiry error = %v, want %v", err, ErrorNoSuchKey)
+	}
+}
+
+func TestExpirySweeper(t *testing.T) {
+	for i := 0; i < sweepBatch+10; i++ {
+		if err := PutWithTTL(fmt.Sprintf("sweep-key-%d", i), "value", time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := PutWithTTL("sweep-kept", "value", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	swept := SweptKeys()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := StartExpirySweeper(ctx, 5*time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for SweptKeys()-swept < sweepBatch+10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("swept %d keys, want %d", SweptKeys()-swept, sweepBatch+10)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	gone := resident("sweep-key-0")
+	kept := resident("sweep-kept")
+	if gone || !kept {
+		t.Errorf("sweep-key-0 stored: %t, sweep-kept stored: %t; want false, true", gone, kept)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sweeper still running after the context was cancelled")
+	}
+}
+
+func TestSlidingTTL(t *testing.T) {
+	const key = "ttl-sliding-key"
+
+	if _, err := PutWithSlidingTTL(key, "value", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read for longer than the TTL, it never expires
+	for i := 0; i < 6; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if _, err := Get(key); err != nil {
+			t.Fatalf("Get() after %d reads: %v", i, err)
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := Get(key); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Get() after idle error = %v, want %v", err, ErrorNoSuchKey)
+	}
+}
@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrorNotInteger = errors.New("value is not an integer")
+var ErrorOverflow = errors.New("integer overflow")
+var ErrorOutOfBounds = errors.New("value out of bounds")
+var ErrorInvalidBounds = errors.New("invalid bounds")
+
+// Increment adds delta to the integer value of the key under a single lock,
+// a missing key counting as 0, and returns the new value. The TTL of the key
+// is cleared, like by a Put.
+func Increment(key string, delta int64) (int64, error) {
+	defer evictOverflow() // Once unlocked, a missing key is added
+	s := shardOf(key)
+	if err := s.lock(); err != nil {
+		return 0, err
+	}
+	defer s.Unlock()
+
+	var n int64
+	if value, ok := s.m[key]; ok && !s.expiredLocked(key, time.Now()) {
+		var err error
+		if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, fmt.Errorf("%w: key %s", ErrorNotInteger, key)
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, fmt.Errorf("%w: key %s", ErrorOverflow, key)
+	}
+
+	n += delta
+	if meta := s.meta[key]; (meta.Min != nil && n < *meta.Min) || (meta.Max != nil && n > *meta.Max) {
+		return 0, fmt.Errorf("%w: key %s, %d not in [%s]", ErrorOutOfBounds, key, n, FormatBounds(meta.Min, meta.Max))
+	}
+	s.putLocked(key, strconv.FormatInt(n, 10))
+	return n, nil
+}
+
+// SetBounds sets the bounds Increment keeps the integer value of the key
+// within, a nil one is unbounded. They are kept in the metadata of the key,
+// until it's deleted.
+func SetBounds(key string, min, max *int64) error {
+	if min != nil && max != nil && *min > *max {
+		return fmt.Errorf("%w: min %d above max %d", ErrorInvalidBounds, *min, *max)
+	}
+
+	s := shardOf(key)
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.Unlock()
+
+	if _, ok := s.m[key]; !ok || s.expiredLocked(key, time.Now()) {
+		return ErrorNoSuchKey
+	}
+	meta := s.meta[key]
+	meta.Min, meta.Max = min, max
+	s.meta[key] = meta
+	return nil
+}
+
+// FormatBounds returns the "min:max" form of the bounds, as logged, with an
+// empty side when unbounded
+func FormatBounds(min, max *int64) string {
+	var b strings.Builder
+	if min != nil {
+		b.WriteString(strconv.FormatInt(*min, 10))
+	}
+	b.WriteByte(':')
+	if max != nil {
+		b.WriteString(strconv.FormatInt(*max, 10))
+	}
+	return b.String()
+}
+
+// ParseBounds parses the "min:max" form of FormatBounds
+func ParseBounds(s string) (min, max *int64, err error) {
+	lo, hi, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %q, expected min:max", ErrorInvalidBounds, s)
+	}
+	if min, err = parseBound(lo); err != nil {
+		return nil, nil, err
+	}
+	if max, err = parseBound(hi); err != nil {
+		return nil, nil, err
+	}
+	return min, max, nil
+}
+
+// parseBound parses one side of the bounds, nil if empty
+func parseBound(s string) (*int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q is not an integer", ErrorInvalidBounds, s)
+	}
+	return &n, nil
+}
+
+// Append concatenates suffix to the value of the key under a single lock, a
+// missing key counting as empty, and returns the new value. The TTL of the
+// key is cleared, like by a Put.
+func Append(key, suffix string) (string, error) {
+	defer evictOverflow() // Once unlocked, a missing key is added
+	s := shardOf(key)
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	defer s.Unlock()
+
+	var value string
+	if current, ok := s.m[key]; ok && !s.expiredLocked(key, time.Now()) {
+		value = current
+	}
+
+	value += suffix
+	s.putLocked(key, value)
+	return value, nil
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestIncrementConcurrent(t *testing.T) {
+	_, _ = Delete("incr-counter")
+
+	const goroutines, increments = 50, 100
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if _, err := Increment("incr-counter", 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := strconv.Itoa(goroutines * increments)
+	if value, err := Get("incr-counter"); err != nil || value != want {
+		t.Errorf("Get() = %q, %v; want %q", value, err, want)
+	}
+}
+
+func TestIncrementErrors(t *testing.T) {
+	if err := Put("incr-text", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Increment("incr-text", 1); !errors.Is(err, ErrorNotInteger) {
+		t.Errorf("got error %v, want %v", err, ErrorNotInteger)
+	}
+
+	if err := Put("incr-max", strconv.FormatInt(math.MaxInt64, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Increment("incr-max", 1); !errors.Is(err, ErrorOverflow) {
+		t.Errorf("got error %v, want %v", err, ErrorOverflow)
+	}
+	if n, err := Increment("incr-max", -1); err != nil || n != math.MaxInt64-1 {
+		t.Errorf("Increment(-1) = %d, %v; want %d", n, err, int64(math.MaxInt64-1))
+	}
+}
+
+func TestIncrementBounds(t *testing.T) {
+	_, _ = Delete("incr-quota")
+	if err := SetBounds("incr-quota", nil, nil); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("SetBounds() on a missing key: got error %v, want %v", err, ErrorNoSuchKey)
+	}
+	if err := Put("incr-quota", "0"); err != nil {
+		t.Fatal(err)
+	}
+	min, max := int64(0), int64(3)
+	if err := SetBounds("incr-quota", &max, &min); !errors.Is(err, ErrorInvalidBounds) {
+		t.Errorf("SetBounds(3, 0): got error %v, want %v", err, ErrorInvalidBounds)
+	}
+	if err := SetBounds("incr-quota", &min, &max); err != nil {
+		t.Fatal(err)
+	}
+
+	for want := int64(1); want <= max; want++ {
+		if n, err := Increment("incr-quota", 1); err != nil || n != want {
+			t.Fatalf("Increment() = %d, %v; want %d", n, err, want)
+		}
+	}
+	if _, err := Increment("incr-quota", 1); !errors.Is(err, ErrorOutOfBounds) {
+		t.Errorf("Increment() over max: got error %v, want %v", err, ErrorOutOfBounds)
+	}
+	if _, err := Increment("incr-quota", -4); !errors.Is(err, ErrorOutOfBounds) {
+		t.Errorf("Increment() under min: got error %v, want %v", err, ErrorOutOfBounds)
+	}
+	if value, _ := Get("incr-quota"); value != "3" {
+		t.Errorf("value = %q after the refused increments, want %q", value, "3")
+	}
+
+	// The bounds go with the key
+	_, _ = Delete("incr-quota")
+	if n, err := Increment("incr-quota", 10); err != nil || n != 10 {
+		t.Errorf("Increment() after a DELETE = %d, %v; want 10", n, err)
+	}
+}
+
+func TestParseBounds(t *testing.T) {
+	for _, s := range []string{":", "0:", ":100", "-5:5"} {
+		min, max, err := ParseBounds(s)
+		if err != nil {
+			t.Errorf("ParseBounds(%q) error = %v", s, err)
+		} else if got := FormatBounds(min, max); got != s {
+			t.Errorf("FormatBounds(ParseBounds(%q)) = %q", s, got)
+		}
+	}
+	for _, s := range []string{"", "1", "a:1", "1:b"} {
+		if _, _, err := ParseBounds(s); !errors.Is(err, ErrorInvalidBounds) {
+			t.Errorf("ParseBounds(%q) error = %v, want %v", s, err, ErrorInvalidBounds)
+		}
+	}
+}
+
+func TestAppendConcurrent(t *testing.T) {
+	_, _ = Delete("append-log")
+
+	const goroutines, appends = 20, 50
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < appends; j++ {
+				if _, err := Append("append-log", "x"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, err := Get("append-log"); err != nil || len(value) != goroutines*appends {
+		t.Errorf("Get() = %d bytes, %v; want %d bytes", len(value), err, goroutines*appends)
+	}
+}
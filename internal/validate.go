@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrorInvalidKey is returned by ValidateKey
+var ErrorInvalidKey = errors.New("invalid key")
+
+// maxKeyLength bounds the key length in bytes, 0 is unlimited
+var maxKeyLength atomic.Int64
+
+// SetMaxKeyLength bounds the length of the keys ValidateKey accepts, in
+// bytes. Zero is unlimited.
+func SetMaxKeyLength(n int) {
+	maxKeyLength.Store(int64(n))
+}
+
+// ValidateKey checks a key before a write. A tab or a newline would split
+// the key across the fields or lines of the transaction log, which then
+// fails to replay.
+func ValidateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: empty", ErrorInvalidKey)
+	}
+	if strings.ContainsAny(key, "\t\n") {
+		return fmt.Errorf("%w: %q holds a tab or a newline", ErrorInvalidKey, key)
+	}
+	if n := maxKeyLength.Load(); n > 0 && int64(len(key)) > n {
+		return fmt.Errorf("%w: %d bytes, over the maximum of %d", ErrorInvalidKey, len(key), n)
+	}
+	return nil
+}